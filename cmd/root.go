@@ -2,16 +2,24 @@ package cmd
 
 import (
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"os"
 
 	"github.com/spf13/cobra"
+
+	"github.com/uyuni-project/minima/get"
 )
 
 var (
 	version   string
 	cfgFile   string
 	cfgString string
+	logLevel  string
+	logFormat string
+	logFile   string
+	// progress reports package downloads, log lines are written through it
+	progress *get.ProgressTracker
 )
 
 // RootCmd represents the base command when called without any subcommands
@@ -20,6 +28,10 @@ var (
 		Use:   "minima",
 		Short: "A Simple Linux Repository Manager",
 		Long:  "minima mirrors and manages Linux package repositories.",
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			quiet, _ := cmd.Flags().GetBool("quiet")
+			return initLogging(quiet)
+		},
 		Run: func(cmd *cobra.Command, args []string) {
 			versionFlag, _ := cmd.Flags().GetBool("version")
 			if versionFlag {
@@ -46,6 +58,9 @@ func init() {
 	// all sub-commands will have access to this flag
 	RootCmd.PersistentFlags().StringVarP(&cfgFile, "config", "c", "minima.yaml", "config file")
 	RootCmd.PersistentFlags().BoolP("quiet", "q", false, "greatly reduces the number of logs")
+	RootCmd.PersistentFlags().StringVar(&logLevel, "log-level", "info", "minimum level of logs: debug, info, warn or error")
+	RootCmd.PersistentFlags().StringVar(&logFormat, "log-format", "text", "format of logs: text or json")
+	RootCmd.PersistentFlags().StringVar(&logFile, "log-file", "", "append logs to a file instead of standard error")
 	// local flags
 	RootCmd.Flags().BoolP("version", "v", false, "Print minima version")
 }
@@ -56,7 +71,7 @@ func initConfig() {
 	ev := os.Getenv("MINIMA_CONFIG")
 	if ev != "" {
 		cfgString = ev
-		fmt.Println("Using configuration from $MINIMA_CONFIG")
+		slog.Info("Using configuration from $MINIMA_CONFIG")
 		return
 	}
 
@@ -64,9 +79,47 @@ func initConfig() {
 	if cfgFile != "" {
 		bytes, err := os.ReadFile(cfgFile)
 		if err != nil {
-			log.Fatal(err)
+			fatal("Cannot read config file", err)
 		}
 		cfgString = string(bytes)
-		fmt.Println("Using config file:", cfgFile)
+		slog.Info("Using config file", "file", cfgFile)
 	}
 }
+
+// initLogging sets up the default logger according to the logging flags
+func initLogging(quiet bool) error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(logLevel)); err != nil {
+		return fmt.Errorf("invalid log level %s, expected debug, info, warn or error", logLevel)
+	}
+
+	// keeps log lines above the status line on terminals
+	progress = get.NewProgressTracker(os.Stderr, quiet)
+	var out io.Writer = progress
+	if logFile != "" {
+		file, err := os.OpenFile(logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		out = file
+	}
+
+	options := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch logFormat {
+	case "text":
+		handler = slog.NewTextHandler(out, options)
+	case "json":
+		handler = slog.NewJSONHandler(out, options)
+	default:
+		return fmt.Errorf("invalid log format %s, expected text or json", logFormat)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// fatal logs an error and exits
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
@@ -0,0 +1,45 @@
+package cmd
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInitLogging(t *testing.T) {
+	defaultLogger := slog.Default()
+	defer func() {
+		slog.SetDefault(defaultLogger)
+		logLevel, logFormat, logFile = "info", "text", ""
+	}()
+
+	logLevel, logFormat, logFile = "warn", "json", filepath.Join(t.TempDir(), "minima.log")
+	if err := initLogging(true); err != nil {
+		t.Fatal(err)
+	}
+	slog.Info("Downloading packages", "repo", "http://example.com/repo")
+	slog.Warn("Download failed, retrying", "repo", "http://example.com/repo", "file", "a.rpm")
+
+	bytes, err := os.ReadFile(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(bytes)), "\n")
+	assert.Len(t, lines, 1)
+	var record map[string]any
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &record))
+	assert.Equal(t, "WARN", record["level"])
+	assert.Equal(t, "Download failed, retrying", record["msg"])
+	assert.Equal(t, "http://example.com/repo", record["repo"])
+	assert.Equal(t, "a.rpm", record["file"])
+
+	logLevel, logFormat, logFile = "loud", "text", ""
+	assert.Error(t, initLogging(true))
+	logLevel, logFormat = "info", "xml"
+	assert.Error(t, initLogging(true))
+}
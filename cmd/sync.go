@@ -2,9 +2,10 @@ package cmd
 
 import (
 	"fmt"
-	"log"
+	"log/slog"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 
@@ -12,6 +13,7 @@ import (
 
 	"github.com/uyuni-project/minima/get"
 	"github.com/uyuni-project/minima/updates"
+	"github.com/uyuni-project/minima/util"
 	yaml "gopkg.in/yaml.v2"
 )
 
@@ -22,7 +24,8 @@ var (
 	syncCmd = &cobra.Command{
 		Use:   "sync",
 		Short: "Synchronizes repos from remote locations",
-		Long: `Synchronizes content in repos to a directory or an S3 bucket.
+		Long: `Synchronizes content in repos to a directory, a remote directory over SFTP, an S3 bucket,
+  a Google Cloud Storage bucket or an Azure Blob Storage container.
 
   You can specify configuration in YAML either in a file or the MINIMA_CONFIG environment variable.
 
@@ -33,14 +36,128 @@ var (
       path: /srv/mirror
       # uncomment to save to an AWS S3 bucket instead of the filesystem
       # type: s3
+      # static credentials, if omitted the standard AWS credential chain is used
+      # (environment, shared config, web identity, instance metadata)
       # access_key_id: ACCESS_KEY_ID
       # secret_access_key: SECRET_ACCESS_KEY
+      # profile: default
+      # role_arn: arn:aws:iam::123456789012:role/minima
       # region: us-east-1
       # bucket: minima-bucket-key
+      # uncomment to use an S3-compatible service such as MinIO or Ceph RGW
+      # endpoint: http://localhost:9000
+      # force_path_style: true
+      # disable_ssl: true
+      # skip_bucket_creation: true
+      # skip_website_configuration: true
+      # uncomment to save to a Google Cloud Storage bucket instead of the filesystem
+      # type: gcs
+      # jsonpath: /etc/minima/service-account.json
+      # projectid: my-project
+      # bucket: minima-bucket
+      # endpoint: http://localhost:4443
+      # uncomment to save to an Azure Blob Storage container instead of the filesystem
+      # type: azure
+      # account_name: minimaaccount
+      # container: minima
+      # one of account_key, sas_token or managed_identity
+      # account_key: ACCOUNT_KEY
+      # sas_token: SAS_TOKEN
+      # managed_identity: true
+      # uncomment to save to a directory on a remote host over SFTP instead of the filesystem
+      # type: sftp
+      # host: mirror.example.com:22
+      # user: minima
+      # path: /srv/mirror
+      # key_file: /etc/minima/id_ed25519
+      # known_hosts_file: /etc/minima/known_hosts
+
+    # uncomment instead of storage to replicate to several storages at once
+    # storages:
+    #   - type: file
+    #     path: /srv/mirror
+    #   - type: s3
+    #     name: aws-mirror
+    #     region: us-east-1
+    #     bucket: minima-bucket-key
+    # replication:
+    #   # abort (default) fails the sync if any storage fails, continue skips
+    #   # failed storages, commits the others and reports the failure
+    #   on_failure: continue
+    #   # retries of failed storage operations, except downloads
+    #   retries: 3
 
     http:
       - url: http://download.opensuse.org/repositories/myrepo1/openSUSE_Leap_42.3/
         archs: [x86_64]
+        # optional, rpm, deb, apk or pacman, by default the type is detected
+        # type: rpm
+        # apk and pacman only, required, public keys trusted to sign metadata (PEM for apk, OpenPGP for pacman)
+        # keys: [/etc/apk/keys/alpine-devel@lists.alpinelinux.org-6165ee59.rsa.pub]
+        # optional, the repo name, by default the last element of the URL path, or
+        # <name> in <name>/os/<arch> for pacman
+        # name: myrepo1
+        # optional, rpm only, rewrite metadata to only list synced packages,
+        # eg. when filtering by arch (signed only if signing_key is set)
+        # regenerate_metadata: true
+        # optional, rpm only, also sync delta rpms (.drpm) of synced packages
+        # delta_rpms: true
+        # optional, whether source packages (src, nosrc, Debian Sources) and
+        # debugging information packages (-debuginfo, -debugsource, -dbgsym) are
+        # synced: include, exclude or only. By default they are synced like others,
+        # by arch
+        # sources: include
+        # debuginfo: exclude
+        # optional, verify files against all the checksums listed in metadata (eg.
+        # MD5Sum, SHA1 and SHA512 of deb repos), not only one of them
+        # verify_all_checksums: true
+        # optional, deb only, patterns of indexes listed in Release to sync or not,
+        # matching their path or a parent directory (patterns without a slash match
+        # names at any depth). The Release file is rewritten to only list synced
+        # indexes, and signed with signing_key, which is then required. Files not
+        # listed in Release, such as installer images, are never synced
+        # include_indexes: [main/binary-amd64/*, main/i18n/Translation-en*]
+        # exclude_indexes: [Contents-*, dep11, main/i18n/Translation-de*]
+        # optional, armored OpenPGP private key signing metadata rewritten by minima,
+        # the public key is stored next to the signature
+        # signing_key: /etc/minima/signing.asc
+        # optional, spread package downloads across mirrors listed in a metalink
+        # for repodata/repomd.xml, or in a mirrorlist (one base URL per line)
+        # metalink: http://download.opensuse.org/repositories/myrepo1/openSUSE_Leap_42.3/repodata/repomd.xml.meta4
+        # mirrorlist: http://example.com/myrepo1/mirrorlist.txt
+        # optional, limit download bandwidth of this repo
+        # max_bandwidth: 1MB
+        # optional, store the repo at a different path than the URL path
+        # path: myrepo1/{arch}
+        # optional, store the repo in a different storage than the global one
+        # storage:
+        #   type: file
+        #   path: /srv/other-mirror
+
+    # optional, limit download bandwidth of all repos (eg. 500KB, 5MB/s),
+    # the limit can be changed in daily time windows (0 means no limit)
+    # max_bandwidth: 5MB
+    # bandwidth_schedule:
+    #   - from: "22:00"
+    #     to: "06:00"
+    #     max_bandwidth: 0
+
+    # optional, how failed downloads are retried (defaults shown)
+    # retry:
+    #   initial_backoff: 1s
+    #   max_backoff: 1m
+    #   # restarts of the whole repo when metadata changes while syncing
+    #   metadata_restarts: 20
+    #   # attempts per file, by error class
+    #   attempts:
+    #     network: 5
+    #     server: 5
+    #     throttled: 10
+    #     not_found: 1
+    #     forbidden: 1
+    #     checksum: 2
+    #     size: 2
+    #     other: 1
 
     # optional section to download repos from SCC
     # scc:
@@ -59,17 +176,17 @@ var (
 			var errorflag bool = false
 			syncers, err := syncersFromConfig(cfgString, quiet)
 			if err != nil {
-				log.Fatal(err)
-				errorflag = true
+				fatal("Invalid configuration", err)
 			}
 			for _, syncer := range syncers {
-				log.Printf("Processing repo: %s", syncer.URL.String())
+				syncer.Progress = progress
+				slog.Info("Processing repo", "repo", syncer.URL.String())
 				err := syncer.StoreRepo()
 				if err != nil {
-					log.Println(err)
+					slog.Error("Sync failed", "repo", syncer.URL.String(), "error", err)
 					errorflag = true
 				} else {
-					log.Println("...done.")
+					slog.Info("Sync done", "repo", syncer.URL.String())
 				}
 			}
 			if errorflag {
@@ -85,9 +202,16 @@ var (
 // Config maps the configuration in minima.yaml
 type Config struct {
 	Storage get.StorageConfig
-	SCC     get.SCC
-	OBS     updates.OBS
-	HTTP    []get.HTTPRepoConfig
+	// Storages replicates each sync to several storages, instead of Storage
+	Storages    []get.StorageConfig
+	Replication get.ReplicationConfig
+	Retry       get.RetryConfig
+	// MaxBandwidth limits downloads of all repos, changed in windows of BandwidthSchedule
+	MaxBandwidth      get.Bandwidth         `yaml:"max_bandwidth"`
+	BandwidthSchedule []get.BandwidthWindow `yaml:"bandwidth_schedule"`
+	SCC               get.SCC
+	OBS               updates.OBS
+	HTTP              []get.HTTPRepoConfig
 }
 
 func syncersFromConfig(configString string, quiet bool) ([]*get.Syncer, error) {
@@ -95,9 +219,6 @@ func syncersFromConfig(configString string, quiet bool) ([]*get.Syncer, error) {
 	if err != nil {
 		return nil, err
 	}
-	//---passing the flag value to a global variable in get package, to disables syncing of i586 and i686 rpms (usually inside x86_64)
-	get.SkipLegacy = skipLegacyPackages
-
 	if config.SCC.Username != "" {
 		if thisRepo != "" {
 			if archs == "" {
@@ -118,43 +239,285 @@ func syncersFromConfig(configString string, quiet bool) ([]*get.Syncer, error) {
 		config.HTTP = append(config.HTTP, httpRepoConfigs...)
 	}
 
+	// downloads of all repos share a limiter, S3 uploads have their own
+	downloadLimiter, err := get.NewBandwidthLimiter(config.MaxBandwidth, config.BandwidthSchedule)
+	if err != nil {
+		return nil, err
+	}
+	uploadLimiter, err := get.NewBandwidthLimiter(config.MaxBandwidth, config.BandwidthSchedule)
+	if err != nil {
+		return nil, err
+	}
+
 	syncers := []*get.Syncer{}
+	// maps storages to paths of repos stored there, and those to repo URLs
+	locations := map[string]map[string]string{}
 	for _, httpRepo := range config.HTTP {
 		repoURL, err := url.Parse(httpRepo.URL)
 		if err != nil {
 			return nil, err
 		}
 
-		archs := map[string]bool{}
-		for _, archString := range httpRepo.Archs {
-			archs[archString] = true
+		repoPath, err := get.RepoPath(httpRepo, repoURL)
+		if err != nil {
+			return nil, err
+		}
+
+		storageConfigs := repoStorageConfigs(config, httpRepo)
+		for _, storageConfig := range storageConfigs {
+			storage, fullPath := storageLocation(storageConfig, repoPath)
+			if locations[storage] == nil {
+				locations[storage] = map[string]string{}
+			}
+			for otherPath, other := range locations[storage] {
+				if otherPath == fullPath {
+					return nil, fmt.Errorf("repos %s and %s would be stored at the same path %s", other, httpRepo.URL, repoPath)
+				}
+				if pathsOverlap(otherPath, fullPath) {
+					return nil, fmt.Errorf("repos %s and %s would be stored at overlapping paths %s and %s", other, httpRepo.URL, otherPath, fullPath)
+				}
+			}
+			locations[storage][fullPath] = httpRepo.URL
 		}
 
-		var storage get.Storage
-		switch config.Storage.Type {
-		case "file":
-			storage = get.NewFileStorage(filepath.Join(config.Storage.Path, filepath.FromSlash(repoURL.Path)))
-		case "s3":
-			storage, err = get.NewS3Storage(config.Storage.AccessKeyID, config.Storage.AccessKeyID, config.Storage.Region, config.Storage.Bucket+repoURL.Path)
+		storage, err := storageFromConfig(storageConfigs, config.Replication, repoPath, uploadLimiter)
+		if err != nil {
+			return nil, err
+		}
+		limiters := []*util.RateLimiter{downloadLimiter}
+		if httpRepo.MaxBandwidth > 0 {
+			repoLimiter, err := get.NewBandwidthLimiter(httpRepo.MaxBandwidth, nil)
+			if err != nil {
+				return nil, err
+			}
+			limiters = append(limiters, repoLimiter)
+		}
+		keys := [][]byte{}
+		for _, keyPath := range httpRepo.Keys {
+			key, err := os.ReadFile(keyPath)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, key)
+		}
+		var signingKey []byte
+		if httpRepo.SigningKey != "" {
+			signingKey, err = os.ReadFile(httpRepo.SigningKey)
 			if err != nil {
 				return nil, err
 			}
 		}
-		syncers = append(syncers, get.NewSyncer(*repoURL, archs, storage, quiet))
+		syncer := get.NewSyncer(*repoURL, storage,
+			get.WithRepoType(httpRepo.Type),
+			get.WithRepoName(httpRepo.Name),
+			get.WithArchs(httpRepo.Archs...),
+			get.WithKeys(keys...),
+			get.WithRegenerateMetadata(httpRepo.RegenerateMetadata),
+			get.WithDeltaRPMs(httpRepo.DeltaRPMs),
+			get.WithSources(httpRepo.Sources),
+			get.WithDebuginfo(httpRepo.Debuginfo),
+			get.WithVerifyAllChecksums(httpRepo.VerifyAllChecksums),
+			get.WithIncludeIndexes(httpRepo.IncludeIndexes...),
+			get.WithExcludeIndexes(httpRepo.ExcludeIndexes...),
+			get.WithSigningKey(signingKey),
+			// disables syncing of i586 and i686 rpms (usually inside x86_64)
+			get.WithSkipLegacy(skipLegacyPackages),
+			get.WithQuiet(quiet),
+			get.WithMirrorlist(httpRepo.Mirrorlist),
+			get.WithMetalink(httpRepo.Metalink),
+			get.WithRetry(config.Retry),
+			get.WithLimiters(limiters...),
+		)
+		syncers = append(syncers, syncer)
 	}
 
 	return syncers, nil
 }
 
+// repoStorageConfigs returns the configuration of storages for a repo, either
+// its own or the global one
+func repoStorageConfigs(config Config, httpRepo get.HTTPRepoConfig) []get.StorageConfig {
+	if httpRepo.Storage != nil {
+		return []get.StorageConfig{*httpRepo.Storage}
+	}
+	if len(config.Storages) > 0 {
+		return config.Storages
+	}
+	return []get.StorageConfig{config.Storage}
+}
+
+// storageLocation identifies where a repo path is stored, returning a key
+// identifying the storage and the absolute path of the repo in it
+func storageLocation(storageConfig get.StorageConfig, repoPath string) (string, string) {
+	storage := strings.Join([]string{
+		storageConfig.Type,
+		storageConfig.Endpoint,
+		storageConfig.Host,
+		storageConfig.Bucket,
+		storageConfig.Container,
+	}, "|")
+	return storage, path.Join("/", storageConfig.Path, repoPath)
+}
+
+// pathsOverlap returns true if two clean absolute paths are the same, or one
+// contains the other
+func pathsOverlap(a string, b string) bool {
+	return a == b ||
+		strings.HasPrefix(b, strings.TrimSuffix(a, "/")+"/") ||
+		strings.HasPrefix(a, strings.TrimSuffix(b, "/")+"/")
+}
+
+// storageFromConfig returns the Storage for a repo path, replicating to all
+// storages if more than one is specified
+func storageFromConfig(storageConfigs []get.StorageConfig, replication get.ReplicationConfig, repoPath string, uploadLimiter *util.RateLimiter) (get.Storage, error) {
+	if len(storageConfigs) == 1 {
+		return newStorage(storageConfigs[0], repoPath, uploadLimiter)
+	}
+
+	targets := []get.FanoutTarget{}
+	for _, storageConfig := range storageConfigs {
+		storage, err := newStorage(storageConfig, repoPath, uploadLimiter)
+		if err != nil {
+			return nil, err
+		}
+		name := storageConfig.Name
+		if name == "" {
+			name = storageConfig.Type + ":" + storageConfig.Path + storageConfig.Bucket + storageConfig.Container
+		}
+		targets = append(targets, get.FanoutTarget{Name: name, Storage: storage})
+	}
+	return get.NewFanoutStorage(targets, replication), nil
+}
+
+// newStorage returns a single Storage for a repo path
+func newStorage(storageConfig get.StorageConfig, repoPath string, uploadLimiter *util.RateLimiter) (storage get.Storage, err error) {
+	switch storageConfig.Type {
+	case "file":
+		storage = get.NewFileStorage(filepath.Join(storageConfig.Path, filepath.FromSlash(repoPath)))
+	case "s3":
+		options := get.S3Options{
+			AccessKeyID:              storageConfig.AccessKeyID,
+			SecretAccessKey:          storageConfig.SecretAccessKey,
+			Profile:                  storageConfig.Profile,
+			RoleARN:                  storageConfig.RoleARN,
+			Endpoint:                 storageConfig.Endpoint,
+			ForcePathStyle:           storageConfig.ForcePathStyle,
+			DisableSSL:               storageConfig.DisableSSL,
+			SkipBucketCreation:       storageConfig.SkipBucketCreation,
+			SkipWebsiteConfiguration: storageConfig.SkipWebsiteConfiguration,
+			UploadLimiter:            uploadLimiter,
+		}
+		storage, err = get.NewS3Storage(storageConfig.Region, storageConfig.Bucket+repoPath, options)
+	case "gcs":
+		options := get.GCSOptions{
+			CredentialsFile:    storageConfig.JsonPath,
+			ProjectID:          storageConfig.ProjectID,
+			Endpoint:           storageConfig.Endpoint,
+			SkipBucketCreation: storageConfig.SkipBucketCreation,
+		}
+		storage, err = get.NewGCSStorage(storageConfig.Bucket, repoPath, options)
+	case "azure":
+		options := get.AzureOptions{
+			AccountName:             storageConfig.AccountName,
+			AccountKey:              storageConfig.AccountKey,
+			SASToken:                storageConfig.SASToken,
+			UseManagedIdentity:      storageConfig.ManagedIdentity,
+			ManagedIdentityClientID: storageConfig.ManagedIdentityClientID,
+			Endpoint:                storageConfig.Endpoint,
+			SkipContainerCreation:   storageConfig.SkipBucketCreation,
+		}
+		storage, err = get.NewAzureStorage(storageConfig.Container, repoPath, options)
+	case "sftp":
+		options := get.SFTPOptions{
+			Host:           storageConfig.Host,
+			User:           storageConfig.User,
+			KeyFile:        storageConfig.KeyFile,
+			KeyPassphrase:  storageConfig.KeyPassphrase,
+			KnownHostsFile: storageConfig.KnownHostsFile,
+		}
+		storage, err = get.NewSFTPStorage(path.Join(storageConfig.Path, repoPath), options)
+	default:
+		err = fmt.Errorf("unrecognised storage type %q", storageConfig.Type)
+	}
+	return
+}
+
 func parseConfig(configString string) (Config, error) {
 	config := Config{}
 	if err := yaml.Unmarshal([]byte(configString), &config); err != nil {
 		return config, fmt.Errorf("configuration parse error: %v", err)
 	}
 
-	storageType := config.Storage.Type
-	if storageType != "file" && storageType != "s3" {
-		return config, fmt.Errorf("configuration parse error: unrecognised storage type")
+	storages := config.Storages
+	if len(storages) > 0 && config.Storage.Type != "" {
+		return config, fmt.Errorf("configuration parse error: storage and storages cannot be both specified")
+	}
+
+	// the global storage can be omitted if all repos specify their own
+	globalStorageNeeded := len(config.HTTP) == 0 && len(config.SCC.Repositories) == 0
+	for _, httpRepo := range config.HTTP {
+		if err := get.ValidRepoType(httpRepo.Type); err != nil {
+			return config, fmt.Errorf("configuration parse error: %v", err)
+		}
+		if repoType, found := get.LookupRepoType(httpRepo.Type); found && repoType.NeedsKeys() && len(httpRepo.Keys) == 0 {
+			return config, fmt.Errorf("configuration parse error: %s repo %s needs keys to check metadata signatures", httpRepo.Type, httpRepo.URL)
+		}
+		if (len(httpRepo.IncludeIndexes) > 0 || len(httpRepo.ExcludeIndexes) > 0) && httpRepo.SigningKey == "" {
+			// indexes are only selected for types rewriting metadata, deb if the type is detected
+			if repoType, found := get.LookupRepoType(httpRepo.Type); !found || repoType.FilterMetadata != nil {
+				return config, fmt.Errorf("configuration parse error: repo %s needs a signing_key to sign the Release file rewritten by include_indexes or exclude_indexes", httpRepo.URL)
+			}
+		}
+		for _, policy := range []get.PackagePolicy{httpRepo.Sources, httpRepo.Debuginfo} {
+			if err := get.ValidPackagePolicy(policy); err != nil {
+				return config, fmt.Errorf("configuration parse error: %v", err)
+			}
+		}
+		if httpRepo.Storage != nil {
+			storages = append(storages, *httpRepo.Storage)
+		} else {
+			globalStorageNeeded = true
+		}
+	}
+	for _, sccRepos := range config.SCC.Repositories {
+		if sccRepos.Storage != nil {
+			storages = append(storages, *sccRepos.Storage)
+		} else {
+			globalStorageNeeded = true
+		}
+	}
+	if len(config.Storages) == 0 && (globalStorageNeeded || config.Storage.Type != "") {
+		storages = append(storages, config.Storage)
+	}
+
+	for _, storage := range storages {
+		switch storage.Type {
+		case "file", "s3", "gcs", "azure", "sftp":
+		default:
+			return config, fmt.Errorf("configuration parse error: unrecognised storage type")
+		}
+	}
+
+	switch config.Replication.OnFailure {
+	case "", "abort", "continue":
+	default:
+		return config, fmt.Errorf("configuration parse error: unrecognised replication on_failure policy")
+	}
+
+	if _, err := get.NewBandwidthLimiter(config.MaxBandwidth, config.BandwidthSchedule); err != nil {
+		return config, fmt.Errorf("configuration parse error: %v", err)
+	}
+
+	for class, attempts := range config.Retry.Attempts {
+		switch class {
+		case get.ErrorClassNetwork, get.ErrorClassServer, get.ErrorClassThrottled, get.ErrorClassNotFound,
+			get.ErrorClassForbidden, get.ErrorClassChecksum, get.ErrorClassSize, get.ErrorClassOther:
+		default:
+			return config, fmt.Errorf("configuration parse error: unrecognised error class %s in retry attempts", class)
+		}
+		if attempts < 1 {
+			return config, fmt.Errorf("configuration parse error: retry attempts for %s must be at least 1", class)
+		}
 	}
 	return config, nil
 }
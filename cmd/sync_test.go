@@ -3,7 +3,9 @@ package cmd
 import (
 	"os"
 	"path"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/uyuni-project/minima/get"
@@ -14,6 +16,15 @@ const (
 	invalidStoragefile = "invalid_storage.yaml"
 	validHTTPReposFile = "valid_http_repos.yaml"
 	validSCCReposFile  = "valid_scc_repos.yaml"
+	validGCSStorage    = "valid_gcs_storage.yaml"
+	validStorages      = "valid_storages.yaml"
+	invalidStorages    = "invalid_storages.yaml"
+	validRetry         = "valid_retry.yaml"
+	validBandwidth     = "valid_bandwidth.yaml"
+	invalidRepoType    = "invalid_repo_type.yaml"
+	invalidPolicy      = "invalid_package_policy.yaml"
+	missingKeys        = "missing_keys.yaml"
+	missingSigningKey  = "missing_signing_key.yaml"
 )
 
 func TestParseConfig(t *testing.T) {
@@ -34,6 +45,7 @@ func TestParseConfig(t *testing.T) {
 					{
 						URL:   "http://test/SLE-Product-SLES15-SP5-Pool/",
 						Archs: []string{"x86_64", "aarch64", "s390x"},
+						Type:  "rpm",
 					},
 					{
 						URL:   "http://test/SLE-Product-SLES15-SP5-Updates/",
@@ -67,6 +79,119 @@ func TestParseConfig(t *testing.T) {
 			},
 			false,
 		},
+		{
+			"Valid GCS storage", validGCSStorage,
+			Config{
+				Storage: get.StorageConfig{
+					Type:      "gcs",
+					Bucket:    "minima-bucket",
+					JsonPath:  "/etc/minima/service-account.json",
+					ProjectID: "my-project",
+				},
+				HTTP: []get.HTTPRepoConfig{
+					{
+						URL:   "http://test/SLE-Product-SLES15-SP5-Pool/",
+						Archs: []string{"x86_64"},
+					},
+				},
+			},
+			false,
+		},
+		{
+			"Valid multiple storages", validStorages,
+			Config{
+				Storages: []get.StorageConfig{
+					{
+						Type: "file",
+						Path: "/srv/mirror",
+					},
+					{
+						Type:   "s3",
+						Name:   "aws-mirror",
+						Region: "us-east-1",
+						Bucket: "minima-bucket-key",
+					},
+				},
+				Replication: get.ReplicationConfig{
+					OnFailure: "continue",
+					Retries:   3,
+				},
+				HTTP: []get.HTTPRepoConfig{
+					{
+						URL:   "http://test/SLE-Product-SLES15-SP5-Pool/",
+						Archs: []string{"x86_64"},
+					},
+				},
+			},
+			false,
+		},
+		{
+			"Valid retry policy", validRetry,
+			Config{
+				Storage: get.StorageConfig{
+					Type: "file",
+					Path: "/srv/mirror",
+				},
+				Retry: get.RetryConfig{
+					InitialBackoff: 500 * time.Millisecond,
+					MaxBackoff:     30 * time.Second,
+					Attempts: map[string]int{
+						"network":   3,
+						"not_found": 2,
+					},
+				},
+				HTTP: []get.HTTPRepoConfig{
+					{
+						URL:   "http://test/SLE-Product-SLES15-SP5-Pool/",
+						Archs: []string{"x86_64"},
+					},
+				},
+			},
+			false,
+		},
+		{
+			"Valid bandwidth limits", validBandwidth,
+			Config{
+				Storage: get.StorageConfig{
+					Type: "file",
+					Path: "/srv/mirror",
+				},
+				MaxBandwidth: 5 * 1024 * 1024,
+				BandwidthSchedule: []get.BandwidthWindow{
+					{From: "22:00", To: "06:00", MaxBandwidth: 0},
+				},
+				HTTP: []get.HTTPRepoConfig{
+					{
+						URL:          "http://test/SLE-Product-SLES15-SP5-Pool/",
+						Archs:        []string{"x86_64"},
+						MaxBandwidth: 512 * 1024,
+					},
+				},
+			},
+			false,
+		},
+		{
+			"Both storage and storages", invalidStorages,
+			Config{
+				Storage: get.StorageConfig{
+					Type: "file",
+					Path: "/srv/mirror",
+				},
+				Storages: []get.StorageConfig{
+					{
+						Type: "file",
+						Path: "/srv/mirror2",
+					},
+				},
+				HTTP: []get.HTTPRepoConfig{
+					{
+						URL:   "http://test/SLE-Product-SLES15-SP5-Pool/",
+						Archs: []string{"x86_64"},
+					},
+				},
+			},
+			true,
+		},
 		{
 			"Invalid storage", invalidStoragefile,
 			Config{
@@ -87,6 +212,74 @@ func TestParseConfig(t *testing.T) {
 			},
 			true,
 		},
+		{
+			"Invalid repo type", invalidRepoType,
+			Config{
+				Storage: get.StorageConfig{
+					Type: "file",
+					Path: "/srv/mirror",
+				},
+				HTTP: []get.HTTPRepoConfig{
+					{
+						URL:   "http://test/SLE-Product-SLES15-SP5-Pool/",
+						Archs: []string{"x86_64"},
+						Type:  "rpmx",
+					},
+				},
+			},
+			true,
+		},
+		{
+			"Invalid package policy", invalidPolicy,
+			Config{
+				Storage: get.StorageConfig{
+					Type: "file",
+					Path: "/srv/mirror",
+				},
+				HTTP: []get.HTTPRepoConfig{
+					{
+						URL:     "http://test/SLE-Product-SLES15-SP5-Pool/",
+						Archs:   []string{"x86_64"},
+						Sources: "sometimes",
+					},
+				},
+			},
+			true,
+		},
+		{
+			"Missing keys", missingKeys,
+			Config{
+				Storage: get.StorageConfig{
+					Type: "file",
+					Path: "/srv/mirror",
+				},
+				HTTP: []get.HTTPRepoConfig{
+					{
+						URL:   "https://dl-cdn.alpinelinux.org/alpine/v3.20/main/",
+						Archs: []string{"x86_64"},
+						Type:  "apk",
+					},
+				},
+			},
+			true,
+		},
+		{
+			"Missing signing key", missingSigningKey,
+			Config{
+				Storage: get.StorageConfig{
+					Type: "file",
+					Path: "/srv/mirror",
+				},
+				HTTP: []get.HTTPRepoConfig{
+					{
+						URL:            "https://deb.debian.org/debian/dists/bookworm/",
+						Archs:          []string{"amd64"},
+						ExcludeIndexes: []string{"Contents-*"},
+					},
+				},
+			},
+			true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -106,3 +299,37 @@ func TestParseConfig(t *testing.T) {
 		})
 	}
 }
+
+func TestSyncersFromConfigPathCollision(t *testing.T) {
+	bytes, err := os.ReadFile(path.Join(testdataDir, "colliding_repo_paths.yaml"))
+	if err != nil {
+		t.Fatal()
+	}
+
+	_, err = syncersFromConfig(string(bytes), true)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "same path /sles/x86_64/")
+	}
+
+	// the third repo uses its own storage, so it does not collide
+	config := strings.Replace(string(bytes), "SP5-Updates/x86_64/\n    archs: [x86_64]", "SP5-Updates/x86_64/\n    archs: [aarch64]", 1)
+	syncers, err := syncersFromConfig(config, true)
+	assert.NoError(t, err)
+	assert.Len(t, syncers, 3)
+
+	// a repo stored inside another one collides too
+	config = strings.Replace(config, "    path: sles/{arch}\n", "    path: sles\n", 1)
+	_, err = syncersFromConfig(config, true)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "overlapping paths /srv/mirror/sles and /srv/mirror/sles/aarch64")
+	}
+}
+
+func TestPathsOverlap(t *testing.T) {
+	assert.True(t, pathsOverlap("/foo", "/foo"))
+	assert.True(t, pathsOverlap("/foo", "/foo/bar"))
+	assert.True(t, pathsOverlap("/foo/bar", "/foo"))
+	assert.True(t, pathsOverlap("/", "/foo"))
+	assert.False(t, pathsOverlap("/foo", "/foobar"))
+	assert.False(t, pathsOverlap("/foo/bar", "/foo/baz"))
+}
@@ -18,7 +18,7 @@ package cmd
 import (
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -82,26 +82,26 @@ func muFindAndSync(quiet bool) {
 
 	err := yaml.Unmarshal([]byte(cfgString), &config)
 	if err != nil {
-		log.Fatalf("Error reading configuration: %v", err)
+		fatal("Error reading configuration", err)
 	}
 
 	if cleanup {
 		// DO CLEANUP - TO BE IMPLEMENTED
-		log.Println("searching for outdated MU repos...")
+		slog.Info("Searching for outdated MU repos")
 		updateList, err = GetUpdatesAndChannels(config.OBS.Username, config.OBS.Password, true)
 		if err != nil {
-			log.Fatalf("Error searching for outdated MUs repos: %v", err)
+			fatal("Error searching for outdated MUs repos", err)
 		}
 		err = RemoveOldChannels(config, updateList)
 		if err != nil {
-			log.Fatalf("Error removing old channels: %v", err)
+			fatal("Error removing old channels", err)
 		}
-		log.Println("...done!")
+		slog.Info("Cleanup done")
 	} else {
 		if thisMU == "" {
 			updateList, err = GetUpdatesAndChannels(config.OBS.Username, config.OBS.Password, justSearch)
 			if err != nil {
-				log.Fatalf("Error finding updates and channels: %v", err)
+				fatal("Error finding updates and channels", err)
 			}
 			config.HTTP = []get.HTTPRepoConfig{}
 			for _, val := range updateList {
@@ -109,7 +109,7 @@ func muFindAndSync(quiet bool) {
 			}
 		} else {
 			if mu := strings.Split(thisMU, ":"); len(mu) != 4 {
-				log.Fatalf("Badly formatted MU. It must be SUSE:Maintenance:NUMBER:NUMBER")
+				fatal("Badly formatted MU", fmt.Errorf("%s must be SUSE:Maintenance:NUMBER:NUMBER", thisMU))
 			} else {
 				a := Updates{}
 				a.IncidentNumber = mu[2]
@@ -118,7 +118,7 @@ func muFindAndSync(quiet bool) {
 
 				a.Repositories, err = GetRepo(http.DefaultClient, mu)
 				if err != nil {
-					log.Fatalf("Something went wrong in MU %s repos processing: %v\n", mu, err)
+					fatal("Something went wrong in MU repos processing", fmt.Errorf("%s: %v", mu, err))
 				}
 				config.HTTP = append(config.HTTP, a.Repositories...)
 				updateList = append(updateList, a)
@@ -127,14 +127,14 @@ func muFindAndSync(quiet bool) {
 
 		byteChunk, err := yaml.Marshal(config)
 		if err != nil {
-			log.Fatalf("Error marshalling config: %v", err)
+			fatal("Error marshalling config", err)
 		}
 
 		if spitYamls {
 			t := time.Now()
 			err := os.WriteFile(fmt.Sprintf("./minima_obs_%v-%v-%v-%v:%v.yaml", t.Year(), t.Month(), t.Local().Day(), t.Hour(), t.Minute()), byteChunk, 0644)
 			if err != nil {
-				log.Fatalf("Error writing file: %v", err)
+				fatal("Error writing file", err)
 			}
 			os.Exit(3)
 		}
@@ -147,16 +147,17 @@ func muFindAndSync(quiet bool) {
 
 		syncers, err := syncersFromConfig(string(byteChunk), quiet)
 		if err != nil {
-			log.Fatal(err)
+			fatal("Invalid configuration", err)
 		}
 
 		for _, syncer := range syncers {
-			log.Printf("Processing repo: %s", syncer.URL.String())
+			syncer.Progress = progress
+			slog.Info("Processing repo", "repo", syncer.URL.String())
 			err := syncer.StoreRepo()
 			if err != nil {
-				log.Fatal(err)
+				fatal("Sync failed", err)
 			}
-			log.Println("...done.")
+			slog.Info("Sync done", "repo", syncer.URL.String())
 		}
 	}
 }
@@ -182,7 +183,7 @@ func ProcWebChunk(client *http.Client, product, maint string) ([]get.HTTPRepoCon
 			if err := ArchMage(client, &repo); err != nil {
 				return nil, err
 			}
-			fmt.Println(repo)
+			slog.Debug("Found MU repo", "url", repo.URL, "archs", repo.Archs)
 			httpFormattedRepos = append(httpFormattedRepos, repo)
 		}
 	}
@@ -212,7 +213,7 @@ func ArchMage(client *http.Client, repo *get.HTTPRepoConfig) error {
 				exists, err := updates.CheckWebPageExists(client, finalUrl)
 				if err != nil {
 					// TODO: verify if we need to actually return an error
-					log.Printf("Got error calling HEAD %s: %v...\n", finalUrl, err)
+					slog.Warn("Got error calling HEAD", "url", finalUrl, "error", err)
 				}
 				if exists {
 					archsChan <- arch
@@ -240,7 +241,7 @@ func GetRepo(client *http.Client, mu string) (httpFormattedRepos []get.HTTPRepoC
 	if err != nil {
 		return nil, fmt.Errorf("error retrieving products for MU %s: %v", mu, err)
 	}
-	fmt.Printf("%d product entries for mu %s\n", len(productsChunks), mu)
+	slog.Debug("Found MU products", "mu", mu, "count", len(productsChunks))
 
 	reposChan := make(chan []get.HTTPRepoConfig)
 	errChan := make(chan error)
@@ -289,7 +290,7 @@ func GetRepo(client *http.Client, mu string) (httpFormattedRepos []get.HTTPRepoC
 
 // getProductsForMU parses a MU webpage attempting to retrieve a slice of available SUSE products
 func getProductsForMU(client *http.Client, mu string) ([]string, error) {
-	fmt.Println("GET", mu)
+	slog.Debug("Fetching MU products", "url", mu)
 	resp, err := client.Get(mu)
 	if err != nil {
 		return nil, err
@@ -375,7 +376,7 @@ func RemoveOldChannels(config Config, updates []Updates) (err error) {
 			if regexp.MustCompile(`/\d{5,6}/`).FindString(elem) != "" {
 				_, exists := mappedUpdates[strings.Replace(regexp.MustCompile(`/\d{5,6}/`).FindString(elem), "/", "", 10)]
 				if !exists {
-					log.Printf("removing: %s...\n", elem)
+					slog.Info("Removing old MU channel", "path", elem)
 					err = os.RemoveAll(elem)
 					if err != nil {
 						return
@@ -0,0 +1,303 @@
+package get
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/uyuni-project/minima/util"
+)
+
+// Functions to handle Alpine APK repositories. Both APKINDEX.tar.gz and .apk
+// files are concatenated gzip streams of tar archives: an optional signature,
+// control data and, in packages, the installed files
+
+// apkChecksumType is the type of APK checksums, SHA1 of the compressed
+// control data of a package, base64 encoded after a Q1 prefix
+const apkChecksumType = "Q1"
+
+// apkStreamReader reads concatenated gzip streams one at a time, writing the
+// compressed bytes it consumes to sink, if set
+type apkStreamReader struct {
+	reader io.ByteScanner
+	sink   io.Writer
+	gzip   *gzip.Reader
+}
+
+func newAPKStreamReader(reader io.Reader) *apkStreamReader {
+	if scanner, ok := reader.(io.ByteScanner); ok {
+		return &apkStreamReader{reader: scanner}
+	}
+	return &apkStreamReader{reader: bufio.NewReader(reader)}
+}
+
+func (r *apkStreamReader) Read(p []byte) (n int, err error) {
+	n, err = r.reader.(io.Reader).Read(p)
+	if r.sink != nil {
+		r.sink.Write(p[:n])
+	}
+	return
+}
+
+// ReadByte lets gzip read exactly up to the end of each stream
+func (r *apkStreamReader) ReadByte() (b byte, err error) {
+	b, err = r.reader.ReadByte()
+	if err == nil && r.sink != nil {
+		r.sink.Write([]byte{b})
+	}
+	return
+}
+
+// next returns the uncompressed content of the next stream, io.EOF if there
+// are no more
+func (r *apkStreamReader) next() (stream io.Reader, err error) {
+	if _, err = r.reader.ReadByte(); err != nil {
+		return
+	}
+	if err = r.reader.UnreadByte(); err != nil {
+		return
+	}
+
+	if r.gzip == nil {
+		r.gzip, err = gzip.NewReader(r)
+	} else {
+		err = r.gzip.Reset(r)
+	}
+	if err != nil {
+		return
+	}
+	r.gzip.Multistream(false)
+	return r.gzip, nil
+}
+
+// readTar calls f on every entry of a tar stream, which can lack the end of
+// archive marker, then reads the stream to its end
+func readTar(stream io.Reader, f func(header *tar.Header, content io.Reader) error) (err error) {
+	reader := tar.NewReader(stream)
+	for {
+		var header *tar.Header
+		header, err = reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return
+		}
+		if err = f(header, reader); err != nil {
+			return
+		}
+	}
+	_, err = io.Copy(io.Discard, stream)
+	return
+}
+
+// signatureHash returns the hash used by a signature file in an APK stream,
+// or 0 if the file is not a signature
+func signatureHash(name string) crypto.Hash {
+	switch {
+	case strings.HasPrefix(name, ".SIGN.RSA512."):
+		return crypto.SHA512
+	case strings.HasPrefix(name, ".SIGN.RSA256."):
+		return crypto.SHA256
+	case strings.HasPrefix(name, ".SIGN.RSA."):
+		return crypto.SHA1
+	}
+	return 0
+}
+
+// verifyAPKIndex checks the signature of an APKINDEX.tar.gz, which covers all
+// streams after the signature one, against trusted RSA public keys in PEM format
+func verifyAPKIndex(metadata []byte, keys [][]byte) error {
+	reader := bytes.NewReader(metadata)
+	streams := newAPKStreamReader(reader)
+	stream, err := streams.next()
+	if err != nil {
+		return err
+	}
+
+	var signature []byte
+	var hashType crypto.Hash
+	err = readTar(stream, func(header *tar.Header, content io.Reader) (err error) {
+		if h := signatureHash(header.Name); h != 0 && signature == nil {
+			hashType = h
+			signature, err = io.ReadAll(content)
+		}
+		return
+	})
+	if err != nil {
+		return err
+	}
+	if signature == nil {
+		return &SignatureError{Reason: "APKINDEX.tar.gz is not signed"}
+	}
+
+	h := hashType.New()
+	h.Write(metadata[len(metadata)-reader.Len():])
+	digest := h.Sum(nil)
+	for _, key := range keys {
+		publicKey, err := parseRSAPublicKey(key)
+		if err != nil {
+			return err
+		}
+		if rsa.VerifyPKCS1v15(publicKey, hashType, digest, signature) == nil {
+			return nil
+		}
+	}
+	return &SignatureError{Reason: "APKINDEX.tar.gz signature check failed, signature is not valid"}
+}
+
+// parseRSAPublicKey parses a PEM encoded RSA public key, as used by abuild
+func parseRSAPublicKey(key []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(key)
+	if block == nil {
+		return nil, errors.New("key is not in PEM format")
+	}
+	if publicKey, err := x509.ParsePKIXPublicKey(block.Bytes); err == nil {
+		if rsaKey, ok := publicKey.(*rsa.PublicKey); ok {
+			return rsaKey, nil
+		}
+		return nil, errors.New("key is not an RSA key")
+	}
+	return x509.ParsePKCS1PublicKey(block.Bytes)
+}
+
+// decodeAPKIndex returns packages listed in an APKINDEX.tar.gz
+func decodeAPKIndex(reader io.Reader, _ string) (metadata XMLMetaData, err error) {
+	streams := newAPKStreamReader(reader)
+	for {
+		var stream io.Reader
+		stream, err = streams.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return
+		}
+
+		var index []byte
+		err = readTar(stream, func(header *tar.Header, content io.Reader) (err error) {
+			if header.Name == "APKINDEX" {
+				index, err = io.ReadAll(content)
+			}
+			return
+		})
+		if err != nil {
+			return
+		}
+		if index != nil {
+			return parseAPKIndex(bytes.NewReader(index))
+		}
+	}
+	err = errors.New("no APKINDEX in APKINDEX.tar.gz")
+	return
+}
+
+// parseAPKIndex parses an APKINDEX file, made of one paragraph per package
+// with one "field:value" line per field
+func parseAPKIndex(reader io.Reader) (metadata XMLMetaData, err error) {
+	packages := make([]XMLPackage, 0)
+	fields := map[string]string{}
+	addPackage := func() error {
+		if len(fields) == 0 {
+			return nil
+		}
+		if fields["P"] == "" || fields["V"] == "" || !strings.HasPrefix(fields["C"], apkChecksumType) {
+			return fmt.Errorf("badly formatted APKINDEX entry for package '%s'", fields["P"])
+		}
+		size, _ := strconv.ParseInt(fields["S"], 10, 64)
+		packages = append(packages, XMLPackage{
+			Name:     fields["P"],
+			Arch:     fields["A"],
+			Location: XMLLocation{Href: fields["P"] + "-" + fields["V"] + ".apk"},
+			Checksum: XMLChecksum{Type: apkChecksumType, Checksum: fields["C"]},
+			Size:     XMLSize{Package: size},
+		})
+		fields = map[string]string{}
+		return nil
+	}
+
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			if err = addPackage(); err != nil {
+				return
+			}
+			continue
+		}
+		key, value, found := strings.Cut(line, ":")
+		if !found {
+			err = fmt.Errorf("badly formatted APKINDEX line: '%s'", line)
+			return
+		}
+		fields[key] = value
+	}
+	if err = scanner.Err(); err != nil {
+		return
+	}
+	if err = addPackage(); err != nil {
+		return
+	}
+	metadata = XMLMetaData{Packages: packages}
+	return
+}
+
+// verifyAPK reads a whole .apk and checks the SHA1 of its compressed control
+// data against an APKINDEX checksum
+func verifyAPK(reader io.Reader, checksum XMLChecksum) error {
+	if checksum.Type != apkChecksumType {
+		return fmt.Errorf("unsupported checksum type %s for APK packages", checksum.Type)
+	}
+
+	streams := newAPKStreamReader(reader)
+	// control data is in the first stream, or in the second after a signature
+	var control hash.Hash
+	for i := 0; i < 2 && control == nil; i++ {
+		h := sha1.New()
+		streams.sink = h
+		stream, err := streams.next()
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+		signed := false
+		err = readTar(stream, func(header *tar.Header, _ io.Reader) error {
+			signed = signed || strings.HasPrefix(header.Name, ".SIGN.")
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if !signed {
+			control = h
+		}
+	}
+	streams.sink = nil
+	if _, err := io.Copy(io.Discard, streams.reader.(io.Reader)); err != nil {
+		return err
+	}
+
+	if control == nil {
+		return errors.New("no control data in APK package")
+	}
+	actual := apkChecksumType + base64.StdEncoding.EncodeToString(control.Sum(nil))
+	if actual != checksum.Checksum {
+		return util.NewChecksumError(checksum.Checksum, actual)
+	}
+	return nil
+}
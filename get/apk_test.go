@@ -0,0 +1,162 @@
+package get
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/uyuni-project/minima/util"
+)
+
+func TestParseAPKIndex(t *testing.T) {
+	index := "C:Q1abc=\nP:hello\nV:1.0-r0\nA:x86_64\nS:123\nT:a package\n\n" +
+		"C:Q1def=\nP:hello-doc\nV:1.0-r0\nA:noarch\nS:45\n"
+	metadata, err := parseAPKIndex(strings.NewReader(index))
+	assert.NoError(t, err)
+	expected := []XMLPackage{
+		{Name: "hello", Arch: "x86_64", Location: XMLLocation{Href: "hello-1.0-r0.apk"}, Checksum: XMLChecksum{Type: "Q1", Checksum: "Q1abc="}, Size: XMLSize{Package: 123}},
+		{Name: "hello-doc", Arch: "noarch", Location: XMLLocation{Href: "hello-doc-1.0-r0.apk"}, Checksum: XMLChecksum{Type: "Q1", Checksum: "Q1def="}, Size: XMLSize{Package: 45}},
+	}
+	assert.Equal(t, expected, metadata.Packages)
+
+	_, err = parseAPKIndex(strings.NewReader("P:hello\nV:1.0-r0\n"))
+	assert.Error(t, err)
+	_, err = parseAPKIndex(strings.NewReader("not a field\n"))
+	assert.Error(t, err)
+}
+
+func TestVerifyAPK(t *testing.T) {
+	index, err := os.Open(filepath.Join("testdata", "apk_repo", "x86_64", "APKINDEX.tar.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	metadata, err := decodeAPKIndex(index, "gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, metadata.Packages, 2)
+
+	for _, pack := range metadata.Packages {
+		apk, err := os.Open(filepath.Join("testdata", "apk_repo", "x86_64", pack.Location.Href))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.NoError(t, verifyAPK(apk, pack.Checksum), pack.Location.Href)
+		apk.Close()
+	}
+
+	// checksum of another package
+	apk, err := os.Open(filepath.Join("testdata", "apk_repo", "x86_64", metadata.Packages[0].Location.Href))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer apk.Close()
+	err = verifyAPK(apk, metadata.Packages[1].Checksum)
+	var checksumErr *util.ChecksumError
+	assert.True(t, errors.As(err, &checksumErr), err)
+}
+
+func TestVerifyAPKIndex(t *testing.T) {
+	metadata, err := os.ReadFile(filepath.Join("testdata", "apk_repo", "x86_64", "APKINDEX.tar.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := os.ReadFile(filepath.Join("testdata", "apk_repo.rsa.pub"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := os.ReadFile(filepath.Join("testdata", "apk_other.rsa.pub"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.NoError(t, verifyAPKIndex(metadata, [][]byte{key}))
+	assert.NoError(t, verifyAPKIndex(metadata, [][]byte{otherKey, key}))
+
+	var signatureErr *SignatureError
+	assert.True(t, errors.As(verifyAPKIndex(metadata, [][]byte{otherKey}), &signatureErr))
+
+	tampered := append([]byte{}, metadata...)
+	tampered[len(tampered)-10] ^= 0xff
+	assert.Error(t, verifyAPKIndex(tampered, [][]byte{key}))
+
+	assert.Error(t, verifyAPKIndex(metadata, [][]byte{[]byte("not a key")}))
+}
+
+func TestStoreAPKRepo(t *testing.T) {
+	server := httptest.NewServer(http.FileServer(http.Dir("testdata")))
+	defer server.Close()
+
+	key, err := os.ReadFile(filepath.Join("testdata", "apk_repo.rsa.pub"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	repoURL, err := url.Parse(server.URL + "/apk_repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	directory := t.TempDir()
+	syncer := NewSyncer(*repoURL, NewFileStorage(directory),
+		WithHTTPClient(server.Client()),
+		WithArchs("x86_64"),
+		WithKeys(key),
+	)
+	repoType, err := syncer.detectRepoType()
+	assert.NoError(t, err)
+	assert.Equal(t, "apk", repoType.Name)
+
+	// first sync
+	assert.NoError(t, syncer.StoreRepo())
+
+	expectedFiles := []string{
+		filepath.Join("x86_64", "APKINDEX.tar.gz"),
+		filepath.Join("x86_64", "hello-1.0-r0.apk"),
+		filepath.Join("x86_64", "hello-doc-1.0-r0.apk"),
+	}
+	for _, file := range expectedFiles {
+		original, err := os.ReadFile(filepath.Join("testdata", "apk_repo", file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		synced, err := os.ReadFile(filepath.Join(directory, file))
+		if assert.NoError(t, err) {
+			assert.Equal(t, original, synced, file)
+		}
+	}
+	_, err = os.Stat(filepath.Join(directory, "aarch64"))
+	assert.True(t, os.IsNotExist(err))
+
+	// second sync
+	assert.NoError(t, syncer.StoreRepo())
+
+	// metadata signed by an untrusted key
+	otherKey, err := os.ReadFile(filepath.Join("testdata", "apk_other.rsa.pub"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	syncer = NewSyncer(*repoURL, NewFileStorage(t.TempDir()),
+		WithHTTPClient(server.Client()),
+		WithArchs("x86_64"),
+		WithKeys(otherKey),
+		WithRetry(RetryConfig{InitialBackoff: time.Millisecond, MetadataRestarts: 1}),
+	)
+	var signatureErr *SignatureError
+	assert.True(t, errors.As(syncer.StoreRepo(), &signatureErr))
+
+	// metadata is not synced unverified
+	syncer = NewSyncer(*repoURL, NewFileStorage(t.TempDir()), WithHTTPClient(server.Client()), WithArchs("x86_64"))
+	assert.True(t, errors.As(syncer.StoreRepo(), &signatureErr))
+
+	// archs are needed to find metadata
+	syncer = NewSyncer(*repoURL, NewFileStorage(t.TempDir()), WithHTTPClient(server.Client()), WithRepoType("apk"), WithKeys(key))
+	assert.Error(t, syncer.StoreRepo())
+}
@@ -0,0 +1,315 @@
+package get
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+
+	"github.com/uyuni-project/minima/util"
+)
+
+// azureChecksumMetadataKey holds the checksum of an uploaded blob, blob
+// metadata names must be valid C# identifiers
+const azureChecksumMetadataKey = "minimachecksum"
+
+// AzureStorage allows to store data in an Azure Blob Storage container. Like
+// S3Storage, files are kept under one of two prefixes ("a/" and "b/"): the
+// temporary location is the prefix not currently in use, and Commit swaps
+// them by updating a marker blob
+type AzureStorage struct {
+	client *container.Client
+	root   string
+	prefix string
+}
+
+// AzureOptions holds the settings of an AzureStorage. Exactly one of
+// AccountKey, SASToken or UseManagedIdentity should be specified
+type AzureOptions struct {
+	// AccountName is the name of the storage account
+	AccountName string
+	// AccountKey is a shared key of the storage account
+	AccountKey string
+	// SASToken is a shared access signature for the account or container
+	SASToken string
+	// UseManagedIdentity obtains tokens from the Azure instance metadata service
+	UseManagedIdentity bool
+	// ManagedIdentityClientID selects a user-assigned managed identity
+	ManagedIdentityClientID string
+	// Endpoint overrides the default https://<account>.blob.core.windows.net,
+	// eg. http://127.0.0.1:10000/devstoreaccount1 to use the Azurite emulator
+	Endpoint string
+	// SkipContainerCreation assumes the container already exists
+	SkipContainerCreation bool
+}
+
+// NewAzureStorage returns a new Storage backed by an Azure Blob Storage
+// container, storing files under the root blob name prefix
+func NewAzureStorage(containerName string, root string, options AzureOptions) (storage Storage, err error) {
+	if options.AccountName == "" {
+		return nil, errors.New("an account name is needed for Azure Blob Storage")
+	}
+
+	endpoint := strings.TrimSuffix(options.Endpoint, "/")
+	if endpoint == "" {
+		endpoint = "https://" + options.AccountName + ".blob.core.windows.net"
+	}
+	containerURL := endpoint + "/" + url.PathEscape(containerName)
+
+	var client *container.Client
+	switch {
+	case options.AccountKey != "":
+		var credential *container.SharedKeyCredential
+		credential, err = container.NewSharedKeyCredential(options.AccountName, options.AccountKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Azure account key: %v", err)
+		}
+		client, err = container.NewClientWithSharedKeyCredential(containerURL, credential, nil)
+	case options.SASToken != "":
+		// blob URLs derived from the container URL keep the signature
+		client, err = container.NewClientWithNoCredential(containerURL+"?"+strings.TrimPrefix(options.SASToken, "?"), nil)
+	case options.UseManagedIdentity:
+		clientID := options.ManagedIdentityClientID
+		if clientID == "" {
+			clientID = os.Getenv("AZURE_CLIENT_ID")
+		}
+		identityOptions := &azidentity.ManagedIdentityCredentialOptions{}
+		if clientID != "" {
+			identityOptions.ID = azidentity.ClientID(clientID)
+		}
+		var credential *azidentity.ManagedIdentityCredential
+		credential, err = azidentity.NewManagedIdentityCredential(identityOptions)
+		if err != nil {
+			return
+		}
+		client, err = container.NewClient(containerURL, credential, nil)
+	default:
+		return nil, errors.New("one of account key, SAS token or managed identity is needed for Azure Blob Storage")
+	}
+	if err != nil {
+		return
+	}
+
+	s := &AzureStorage{
+		client: client,
+		root:   strings.Trim(root, "/"),
+	}
+
+	if !options.SkipContainerCreation {
+		err = s.createContainer()
+		if err != nil {
+			return
+		}
+	}
+
+	s.prefix, err = s.readPrefixMarker()
+	if err != nil {
+		return
+	}
+
+	storage = s
+	return
+}
+
+func (s *AzureStorage) newPrefix() string {
+	if s.prefix == "a/" {
+		return "b/"
+	}
+	return "a/"
+}
+
+func (s *AzureStorage) locationPrefix(location Location) string {
+	if location == Permanent {
+		return s.prefix
+	}
+	return s.newPrefix()
+}
+
+// blobName returns the full blob name of a file under a prefix
+func (s *AzureStorage) blobName(prefix string, filename string) string {
+	return path.Join(s.root, prefix, filename)
+}
+
+func (s *AzureStorage) createContainer() (err error) {
+	_, err = s.client.Create(context.Background(), nil)
+	if bloberror.HasCode(err, bloberror.ContainerAlreadyExists) {
+		return nil
+	}
+	if err == nil {
+		slog.Info("Container created", "url", s.client.URL())
+	}
+	return
+}
+
+// readPrefixMarker returns the current prefix from the marker blob, or an
+// empty prefix if the marker does not exist yet
+func (s *AzureStorage) readPrefixMarker() (prefix string, err error) {
+	reader, err := s.download(s.blobName("", currentPrefixKey))
+	if err != nil {
+		if err == ErrFileNotFound {
+			return "", nil
+		}
+		return
+	}
+	defer reader.Close()
+
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		return
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+// download returns a Reader for a blob, returns ErrFileNotFound if the blob
+// does not exist
+func (s *AzureStorage) download(name string) (reader io.ReadCloser, err error) {
+	response, err := s.client.NewBlobClient(name).DownloadStream(context.Background(), nil)
+	if err != nil {
+		if bloberror.HasCode(err, bloberror.BlobNotFound) {
+			err = ErrFileNotFound
+		}
+		return
+	}
+	return response.Body, nil
+}
+
+// NewReader returns a Reader for a file in a location, returns ErrFileNotFound
+// if the requested path was not found at all
+func (s *AzureStorage) NewReader(filename string, location Location) (reader io.ReadCloser, err error) {
+	return s.download(s.blobName(s.locationPrefix(location), filename))
+}
+
+// StoringMapper returns a mapper that will store read data to a temporary location specified by filename
+func (s *AzureStorage) StoringMapper(filename string, checksum string, hash crypto.Hash) util.ReaderMapper {
+	return func(reader io.ReadCloser) (result io.ReadCloser, err error) {
+		name := s.blobName(s.newPrefix(), filename)
+		uploadOptions := &blockblob.UploadStreamOptions{}
+		if hash != 0 {
+			// the blob is deleted on close if the checksum turns out not to match
+			value := checksumMetadata(hash, checksum)
+			uploadOptions.Metadata = map[string]*string{azureChecksumMetadataKey: &value}
+		}
+
+		pipeReader, pipeWriter := io.Pipe()
+		errs := make(chan error, 1)
+		go func() {
+			_, err := s.client.NewBlockBlobClient(name).UploadStream(context.Background(), pipeReader, uploadOptions)
+			// unblock any pending write if the upload failed early
+			pipeReader.CloseWithError(err)
+			errs <- err
+		}()
+
+		writer := util.NewChecksummingWriter(&waitingCloser{pipeWriter, errs, filename}, checksum, hash)
+		result = util.NewTeeReadCloser(reader, &deletingCloser{writer, func() error {
+			return s.delete(name)
+		}})
+		return
+	}
+}
+
+func (s *AzureStorage) delete(name string) (err error) {
+	_, err = s.client.NewBlobClient(name).Delete(context.Background(), nil)
+	if bloberror.HasCode(err, bloberror.BlobNotFound) {
+		return nil
+	}
+	return
+}
+
+// Checksum returns the checksum of a file in a location. The checksum stored
+// in the blob metadata at upload time is used if available, otherwise the
+// blob is downloaded
+func (s *AzureStorage) Checksum(filename string, location Location, hash crypto.Hash) (checksum string, err error) {
+	properties, err := s.client.NewBlobClient(s.blobName(s.locationPrefix(location), filename)).GetProperties(context.Background(), nil)
+	if err != nil {
+		if bloberror.HasCode(err, bloberror.BlobNotFound) {
+			err = ErrFileNotFound
+		}
+		return
+	}
+
+	// metadata names come back with HTTP header capitalization
+	for key, value := range properties.Metadata {
+		if strings.EqualFold(key, azureChecksumMetadataKey) && value != nil {
+			if cached, ok := parseChecksumMetadata(*value, hash); ok {
+				return cached, nil
+			}
+		}
+	}
+
+	reader, err := s.NewReader(filename, location)
+	if err != nil {
+		return
+	}
+	defer reader.Close()
+	return util.Checksum(reader, hash)
+}
+
+// Recycle will copy a file from the permanent to the temporary location
+func (s *AzureStorage) Recycle(filename string) (err error) {
+	// with a SAS token, the source URL carries the same signature
+	sourceURL := s.client.NewBlobClient(s.blobName(s.prefix, filename)).URL()
+	destination := s.client.NewBlobClient(s.blobName(s.newPrefix(), filename))
+	response, err := destination.StartCopyFromURL(context.Background(), sourceURL, nil)
+	if err != nil {
+		return
+	}
+
+	// copies within the same account are usually synchronous, but might not be
+	status := response.CopyStatus
+	for status != nil && *status == blob.CopyStatusTypePending {
+		time.Sleep(time.Second)
+		properties, err := destination.GetProperties(context.Background(), nil)
+		if err != nil {
+			return err
+		}
+		status = properties.CopyStatus
+	}
+	if status == nil || *status != blob.CopyStatusTypeSuccess {
+		return fmt.Errorf("copy of %s did not succeed", filename)
+	}
+	return
+}
+
+// Commit moves any temporary file accumulated so far to the permanent location
+func (s *AzureStorage) Commit() (err error) {
+	newPrefix := s.newPrefix()
+	_, err = s.client.NewBlockBlobClient(s.blobName("", currentPrefixKey)).UploadBuffer(context.Background(), []byte(newPrefix), nil)
+	if err != nil {
+		return
+	}
+
+	oldPrefix := s.prefix
+	s.prefix = newPrefix
+	if oldPrefix == "" {
+		return
+	}
+
+	listPrefix := s.blobName(oldPrefix, "") + "/"
+	pager := s.client.NewListBlobsFlatPager(&container.ListBlobsFlatOptions{Prefix: &listPrefix})
+	for pager.More() {
+		page, err := pager.NextPage(context.Background())
+		if err != nil {
+			return err
+		}
+		for _, item := range page.Segment.BlobItems {
+			err = s.delete(*item.Name)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return
+}
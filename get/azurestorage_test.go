@@ -0,0 +1,224 @@
+package get
+
+import (
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewAzureStorageCredentials(t *testing.T) {
+	_, err := NewAzureStorage("minima-test", "repo", AzureOptions{AccountKey: "a2V5"})
+	assert.ErrorContains(t, err, "account name")
+	_, err = NewAzureStorage("minima-test", "repo", AzureOptions{AccountName: "minima"})
+	assert.ErrorContains(t, err, "one of account key, SAS token or managed identity")
+	_, err = NewAzureStorage("minima-test", "repo", AzureOptions{AccountName: "minima", AccountKey: "not base64!"})
+	assert.ErrorContains(t, err, "invalid Azure account key")
+}
+
+// azuriteAccountKey is the key of the well-known Azurite development account
+const azuriteAccountKey = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+
+func TestAzureStorage(t *testing.T) {
+	fake, endpoint := newFakeAzure(t, "minima-test")
+	// the copy of the recycled file is polled until it succeeds
+	fake.copyStatus = "pending"
+	options := AzureOptions{AccountName: "devstoreaccount1", AccountKey: azuriteAccountKey, Endpoint: endpoint}
+	storage, err := NewAzureStorage("minima-test", "/repo/", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStorage(t, storage)
+
+	// an existing container is reused, and the committed prefix read back
+	storage, err = NewAzureStorage("minima-test", "/repo/", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "b/", storage.(*AzureStorage).prefix)
+	fake.mutex.Lock()
+	for name := range fake.blobs {
+		assert.False(t, strings.HasPrefix(name, "repo/a/"), name)
+	}
+	// failed copies are reported
+	fake.copyStatus = "failed"
+	fake.mutex.Unlock()
+	assert.ErrorContains(t, storage.Recycle("x86_64/hello+world.rpm"), "did not succeed")
+}
+
+// TestAzuriteStorage runs against the Azurite emulator:
+//
+//	docker run -p 10000:10000 mcr.microsoft.com/azure-storage/azurite azurite-blob --blobHost 0.0.0.0
+//	MINIMA_TEST_AZURE_ENDPOINT=http://127.0.0.1:10000/devstoreaccount1 go test ./get -run TestAzuriteStorage
+func TestAzuriteStorage(t *testing.T) {
+	endpoint := os.Getenv("MINIMA_TEST_AZURE_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("MINIMA_TEST_AZURE_ENDPOINT not set")
+	}
+
+	options := AzureOptions{
+		AccountName: "devstoreaccount1",
+		AccountKey:  azuriteAccountKey,
+		Endpoint:    endpoint,
+	}
+	storage, err := NewAzureStorage("minima-test", "/repo/", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStorage(t, storage)
+}
+
+// fakeAzure serves the subset of the Blob service REST API used by
+// AzureStorage, keeping blobs of a single container in memory
+type fakeAzure struct {
+	mutex     sync.Mutex
+	container string
+	created   bool
+	blobs     map[string]*fakeBlob
+	// copyStatus is returned by copies, pending ones succeed once polled
+	copyStatus string
+}
+
+type fakeBlob struct {
+	content    []byte
+	metadata   http.Header
+	copyStatus string
+}
+
+// newFakeAzure starts a fakeAzure server, returning it and its endpoint
+func newFakeAzure(t *testing.T, container string) (*fakeAzure, string) {
+	fake := &fakeAzure{container: container, blobs: map[string]*fakeBlob{}, copyStatus: "success"}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	return fake, server.URL + "/devstoreaccount1"
+}
+
+func (f *fakeAzure) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	containerPath := "/devstoreaccount1/" + f.container
+	query := r.URL.Query()
+	if r.URL.Path == containerPath && query.Get("restype") == "container" {
+		switch {
+		case r.Method == http.MethodPut && f.created:
+			fakeAzureError(w, http.StatusConflict, "ContainerAlreadyExists")
+		case r.Method == http.MethodPut:
+			f.created = true
+			w.WriteHeader(http.StatusCreated)
+		case r.Method == http.MethodGet && query.Get("comp") == "list":
+			f.list(w, query.Get("prefix"))
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+		}
+		return
+	}
+
+	name, found := strings.CutPrefix(r.URL.Path, containerPath+"/")
+	if !found || !f.created {
+		fakeAzureError(w, http.StatusNotFound, "ContainerNotFound")
+		return
+	}
+	blob := f.blobs[name]
+	switch r.Method {
+	case http.MethodPut:
+		if source := r.Header.Get("x-ms-copy-source"); source != "" {
+			f.copy(w, name, source)
+			return
+		}
+		content, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		metadata := http.Header{}
+		for key, values := range r.Header {
+			if strings.HasPrefix(strings.ToLower(key), "x-ms-meta-") {
+				metadata[key] = values
+			}
+		}
+		f.blobs[name] = &fakeBlob{content: content, metadata: metadata}
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodGet, http.MethodHead:
+		if blob == nil {
+			fakeAzureError(w, http.StatusNotFound, "BlobNotFound")
+			return
+		}
+		for key, values := range blob.metadata {
+			w.Header()[key] = values
+		}
+		w.Header().Set("x-ms-blob-type", "BlockBlob")
+		if blob.copyStatus == "pending" {
+			blob.copyStatus = "success"
+		}
+		if blob.copyStatus != "" {
+			w.Header().Set("x-ms-copy-status", blob.copyStatus)
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(blob.content)))
+		if r.Method == http.MethodGet {
+			w.Write(blob.content)
+		}
+	case http.MethodDelete:
+		if blob == nil {
+			fakeAzureError(w, http.StatusNotFound, "BlobNotFound")
+			return
+		}
+		delete(f.blobs, name)
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+// copy copies a blob of the container to another, given the source URL
+func (f *fakeAzure) copy(w http.ResponseWriter, name string, source string) {
+	sourceURL, err := url.Parse(source)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	sourceBlob := f.blobs[strings.TrimPrefix(sourceURL.Path, "/devstoreaccount1/"+f.container+"/")]
+	if sourceBlob == nil {
+		fakeAzureError(w, http.StatusNotFound, "CannotVerifyCopySource")
+		return
+	}
+	f.blobs[name] = &fakeBlob{content: sourceBlob.content, metadata: sourceBlob.metadata, copyStatus: f.copyStatus}
+	w.Header().Set("x-ms-copy-id", "copy")
+	w.Header().Set("x-ms-copy-status", f.copyStatus)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// list returns the names of blobs starting with a prefix, in one page
+func (f *fakeAzure) list(w http.ResponseWriter, prefix string) {
+	type blobItem struct {
+		Name       string   `xml:"Name"`
+		Properties struct{} `xml:"Properties"`
+	}
+	result := struct {
+		XMLName       xml.Name   `xml:"EnumerationResults"`
+		ContainerName string     `xml:"ContainerName,attr"`
+		Prefix        string     `xml:"Prefix"`
+		Blobs         []blobItem `xml:"Blobs>Blob"`
+		NextMarker    string     `xml:"NextMarker"`
+	}{ContainerName: f.container, Prefix: prefix}
+	for name := range f.blobs {
+		if strings.HasPrefix(name, prefix) {
+			result.Blobs = append(result.Blobs, blobItem{Name: name})
+		}
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+func fakeAzureError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("x-ms-error-code", code)
+	w.WriteHeader(status)
+}
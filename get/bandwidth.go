@@ -0,0 +1,119 @@
+package get
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/uyuni-project/minima/util"
+)
+
+// Bandwidth is a number of bytes per second, 0 meaning no limit. In YAML it
+// can be given as a number of bytes or with a unit, eg. 500KB or 5MB/s
+type Bandwidth int64
+
+var bandwidthUnits = []struct {
+	suffix     string
+	multiplier int64
+}{
+	{"GB", 1024 * 1024 * 1024},
+	{"MB", 1024 * 1024},
+	{"KB", 1024},
+	{"G", 1024 * 1024 * 1024},
+	{"M", 1024 * 1024},
+	{"K", 1024},
+	{"B", 1},
+}
+
+// ParseBandwidth parses a Bandwidth from a string such as 5MB/s
+func ParseBandwidth(value string) (Bandwidth, error) {
+	s := strings.ToUpper(strings.TrimSpace(value))
+	if s == "" || s == "UNLIMITED" {
+		return 0, nil
+	}
+	s = strings.TrimSuffix(s, "/S")
+
+	multiplier := int64(1)
+	for _, unit := range bandwidthUnits {
+		if strings.HasSuffix(s, unit.suffix) {
+			multiplier = unit.multiplier
+			s = strings.TrimSpace(strings.TrimSuffix(s, unit.suffix))
+			break
+		}
+	}
+	number, err := strconv.ParseFloat(s, 64)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("invalid bandwidth %s", value)
+	}
+	return Bandwidth(number * float64(multiplier)), nil
+}
+
+// UnmarshalYAML parses a Bandwidth from YAML
+func (b *Bandwidth) UnmarshalYAML(unmarshal func(interface{}) error) (err error) {
+	var value string
+	if err = unmarshal(&value); err != nil {
+		return
+	}
+	*b, err = ParseBandwidth(value)
+	return
+}
+
+// BandwidthWindow sets a different maximum bandwidth in a daily time window
+type BandwidthWindow struct {
+	// From and To are local times as HH:MM, windows can span midnight
+	From         string
+	To           string
+	MaxBandwidth Bandwidth `yaml:"max_bandwidth"`
+}
+
+// minutes returns the start and end of the window in minutes from midnight
+func (w BandwidthWindow) minutes() (from int, to int, err error) {
+	parse := func(value string) (int, error) {
+		t, err := time.Parse("15:04", value)
+		if err != nil {
+			return 0, fmt.Errorf("invalid time %s in bandwidth schedule, expected HH:MM", value)
+		}
+		return t.Hour()*60 + t.Minute(), nil
+	}
+	if from, err = parse(w.From); err != nil {
+		return
+	}
+	to, err = parse(w.To)
+	return
+}
+
+// contains returns whether a time falls in the window
+func (w BandwidthWindow) contains(t time.Time) bool {
+	from, to, err := w.minutes()
+	if err != nil {
+		return false
+	}
+	minute := t.Hour()*60 + t.Minute()
+	if from <= to {
+		return minute >= from && minute < to
+	}
+	return minute >= from || minute < to
+}
+
+// NewBandwidthLimiter returns a RateLimiter for a maximum bandwidth, changed
+// in the windows of a schedule. Returns nil if there is nothing to limit
+func NewBandwidthLimiter(maxBandwidth Bandwidth, schedule []BandwidthWindow) (*util.RateLimiter, error) {
+	if maxBandwidth == 0 && len(schedule) == 0 {
+		return nil, nil
+	}
+	for _, window := range schedule {
+		if _, _, err := window.minutes(); err != nil {
+			return nil, err
+		}
+	}
+
+	return util.NewRateLimiter(func(now time.Time) int64 {
+		for _, window := range schedule {
+			if window.contains(now) {
+				return int64(window.MaxBandwidth)
+			}
+		}
+		return int64(maxBandwidth)
+	}), nil
+}
@@ -0,0 +1,50 @@
+package get
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseBandwidth(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    Bandwidth
+		wantErr bool
+	}{
+		{"1024", 1024, false},
+		{"500KB", 500 * 1024, false},
+		{"5MB/s", 5 * 1024 * 1024, false},
+		{"1.5 G", 1536 * 1024 * 1024, false},
+		{"unlimited", 0, false},
+		{"fast", 0, true},
+		{"-5MB", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseBandwidth(tt.value)
+		assert.EqualValues(t, tt.wantErr, (err != nil), tt.value)
+		assert.Equal(t, tt.want, got, tt.value)
+	}
+}
+
+func TestBandwidthWindow(t *testing.T) {
+	night := BandwidthWindow{From: "22:00", To: "06:00"}
+	day := BandwidthWindow{From: "08:30", To: "18:00"}
+	at := func(hour, minute int) time.Time {
+		return time.Date(2024, 1, 1, hour, minute, 0, 0, time.Local)
+	}
+
+	assert.True(t, night.contains(at(23, 0)))
+	assert.True(t, night.contains(at(5, 59)))
+	assert.False(t, night.contains(at(6, 0)))
+	assert.False(t, night.contains(at(12, 0)))
+	assert.True(t, day.contains(at(8, 30)))
+	assert.False(t, day.contains(at(8, 29)))
+
+	_, err := NewBandwidthLimiter(0, []BandwidthWindow{{From: "25:00", To: "06:00"}})
+	assert.Error(t, err)
+	limiter, err := NewBandwidthLimiter(0, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, limiter)
+}
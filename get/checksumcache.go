@@ -0,0 +1,140 @@
+package get
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+// checksumCache remembers checksums of files written to a Storage, so that
+// they do not need to be read again when deciding whether a file can be
+// skipped. An entry is only valid as long as the identity of the file (eg.
+// size, modification time and inode) did not change since it was recorded.
+//
+// Entries are appended to a journal file as soon as they are known, so that
+// the cache survives interrupted syncs.
+type checksumCache struct {
+	path    string
+	entries map[string]checksumCacheEntry
+	mutex   sync.Mutex
+}
+
+// checksumCacheEntry is a line in the checksum cache journal
+type checksumCacheEntry struct {
+	Filename string `json:"filename"`
+	Identity string `json:"identity"`
+	Hash     string `json:"hash"`
+	Checksum string `json:"checksum"`
+}
+
+// newChecksumCache returns a checksumCache backed by the journal at path,
+// loading any entries previously recorded there
+func newChecksumCache(path string) *checksumCache {
+	cache := &checksumCache{path: path, entries: make(map[string]checksumCacheEntry)}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return cache
+	}
+	// the last line might be truncated if minima was interrupted, drop it so
+	// that further entries start on a line of their own
+	if complete := bytes.LastIndexByte(content, '\n') + 1; complete < len(content) {
+		content = content[:complete]
+		os.Truncate(path, int64(complete))
+	}
+
+	for _, line := range bytes.Split(content, []byte("\n")) {
+		var entry checksumCacheEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			continue
+		}
+		if entry.Checksum == "" {
+			cache.forget(entry.Filename)
+			continue
+		}
+		cache.entries[cacheKey(entry.Filename, entry.Hash)] = entry
+	}
+	return cache
+}
+
+func cacheKey(filename string, hashName string) string {
+	return hashName + ":" + filename
+}
+
+// get returns the cached checksum of a file, if one was recorded for the same identity
+func (c *checksumCache) get(filename string, identity string, hash crypto.Hash) (checksum string, found bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry, found := c.entries[cacheKey(filename, hash.String())]
+	if !found || entry.Identity != identity {
+		return "", false
+	}
+	return entry.Checksum, true
+}
+
+// add records the checksum of a file and appends it to the journal
+func (c *checksumCache) add(filename string, identity string, hash crypto.Hash, checksum string) (err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry := checksumCacheEntry{filename, identity, hash.String(), checksum}
+	c.entries[cacheKey(filename, entry.Hash)] = entry
+	return c.append(entry)
+}
+
+// remove forgets checksums of a file, eg. before it is written again, and
+// appends an entry without checksum to the journal
+func (c *checksumCache) remove(filename string) (err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !c.forget(filename) {
+		return nil
+	}
+	return c.append(checksumCacheEntry{Filename: filename})
+}
+
+// forget removes entries of a file for any hash, returning whether there were any
+func (c *checksumCache) forget(filename string) (found bool) {
+	for key, entry := range c.entries {
+		if entry.Filename == filename {
+			delete(c.entries, key)
+			found = true
+		}
+	}
+	return
+}
+
+// append writes an entry to the journal
+func (c *checksumCache) append(entry checksumCacheEntry) (err error) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	file, err := os.OpenFile(c.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return
+	}
+	_, err = file.Write(append(line, '\n'))
+	if err != nil {
+		file.Close()
+		return
+	}
+	return file.Close()
+}
+
+// clear forgets all entries and removes the journal
+func (c *checksumCache) clear() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.entries = make(map[string]checksumCacheEntry)
+	err := os.Remove(c.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
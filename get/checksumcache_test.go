@@ -0,0 +1,91 @@
+package get
+
+import (
+	"crypto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/uyuni-project/minima/util"
+)
+
+func TestChecksumCache(t *testing.T) {
+	journal := filepath.Join(t.TempDir(), "checksums")
+
+	cache := newChecksumCache(journal)
+	_, found := cache.get("a.rpm", "1-2-3", crypto.SHA256)
+	assert.False(t, found)
+
+	assert.NoError(t, cache.add("a.rpm", "1-2-3", crypto.SHA256, "abc"))
+	assert.NoError(t, cache.add("b.rpm", "4-5-6", crypto.SHA256, "def"))
+
+	// simulate an interrupted write
+	file, err := os.OpenFile(journal, os.O_APPEND|os.O_WRONLY, 0644)
+	assert.NoError(t, err)
+	_, err = file.WriteString(`{"filename":"c.rpm","ident`)
+	assert.NoError(t, err)
+	file.Close()
+
+	reloaded := newChecksumCache(journal)
+	checksum, found := reloaded.get("a.rpm", "1-2-3", crypto.SHA256)
+	assert.True(t, found)
+	assert.Equal(t, "abc", checksum)
+
+	// entries added after an interrupted write are kept
+	assert.NoError(t, reloaded.add("c.rpm", "7-8-9", crypto.SHA256, "ghi"))
+	checksum, found = newChecksumCache(journal).get("c.rpm", "7-8-9", crypto.SHA256)
+	assert.True(t, found)
+	assert.Equal(t, "ghi", checksum)
+
+	// changed identity or different hash function
+	_, found = reloaded.get("b.rpm", "4-5-7", crypto.SHA256)
+	assert.False(t, found)
+	_, found = reloaded.get("b.rpm", "4-5-6", crypto.SHA1)
+	assert.False(t, found)
+
+	// files written again
+	assert.NoError(t, reloaded.remove("a.rpm"))
+	_, found = reloaded.get("a.rpm", "1-2-3", crypto.SHA256)
+	assert.False(t, found)
+	_, found = newChecksumCache(journal).get("a.rpm", "1-2-3", crypto.SHA256)
+	assert.False(t, found)
+	_, found = newChecksumCache(journal).get("b.rpm", "4-5-6", crypto.SHA256)
+	assert.True(t, found)
+
+	assert.NoError(t, reloaded.clear())
+	_, found = newChecksumCache(journal).get("a.rpm", "1-2-3", crypto.SHA256)
+	assert.False(t, found)
+}
+
+func TestFileStorageChecksum(t *testing.T) {
+	directory := filepath.Join(t.TempDir(), "repo")
+	storage := NewFileStorage(directory).(*FileStorage)
+
+	_, err := storage.Checksum("a.rpm", Temporary, crypto.SHA256)
+	assert.Equal(t, ErrFileNotFound, err)
+
+	path := filepath.Join(directory+"-in-progress", "a.rpm")
+	assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	assert.NoError(t, os.WriteFile(path, []byte("Hello, World"), 0644))
+
+	expected := "03675ac53ff9cd1535ccc7dfcdfa2c458c5218371f418dc136f2d19ac1fbe8a5"
+	checksum, err := storage.Checksum("a.rpm", Temporary, crypto.SHA256)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, checksum)
+
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	cached, found := storage.cache.get("a.rpm", fileIdentity(info), crypto.SHA256)
+	assert.True(t, found)
+	assert.Equal(t, expected, cached)
+
+	// checksums are returned even if they cannot be cached
+	storage.cache = newChecksumCache(filepath.Join(t.TempDir(), "missing", "checksums"))
+	checksum, err = storage.Checksum("a.rpm", Temporary, crypto.SHA256)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, checksum)
+	store := util.Compose(storage.StoringMapper("b.rpm", expected, crypto.SHA256), util.Nop)
+	assert.NoError(t, store(util.NewNopReadCloser(strings.NewReader("Hello, World"))))
+}
@@ -0,0 +1,79 @@
+package get
+
+import (
+	"crypto"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+
+	"github.com/uyuni-project/minima/util"
+)
+
+// hashOf returns the hash of a checksum type, or an error if the type is
+// unknown, so that files are never synced without being verified
+func hashOf(checksumType string) (crypto.Hash, error) {
+	hash, found := hashMap[checksumType]
+	if !found {
+		return 0, fmt.Errorf("unknown checksum type '%s'", checksumType)
+	}
+	return hash, nil
+}
+
+// matchesChecksums returns whether a file stored in the current sync matches
+// further checksums
+func (r *Syncer) matchesChecksums(location string, checksums []XMLChecksum) bool {
+	for _, checksum := range checksums {
+		hash, err := hashOf(checksum.Type)
+		if err != nil {
+			return false
+		}
+		readChecksum, err := r.storage.Checksum(location, Temporary, hash)
+		if err != nil || readChecksum != strings.ToLower(checksum.Checksum) {
+			return false
+		}
+	}
+	return true
+}
+
+// checksumVerifier returns a ReaderConsumer applying f, and checking all the
+// read data against further checksums if all checksums are verified. Data f
+// does not read is read to the end
+func (r *Syncer) checksumVerifier(checksums []XMLChecksum, f util.ReaderConsumer) (util.ReaderConsumer, error) {
+	if !r.allChecksums || len(checksums) == 0 {
+		return f, nil
+	}
+	hashes := make([]crypto.Hash, len(checksums))
+	for i, checksum := range checksums {
+		var err error
+		if hashes[i], err = hashOf(checksum.Type); err != nil {
+			return nil, err
+		}
+	}
+
+	return func(reader io.ReadCloser) error {
+		// a download may be retried, so hashes are not reused
+		states := make([]hash.Hash, len(hashes))
+		writers := make([]io.Writer, len(hashes))
+		for i, h := range hashes {
+			states[i] = h.New()
+			writers[i] = states[i]
+		}
+		tee := io.TeeReader(reader, io.MultiWriter(writers...))
+		if err := f(util.NewNopReadCloser(tee)); err != nil {
+			return err
+		}
+		if _, err := io.Copy(io.Discard, tee); err != nil {
+			return err
+		}
+
+		for i, checksum := range checksums {
+			actual := hex.EncodeToString(states[i].Sum(nil))
+			if actual != strings.ToLower(checksum.Checksum) {
+				return util.NewChecksumError(checksum.Checksum, actual)
+			}
+		}
+		return nil
+	}, nil
+}
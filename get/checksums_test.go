@@ -0,0 +1,134 @@
+package get
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/uyuni-project/minima/util"
+)
+
+func TestHashOf(t *testing.T) {
+	for _, checksumType := range []string{"md5", "sha", "sha1", "sha224", "sha256", "sha384", "sha512"} {
+		hash, err := hashOf(checksumType)
+		assert.NoError(t, err, checksumType)
+		assert.True(t, hash.Available(), checksumType)
+	}
+	_, err := hashOf("sha3-256")
+	assert.Error(t, err)
+	_, err = hashOf("")
+	assert.Error(t, err)
+}
+
+func TestChecksumVerifier(t *testing.T) {
+	content := []byte("hello world")
+	md5Sum := md5.Sum(content)
+	sha384Sum := sha512.Sum384(content)
+	checksums := []XMLChecksum{
+		{Type: "md5", Checksum: hex.EncodeToString(md5Sum[:])},
+		{Type: "sha384", Checksum: hex.EncodeToString(sha384Sum[:])},
+	}
+	// reads only the first bytes
+	var read []byte
+	partial := func(reader io.ReadCloser) (err error) {
+		read = make([]byte, 5)
+		_, err = io.ReadFull(reader, read)
+		return
+	}
+	repoURL, _ := url.Parse("http://example.com/repo")
+
+	syncer := NewSyncer(*repoURL, nil, WithVerifyAllChecksums(true))
+	verify, err := syncer.checksumVerifier(checksums, partial)
+	assert.NoError(t, err)
+	assert.NoError(t, verify(util.NewNopReadCloser(bytes.NewReader(content))))
+	assert.Equal(t, "hello", string(read))
+	// retried downloads are verified again
+	assert.NoError(t, verify(util.NewNopReadCloser(bytes.NewReader(content))))
+
+	err = verify(util.NewNopReadCloser(strings.NewReader("hello there")))
+	var checksumErr *util.ChecksumError
+	assert.True(t, errors.As(err, &checksumErr))
+
+	_, err = syncer.checksumVerifier([]XMLChecksum{{Type: "crc32", Checksum: "0"}}, util.Nop)
+	assert.Error(t, err)
+
+	// only verified if enabled
+	syncer = NewSyncer(*repoURL, nil)
+	verify, err = syncer.checksumVerifier([]XMLChecksum{{Type: "crc32", Checksum: "0"}}, util.Nop)
+	assert.NoError(t, err)
+	assert.NoError(t, verify(util.NewNopReadCloser(strings.NewReader("hello there"))))
+
+	// packages of unknown checksum types are not downloaded
+	err = syncer.downloadPackage("a.rpm", XMLPackage{Location: XMLLocation{Href: "a.rpm"}, Checksum: XMLChecksum{Type: "crc32", Checksum: "0"}}, "a.rpm")
+	assert.ErrorContains(t, err, "unknown checksum type 'crc32'")
+}
+
+func TestDecodeDebianChecksums(t *testing.T) {
+	release := "Origin: Debian\nMD5Sum:\n 123 4 main/binary-amd64/Packages\n" +
+		"SHA256:\n abc 4 main/binary-amd64/Packages\nSHA512:\n fed 4 main/binary-amd64/Packages\n"
+	repomd, err := decodeRelease(strings.NewReader(release))
+	assert.NoError(t, err)
+	assert.Equal(t, []XMLChecksum{{Type: "md5", Checksum: "123"}, {Type: "sha512", Checksum: "fed"}}, repomd.Data[0].Checksums)
+
+	packages := "Package: a\nFilename: a.deb\nMD5sum: 123\nSHA1: 456\nSHA256: abc\n"
+	metadata, err := decodePackages(strings.NewReader(packages), "")
+	assert.NoError(t, err)
+	assert.Equal(t, []XMLChecksum{{Type: "md5", Checksum: "123"}, {Type: "sha1", Checksum: "456"}}, metadata.Packages[0].Checksums)
+
+	sources := "Package: a\nFiles:\n 123 12 a_1.0-1.dsc\n 456 34 a_1.0.orig.tar.xz\n" +
+		"Checksums-Sha256:\n abc 12 a_1.0-1.dsc\n def 34 a_1.0.orig.tar.xz\n"
+	metadata, err = decodeSources(strings.NewReader(sources), "")
+	assert.NoError(t, err)
+	assert.Equal(t, []XMLChecksum{{Type: "md5", Checksum: "123"}}, metadata.Packages[0].Checksums)
+	assert.Equal(t, []XMLChecksum{{Type: "md5", Checksum: "456"}}, metadata.Packages[1].Checksums)
+
+	_, err = decodeSources(strings.NewReader("Package: a\nFiles:\n 123 a_1.0-1.dsc\nChecksums-Sha256:\n abc 12 a_1.0-1.dsc\n"), "")
+	assert.Error(t, err)
+}
+
+func TestStoreDebRepoAllChecksums(t *testing.T) {
+	repoDirectory := t.TempDir()
+	if err := os.CopyFS(repoDirectory, os.DirFS(filepath.Join("testdata", "deb_repo"))); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.FileServer(http.Dir(repoDirectory)))
+	defer server.Close()
+	repoURL, err := url.Parse(server.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newSyncer := func(verify bool) *Syncer {
+		return NewSyncer(*repoURL, NewFileStorage(t.TempDir()),
+			WithHTTPClient(server.Client()),
+			WithArchs("amd64"),
+			WithSources(PolicyInclude),
+			WithVerifyAllChecksums(verify),
+			WithRetry(RetryConfig{InitialBackoff: 1, MetadataRestarts: 1}),
+		)
+	}
+	assert.NoError(t, newSyncer(true).StoreRepo())
+
+	// a wrong MD5Sum is only detected if all checksums are verified
+	releasePath := filepath.Join(repoDirectory, "Release")
+	release, err := os.ReadFile(releasePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release = bytes.Replace(release, []byte(" 4ec5a01c7f645246a27e3ce1b45695fd 1138 Packages.gz"), []byte(" 00000000000000000000000000000000 1138 Packages.gz"), 1)
+	if err := os.WriteFile(releasePath, release, 0644); err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, newSyncer(false).StoreRepo())
+	assert.Error(t, newSyncer(true).StoreRepo())
+}
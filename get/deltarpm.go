@@ -0,0 +1,125 @@
+package get
+
+import (
+	"encoding/xml"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// Functions to handle delta rpms, listed in deltainfo.xml (SUSE) or
+// prestodelta.xml (Fedora) by the package they update
+
+// isDeltainfo returns whether a type of repomd.xml entry lists delta rpms
+func isDeltainfo(metadataType string) bool {
+	return metadataType == "deltainfo" || metadataType == "prestodelta"
+}
+
+// processDeltainfo reads a stored deltainfo or prestodelta file and returns
+// delta rpms to download and to recycle
+func (r *Syncer) processDeltainfo(path string, packages *packageSet, checksumMap map[string]XMLChecksum) (deltasToDownload []XMLPackage, deltasToRecycle []XMLPackage, err error) {
+	reader, err := r.storage.NewReader(path, Temporary)
+	if err != nil {
+		return
+	}
+	defer reader.Close()
+
+	compType := strings.Trim(filepath.Ext(path), ".")
+	uncompressed, err := uncompress(reader, compType)
+	if err != nil {
+		return
+	}
+	defer uncompressed.Close()
+
+	targets, err := decodeDeltainfo(uncompressed)
+	if err != nil {
+		return
+	}
+	return r.filterDeltas(targets, packages, checksumMap)
+}
+
+// readDeltaChecksums adds checksums of delta rpms listed in a previously
+// downloaded deltainfo or prestodelta file to checksumMap, returning false if
+// it cannot be read
+func (r *Syncer) readDeltaChecksums(path string, checksumMap map[string]XMLChecksum) bool {
+	reader, err := r.storage.NewReader(path, Permanent)
+	if err != nil {
+		return false
+	}
+	defer reader.Close()
+
+	compType := strings.Trim(filepath.Ext(path), ".")
+	uncompressed, err := uncompress(reader, compType)
+	if err != nil {
+		return false
+	}
+	defer uncompressed.Close()
+
+	targets, err := decodeDeltainfo(uncompressed)
+	if err != nil {
+		return false
+	}
+	for _, target := range targets {
+		for _, delta := range target.Deltas {
+			checksumMap[delta.Filename] = delta.Checksum
+		}
+	}
+	return true
+}
+
+// decodeDeltainfo returns the packages listed in deltainfo or prestodelta,
+// with their deltas
+func decodeDeltainfo(reader io.Reader) (targets []deltaPackage, err error) {
+	decoder := xml.NewDecoder(reader)
+	for {
+		var token xml.Token
+		token, err = decoder.RawToken()
+		if err == io.EOF {
+			return targets, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local != "newpackage" {
+			continue
+		}
+		var element *xmlElement
+		element, err = readElement(decoder, start.Copy())
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, parseDeltaPackage(element))
+	}
+}
+
+// filterDeltas returns delta rpms updating synced packages to download and to
+// recycle
+func (r *Syncer) filterDeltas(targets []deltaPackage, packages *packageSet, checksumMap map[string]XMLChecksum) (deltasToDownload []XMLPackage, deltasToRecycle []XMLPackage, err error) {
+	for _, target := range targets {
+		if !packages.nevras[target.nevra()] {
+			continue
+		}
+		for _, delta := range target.Deltas {
+			// deltas are stored and verified like metadata files
+			err = validateData(XMLData{Type: "delta", Location: XMLLocation{Href: delta.Filename}, Checksum: delta.Checksum, Size: delta.Size})
+			if err != nil {
+				return nil, nil, err
+			}
+			pack := XMLPackage{
+				Name:     target.Name,
+				Arch:     target.Arch,
+				Location: XMLLocation{Href: delta.Filename},
+				Checksum: delta.Checksum,
+				Size:     XMLSize{Package: delta.Size},
+			}
+			switch r.decide(pack.Location.Href, pack.Checksum, nil, checksumMap) {
+			case Download:
+				deltasToDownload = append(deltasToDownload, pack)
+			case Recycle:
+				deltasToRecycle = append(deltasToRecycle, pack)
+			}
+		}
+	}
+	return
+}
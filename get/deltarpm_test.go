@@ -0,0 +1,169 @@
+package get
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeDeltainfo(t *testing.T) {
+	deltainfo := `<?xml version="1.0" encoding="UTF-8"?>
+<deltainfo>
+  <newpackage name="a" epoch="0" version="1.0" release="1" arch="x86_64">
+    <delta oldepoch="0" oldversion="0.9" oldrelease="1">
+      <filename>x86_64/a-0.9-1_1.0-1.x86_64.drpm</filename>
+      <size>123</size>
+      <checksum type="sha256">ddd</checksum>
+    </delta>
+    <delta oldepoch="0" oldversion="0.8" oldrelease="1">
+      <filename>x86_64/a-0.8-1_1.0-1.x86_64.drpm</filename>
+      <size>456</size>
+      <checksum type="sha256">eee</checksum>
+    </delta>
+  </newpackage>
+</deltainfo>`
+	targets, err := decodeDeltainfo(strings.NewReader(deltainfo))
+	assert.NoError(t, err)
+	assert.Equal(t, []deltaPackage{{
+		Name: "a", Epoch: "0", Version: "1.0", Release: "1", Arch: "x86_64",
+		Deltas: []packageDelta{
+			{Filename: "x86_64/a-0.9-1_1.0-1.x86_64.drpm", Checksum: XMLChecksum{Type: "sha256", Checksum: "ddd"}, Size: 123},
+			{Filename: "x86_64/a-0.8-1_1.0-1.x86_64.drpm", Checksum: XMLChecksum{Type: "sha256", Checksum: "eee"}, Size: 456},
+		},
+	}}, targets)
+
+	_, err = decodeDeltainfo(strings.NewReader(`<deltainfo><newpackage name="a"><delta>`))
+	assert.Error(t, err)
+}
+
+func TestStoreRepoDeltaRPMs(t *testing.T) {
+	// the test repo, with deltas to a synced and to a skipped package
+	repoDirectory := t.TempDir()
+	if err := os.CopyFS(repoDirectory, os.DirFS(filepath.Join("testdata", "repo"))); err != nil {
+		t.Fatal(err)
+	}
+	deltas := map[string]string{
+		"x86_64/milkyway-dummy-1.0-1.1_2.0-1.1.x86_64.drpm": "x86_64 delta",
+		"i586/milkyway-dummy-1.0-1.1_2.0-1.1.i586.drpm":     "i586 delta",
+	}
+	for location, content := range deltas {
+		if err := os.WriteFile(filepath.Join(repoDirectory, filepath.FromSlash(location)), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	newpackage := func(arch string) string {
+		location := fmt.Sprintf("%s/milkyway-dummy-1.0-1.1_2.0-1.1.%s.drpm", arch, arch)
+		sum := sha256.Sum256([]byte(deltas[location]))
+		return fmt.Sprintf(`  <newpackage name="milkyway-dummy" epoch="0" version="2.0" release="1.1" arch="%s">
+    <delta oldepoch="0" oldversion="1.0" oldrelease="1.1">
+      <filename>%s</filename>
+      <size>%d</size>
+      <checksum type="sha256">%s</checksum>
+    </delta>
+  </newpackage>
+`, arch, location, len(deltas[location]), hex.EncodeToString(sum[:]))
+	}
+	addDeltainfo(t, repoDirectory, "<deltainfo>\n"+newpackage("x86_64")+newpackage("i586")+"</deltainfo>\n")
+
+	server := httptest.NewServer(http.FileServer(http.Dir(repoDirectory)))
+	defer server.Close()
+	repoURL, err := url.Parse(server.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, regenerate := range []bool{false, true} {
+		directory := t.TempDir()
+		var mutex sync.Mutex
+		events := map[EventType][]string{}
+		syncer := NewSyncer(*repoURL, NewFileStorage(directory),
+			WithHTTPClient(server.Client()),
+			WithArchs("x86_64"),
+			WithSkipLegacy(true),
+			WithDeltaRPMs(true),
+			WithRegenerateMetadata(regenerate),
+			WithEventHandler(func(event Event) {
+				mutex.Lock()
+				defer mutex.Unlock()
+				events[event.Type] = append(events[event.Type], event.File)
+			}),
+		)
+
+		// first sync
+		assert.NoError(t, syncer.StoreRepo())
+		synced, err := os.ReadFile(filepath.Join(directory, "x86_64", "milkyway-dummy-1.0-1.1_2.0-1.1.x86_64.drpm"))
+		assert.NoError(t, err)
+		assert.Equal(t, "x86_64 delta", string(synced))
+		_, err = os.Stat(filepath.Join(directory, "i586", "milkyway-dummy-1.0-1.1_2.0-1.1.i586.drpm"))
+		assert.True(t, os.IsNotExist(err))
+
+		// second sync, the delta is recycled
+		events = map[EventType][]string{}
+		assert.NoError(t, syncer.StoreRepo())
+		_, err = os.Stat(filepath.Join(directory, "x86_64", "milkyway-dummy-1.0-1.1_2.0-1.1.x86_64.drpm"))
+		assert.NoError(t, err)
+		assert.Contains(t, events[EventFileRecycled], "x86_64/milkyway-dummy-1.0-1.1_2.0-1.1.x86_64.drpm")
+		assert.NotContains(t, events[EventFileDownloaded], filepath.Join("x86_64", "milkyway-dummy-1.0-1.1_2.0-1.1.x86_64.drpm"))
+	}
+
+	// deltas are not synced by default
+	directory := t.TempDir()
+	syncer := NewSyncer(*repoURL, NewFileStorage(directory), WithHTTPClient(server.Client()), WithArchs("x86_64"))
+	assert.NoError(t, syncer.StoreRepo())
+	_, err = os.Stat(filepath.Join(directory, "x86_64", "milkyway-dummy-1.0-1.1_2.0-1.1.x86_64.drpm"))
+	assert.True(t, os.IsNotExist(err))
+
+	// deltas not matching their checksum are not synced
+	if err := os.WriteFile(filepath.Join(repoDirectory, "x86_64", "milkyway-dummy-1.0-1.1_2.0-1.1.x86_64.drpm"), []byte("x86_64 DELTA"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	syncer = NewSyncer(*repoURL, NewFileStorage(t.TempDir()),
+		WithHTTPClient(server.Client()),
+		WithArchs("x86_64"),
+		WithDeltaRPMs(true),
+		WithRetry(RetryConfig{InitialBackoff: 1, MetadataRestarts: 1}),
+	)
+	assert.Error(t, syncer.StoreRepo())
+}
+
+// addDeltainfo stores deltainfo in a repo and adds it to its repomd.xml
+func addDeltainfo(t *testing.T, repoDirectory string, deltainfo string) {
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write([]byte(deltainfo))
+	writer.Close()
+	sum := sha256.Sum256(compressed.Bytes())
+	checksum := hex.EncodeToString(sum[:])
+	location := "repodata/" + checksum + "-deltainfo.xml.gz"
+	if err := os.WriteFile(filepath.Join(repoDirectory, filepath.FromSlash(location)), compressed.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	repomdPath := filepath.Join(repoDirectory, "repodata", "repomd.xml")
+	repomd, err := os.ReadFile(repomdPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := fmt.Sprintf(`<data type="deltainfo">
+  <checksum type="sha256">%s</checksum>
+  <location href="%s"/>
+  <size>%d</size>
+</data>
+</repomd>`, checksum, location, compressed.Len())
+	repomd = bytes.Replace(repomd, []byte("</repomd>"), []byte(entry), 1)
+	if err := os.WriteFile(repomdPath, repomd, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,328 @@
+package get
+
+import (
+	"crypto"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+
+	"github.com/uyuni-project/minima/util"
+)
+
+// ReplicationConfig defines how a FanoutStorage handles failing targets
+type ReplicationConfig struct {
+	// OnFailure is "abort" (default) to fail the whole sync as soon as any
+	// target fails, or "continue" to skip the failing target for the rest of
+	// the sync, commit the others and report the failure at the end
+	OnFailure string `yaml:"on_failure"`
+	// Retries is the number of times a failing operation on a target is
+	// retried before the target is considered failed. Downloads cannot be
+	// retried per target, as they are streamed to all targets at once
+	Retries int
+}
+
+// FanoutTarget is a named Storage a FanoutStorage replicates to
+type FanoutTarget struct {
+	Name    string
+	Storage Storage
+}
+
+// FanoutStorage replicates data to several storages at once: every download
+// is streamed to all targets, and all targets are committed together. Reads
+// are served by the first target that did not fail
+type FanoutStorage struct {
+	targets []*fanoutTarget
+	policy  ReplicationConfig
+	// mutex guards the errors of targets, set by concurrent downloads
+	mutex sync.Mutex
+}
+
+type fanoutTarget struct {
+	FanoutTarget
+	// err is set when the target failed during the current sync
+	err error
+}
+
+// NewFanoutStorage returns a new Storage replicating to all targets
+func NewFanoutStorage(targets []FanoutTarget, policy ReplicationConfig) Storage {
+	s := &FanoutStorage{policy: policy}
+	for _, target := range targets {
+		s.targets = append(s.targets, &fanoutTarget{FanoutTarget: target})
+	}
+	return s
+}
+
+// ReplicationError is returned on Commit if some targets failed and were
+// skipped, while the others were committed
+type ReplicationError struct {
+	Failures []string
+}
+
+func (e *ReplicationError) Error() string {
+	return fmt.Sprintf("Replication failed for: %s", strings.Join(e.Failures, ", "))
+}
+
+// healthy returns targets that did not fail so far
+func (s *FanoutStorage) healthy() (result []*fanoutTarget) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, target := range s.targets {
+		if target.err == nil {
+			result = append(result, target)
+		}
+	}
+	return
+}
+
+// fail handles an error on a target according to the policy, returning an
+// error if the sync should be aborted
+func (s *FanoutStorage) fail(target *fanoutTarget, err error) error {
+	if s.policy.OnFailure != "continue" {
+		return fmt.Errorf("%s: %v", target.Name, err)
+	}
+
+	slog.Warn("Storage failed, skipping it for the rest of the sync", "storage", target.Name, "error", err)
+	s.mutex.Lock()
+	target.err = fmt.Errorf("%s: %v", target.Name, err)
+	s.mutex.Unlock()
+	if len(s.healthy()) == 0 {
+		return s.replicationError()
+	}
+	return nil
+}
+
+// replicationError returns an error listing failed targets, and resets them
+// so that they are attempted again in the next sync
+func (s *FanoutStorage) replicationError() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	failures := []string{}
+	for _, target := range s.targets {
+		if target.err != nil {
+			failures = append(failures, target.err.Error())
+			target.err = nil
+		}
+	}
+	if len(failures) == 0 {
+		return nil
+	}
+	return &ReplicationError{failures}
+}
+
+// retry runs an operation on a target up to Retries more times if it fails
+func (s *FanoutStorage) retry(operation func() error) (err error) {
+	for i := 0; ; i++ {
+		err = operation()
+		if err == nil || err == ErrFileNotFound || i >= s.policy.Retries {
+			return
+		}
+		slog.Warn("Storage operation failed, retrying", "error", err)
+	}
+}
+
+// NewReader returns a Reader for a file in a location from the first healthy
+// target, returns ErrFileNotFound if the requested path was not found at all
+func (s *FanoutStorage) NewReader(filename string, location Location) (reader io.ReadCloser, err error) {
+	for _, target := range s.healthy() {
+		err = s.retry(func() (err error) {
+			reader, err = target.Storage.NewReader(filename, location)
+			return
+		})
+		if err == nil || err == ErrFileNotFound {
+			return
+		}
+		if err = s.fail(target, err); err != nil {
+			return
+		}
+	}
+	return nil, s.replicationError()
+}
+
+// Checksum returns the checksum of a file in a location, only if the file is
+// present with the same checksum in all healthy targets
+func (s *FanoutStorage) Checksum(filename string, location Location, hash crypto.Hash) (checksum string, err error) {
+	for _, target := range s.healthy() {
+		var targetChecksum string
+		err = s.retry(func() (err error) {
+			targetChecksum, err = target.Storage.Checksum(filename, location, hash)
+			return
+		})
+		if err == ErrFileNotFound {
+			return
+		}
+		if err != nil {
+			if err = s.fail(target, err); err != nil {
+				return
+			}
+			continue
+		}
+
+		if checksum != "" && checksum != targetChecksum {
+			return "", fmt.Errorf("%s differs between storages", filename)
+		}
+		checksum = targetChecksum
+	}
+	return
+}
+
+// Recycle will copy a file from the permanent to the temporary location in all
+// targets. If a target does not have the file, it is copied from another one
+func (s *FanoutStorage) Recycle(filename string) (err error) {
+	for _, target := range s.healthy() {
+		err = s.retry(func() error {
+			return target.Storage.Recycle(filename)
+		})
+		if err != nil {
+			// eg. a newly added target
+			err = s.copyFromOtherTarget(target, filename)
+		}
+		if err != nil {
+			if err = s.fail(target, err); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// copyFromOtherTarget stores a file from the permanent location of another
+// healthy target into the temporary location of target, verifying the copy
+// against the checksum of the source
+func (s *FanoutStorage) copyFromOtherTarget(target *fanoutTarget, filename string) (err error) {
+	err = ErrFileNotFound
+	for _, source := range s.healthy() {
+		if source == target {
+			continue
+		}
+		var checksum string
+		checksum, err = source.Storage.Checksum(filename, Permanent, crypto.SHA256)
+		if err != nil {
+			continue
+		}
+		var reader io.ReadCloser
+		reader, err = source.Storage.NewReader(filename, Permanent)
+		if err != nil {
+			continue
+		}
+		return util.Compose(target.Storage.StoringMapper(filename, checksum, crypto.SHA256), util.Nop)(reader)
+	}
+	return
+}
+
+// StoringMapper returns a mapper that will store read data to a temporary
+// location specified by filename in all healthy targets
+func (s *FanoutStorage) StoringMapper(filename string, checksum string, hash crypto.Hash) util.ReaderMapper {
+	return func(reader io.ReadCloser) (result io.ReadCloser, err error) {
+		writer := &fanoutWriter{storage: s}
+		for _, target := range s.healthy() {
+			pipeReader, pipeWriter := io.Pipe()
+			branch := &fanoutBranch{target: target, writer: pipeWriter, errs: make(chan error, 1)}
+			mapper := target.Storage.StoringMapper(filename, checksum, hash)
+			go func() {
+				err := util.Compose(mapper, discard)(pipeReader)
+				// unblock any pending write if the target failed early
+				pipeReader.CloseWithError(err)
+				branch.errs <- err
+			}()
+			writer.branches = append(writer.branches, branch)
+		}
+		result = util.NewTeeReadCloser(reader, writer)
+		return
+	}
+}
+
+// discard is a ReaderConsumer reading everything, so that it is stored
+func discard(reader io.ReadCloser) (err error) {
+	_, err = io.Copy(io.Discard, reader)
+	return
+}
+
+// fanoutWriter writes to the StoringMappers of all healthy targets, each
+// running in its own goroutine and reading from a pipe
+type fanoutWriter struct {
+	storage  *FanoutStorage
+	branches []*fanoutBranch
+}
+
+type fanoutBranch struct {
+	target *fanoutTarget
+	writer *io.PipeWriter
+	errs   chan error
+	done   bool
+	err    error
+}
+
+// wait closes the pipe to the branch and returns the result of its mapper
+func (b *fanoutBranch) wait() error {
+	if !b.done {
+		b.writer.Close()
+		b.err = <-b.errs
+		b.done = true
+	}
+	return b.err
+}
+
+func (w *fanoutWriter) Write(p []byte) (n int, err error) {
+	for _, branch := range w.branches {
+		if branch.done {
+			continue
+		}
+		if _, err = branch.writer.Write(p); err != nil {
+			if err = w.handle(branch, branch.wait()); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return len(p), nil
+}
+
+func (w *fanoutWriter) Close() (err error) {
+	var checksumErr error
+	for _, branch := range w.branches {
+		alreadyHandled := branch.done
+		branchErr := branch.wait()
+		if alreadyHandled {
+			continue
+		}
+		if _, checksumError := branchErr.(*util.ChecksumError); checksumError {
+			// same data for all targets, not a target failure
+			checksumErr = branchErr
+			continue
+		}
+		if handleErr := w.handle(branch, branchErr); handleErr != nil && err == nil {
+			err = handleErr
+		}
+	}
+	if err != nil {
+		return
+	}
+	return checksumErr
+}
+
+// handle applies the failure policy to a branch error
+func (w *fanoutWriter) handle(branch *fanoutBranch, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, checksumError := err.(*util.ChecksumError); checksumError {
+		return err
+	}
+	return w.storage.fail(branch.target, err)
+}
+
+// Commit moves any temporary file accumulated so far to the permanent location
+// in all healthy targets. If some targets failed, a ReplicationError is returned
+// after committing the others
+func (s *FanoutStorage) Commit() (err error) {
+	for _, target := range s.healthy() {
+		err = s.retry(target.Storage.Commit)
+		if err != nil {
+			if err = s.fail(target, err); err != nil {
+				return
+			}
+		}
+	}
+	return s.replicationError()
+}
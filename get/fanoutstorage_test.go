@@ -0,0 +1,120 @@
+package get
+
+import (
+	"crypto"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/uyuni-project/minima/util"
+)
+
+// failingStorage is a FileStorage failing on writes
+type failingStorage struct {
+	Storage
+}
+
+func (s *failingStorage) StoringMapper(filename string, checksum string, hash crypto.Hash) util.ReaderMapper {
+	return func(reader io.ReadCloser) (io.ReadCloser, error) {
+		return nil, errors.New("disk full")
+	}
+}
+
+// corruptStorage is a Storage returning corrupted content, eg. after bit rot
+type corruptStorage struct {
+	Storage
+}
+
+func (s *corruptStorage) NewReader(filename string, location Location) (io.ReadCloser, error) {
+	reader, err := s.Storage.NewReader(filename, location)
+	if err != nil {
+		return nil, err
+	}
+	reader.Close()
+	return io.NopCloser(strings.NewReader("Hello, Wørld")), nil
+}
+
+func storeString(storage Storage, filename, content string) error {
+	reader := io.NopCloser(strings.NewReader(content))
+	return util.Compose(storage.StoringMapper(filename, "", 0), util.Nop)(reader)
+}
+
+func TestFanoutStorage(t *testing.T) {
+	directory := t.TempDir()
+	first := filepath.Join(directory, "first")
+	second := filepath.Join(directory, "second")
+	storage := NewFanoutStorage([]FanoutTarget{
+		{Name: "first", Storage: NewFileStorage(first)},
+		{Name: "second", Storage: NewFileStorage(second)},
+	}, ReplicationConfig{})
+
+	assert.NoError(t, storeString(storage, "a.rpm", "Hello, World"))
+	assert.NoError(t, storage.Commit())
+	for _, dir := range []string{first, second} {
+		content, err := os.ReadFile(filepath.Join(dir, "a.rpm"))
+		assert.NoError(t, err)
+		assert.Equal(t, "Hello, World", string(content))
+	}
+
+	checksum, err := storage.Checksum("a.rpm", Permanent, crypto.SHA256)
+	assert.NoError(t, err)
+	assert.Equal(t, "03675ac53ff9cd1535ccc7dfcdfa2c458c5218371f418dc136f2d19ac1fbe8a5", checksum)
+
+	// a file missing from one target is copied from the other
+	assert.NoError(t, os.Remove(filepath.Join(second, "a.rpm")))
+	assert.NoError(t, storage.Recycle("a.rpm"))
+	assert.NoError(t, storage.Commit())
+	content, err := os.ReadFile(filepath.Join(second, "a.rpm"))
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello, World", string(content))
+
+	// corrupt files are not copied to other targets
+	storage = NewFanoutStorage([]FanoutTarget{
+		{Name: "first", Storage: &corruptStorage{NewFileStorage(first)}},
+		{Name: "second", Storage: NewFileStorage(second)},
+	}, ReplicationConfig{})
+	assert.NoError(t, os.Remove(filepath.Join(second, "a.rpm")))
+	err = storage.Recycle("a.rpm")
+	assert.ErrorContains(t, err, "second")
+	assert.ErrorContains(t, err, "Checksum")
+
+	// checksum errors are reported as such
+	reader := io.NopCloser(strings.NewReader("Hello, World"))
+	err = util.Compose(storage.StoringMapper("b.rpm", "wrong", crypto.SHA256), util.Nop)(reader)
+	if _, ok := err.(*util.ChecksumError); !ok {
+		t.Errorf("Expected ChecksumError, got %v", err)
+	}
+}
+
+func TestFanoutStorageFailurePolicy(t *testing.T) {
+	directory := t.TempDir()
+	healthy := filepath.Join(directory, "healthy")
+	targets := []FanoutTarget{
+		{Name: "healthy", Storage: NewFileStorage(healthy)},
+		{Name: "failing", Storage: &failingStorage{NewFileStorage(filepath.Join(directory, "failing"))}},
+	}
+
+	storage := NewFanoutStorage(targets, ReplicationConfig{OnFailure: "abort"})
+	err := storeString(storage, "a.rpm", "Hello, World")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "failing")
+
+	storage = NewFanoutStorage(targets, ReplicationConfig{OnFailure: "continue"})
+	assert.NoError(t, storeString(storage, "a.rpm", "Hello, World"))
+	err = storage.Commit()
+	replicationErr, ok := err.(*ReplicationError)
+	if assert.True(t, ok) {
+		assert.Len(t, replicationErr.Failures, 1)
+	}
+	_, err = os.Stat(filepath.Join(healthy, "a.rpm"))
+	assert.NoError(t, err)
+
+	// failed targets are attempted again in the next sync
+	assert.NoError(t, storeString(storage, "b.rpm", "Hello, World"))
+	_, ok = storage.Commit().(*ReplicationError)
+	assert.True(t, ok)
+}
@@ -0,0 +1,13 @@
+//go:build !unix
+
+package get
+
+import (
+	"fmt"
+	"os"
+)
+
+// fileIdentity returns a string that changes whenever the file is modified
+func fileIdentity(info os.FileInfo) string {
+	return fmt.Sprintf("%d-%d", info.Size(), info.ModTime().UnixNano())
+}
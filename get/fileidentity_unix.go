@@ -0,0 +1,18 @@
+//go:build unix
+
+package get
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// fileIdentity returns a string that changes whenever the file is replaced or modified
+func fileIdentity(info os.FileInfo) string {
+	var inode uint64
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		inode = uint64(stat.Ino)
+	}
+	return fmt.Sprintf("%d-%d-%d", info.Size(), info.ModTime().UnixNano(), inode)
+}
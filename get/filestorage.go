@@ -3,7 +3,7 @@ package get
 import (
 	"crypto"
 	"io"
-	"log"
+	"log/slog"
 	"os"
 	"path"
 	"path/filepath"
@@ -14,11 +14,12 @@ import (
 // FileStorage allows to store data in a local directory
 type FileStorage struct {
 	directory string
+	cache     *checksumCache
 }
 
 // NewFileStorage returns a new Storage given a local directory
 func NewFileStorage(directory string) Storage {
-	return &FileStorage{directory}
+	return &FileStorage{directory, newChecksumCache(directory + "-in-progress.checksums")}
 }
 
 // NewReader returns a Reader for a file in a location, returns ErrFileNotFound
@@ -37,12 +38,7 @@ func (s *FileStorage) NewReader(filename string, location Location) (reader io.R
 		return
 	}
 
-	f, err := os.Open(fullPath)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	return f, err
+	return os.Open(fullPath)
 }
 
 // StoringMapper returns a mapper that will store read data to a temporary location specified by filename
@@ -60,11 +56,83 @@ func (s *FileStorage) StoringMapper(filename string, checksum string, hash crypt
 			return
 		}
 
-		result = util.NewTeeReadCloser(reader, util.NewChecksummingWriter(file, checksum, hash))
+		writer := util.NewChecksummingWriter(file, checksum, hash)
+		result = util.NewTeeReadCloser(reader, &cachingWriter{writer, s, filename, fullPath, hash})
 		return
 	}
 }
 
+// cachingWriter records the checksum of a fully written and verified file in
+// the checksum cache
+type cachingWriter struct {
+	*util.ChecksummingWriter
+	storage  *FileStorage
+	filename string
+	fullPath string
+	hash     crypto.Hash
+}
+
+// Close closes the underlying ChecksummingWriter and records the checksum.
+// Failing to record it does not make the written file invalid
+func (w *cachingWriter) Close() (err error) {
+	err = w.ChecksummingWriter.Close()
+	if err != nil || w.hash == 0 {
+		return
+	}
+	info, cerr := os.Stat(w.fullPath)
+	if cerr != nil {
+		slog.Warn("Cannot cache checksum", "file", w.filename, "error", cerr)
+		return
+	}
+	if cerr := w.storage.cache.add(w.filename, fileIdentity(info), w.hash, w.Sum()); cerr != nil {
+		slog.Warn("Cannot cache checksum", "file", w.filename, "error", cerr)
+	}
+	return
+}
+
+// Checksum returns the checksum of a file in a location. Checksums of files
+// in the temporary location are cached, so that files from interrupted syncs
+// do not need to be read again
+func (s *FileStorage) Checksum(filename string, location Location, hash crypto.Hash) (checksum string, err error) {
+	fullPath := path.Join(s.directory, filename)
+	if location == Temporary {
+		fullPath = path.Join(s.directory+"-in-progress", filename)
+	}
+
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = ErrFileNotFound
+		}
+		return
+	}
+	identity := fileIdentity(info)
+
+	if location == Temporary {
+		if cached, found := s.cache.get(filename, identity, hash); found {
+			return cached, nil
+		}
+	}
+
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	checksum, err = util.Checksum(f, hash)
+	if err != nil {
+		return
+	}
+
+	if location == Temporary {
+		if cerr := s.cache.add(filename, identity, hash, checksum); cerr != nil {
+			slog.Warn("Cannot cache checksum", "file", filename, "error", cerr)
+		}
+	}
+	return
+}
+
 // Recycle will copy a file from the permanent to the temporary location
 func (s *FileStorage) Recycle(filename string) (err error) {
 	newPath := path.Join(s.directory+"-in-progress", filename)
@@ -87,6 +155,11 @@ func (s *FileStorage) Commit() error {
 	oldDir := s.directory + "-old"
 	tmpDir := s.directory + "-in-progress"
 
+	// checksums of temporary files are meaningless once they are moved
+	if err := s.cache.clear(); err != nil {
+		return err
+	}
+
 	// If in-progress contains actual packages, it is a candidate for being swapped with the target repo.
 	// Otherwise, it's a situation where we only have metadata in x-in-progress.
 	if hasPackages(tmpDir) {
@@ -117,8 +190,7 @@ func hasPackages(dir string) bool {
 			return nil
 		}
 		if !info.IsDir() {
-			ext := filepath.Ext(path)
-			if _, check := packageExtensions[ext]; check {
+			if isPackageFile(path) {
 				found = true
 				return filepath.SkipAll // Stop walking as soon as one is found
 			}
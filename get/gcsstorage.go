@@ -0,0 +1,251 @@
+package get
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"strings"
+
+	gcs "cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+
+	"github.com/uyuni-project/minima/util"
+)
+
+// GCSStorage allows to store data in a Google Cloud Storage bucket. Like
+// S3Storage, files are kept under one of two prefixes ("a/" and "b/"): the
+// temporary location is the prefix not currently in use, and Commit swaps
+// them by updating a marker object
+type GCSStorage struct {
+	bucket *gcs.BucketHandle
+	root   string
+	prefix string
+}
+
+// GCSOptions holds optional settings of a GCSStorage
+type GCSOptions struct {
+	// CredentialsFile is the path to a service account JSON key file. If empty,
+	// Application Default Credentials are used (GOOGLE_APPLICATION_CREDENTIALS,
+	// gcloud credentials or the metadata server)
+	CredentialsFile string
+	// ProjectID is the project the bucket is created in
+	ProjectID string
+	// Endpoint overrides the default https://storage.googleapis.com, eg. to
+	// use the fake-gcs-server emulator. Requests are not authenticated unless
+	// CredentialsFile is set
+	Endpoint string
+	// SkipBucketCreation assumes the bucket already exists
+	SkipBucketCreation bool
+}
+
+// NewGCSStorage returns a new Storage backed by a Google Cloud Storage bucket,
+// storing files under the root object name prefix
+func NewGCSStorage(bucket string, root string, options GCSOptions) (storage Storage, err error) {
+	clientOptions := []option.ClientOption{}
+	if options.CredentialsFile != "" {
+		clientOptions = append(clientOptions, option.WithCredentialsFile(options.CredentialsFile))
+	}
+	if options.Endpoint != "" {
+		clientOptions = append(clientOptions, option.WithEndpoint(strings.TrimSuffix(options.Endpoint, "/")+"/storage/v1/"))
+		if options.CredentialsFile == "" {
+			clientOptions = append(clientOptions, option.WithoutAuthentication())
+		}
+	}
+
+	client, err := gcs.NewClient(context.Background(), clientOptions...)
+	if err != nil {
+		return
+	}
+
+	s := &GCSStorage{
+		bucket: client.Bucket(bucket),
+		root:   strings.Trim(root, "/"),
+	}
+
+	if !options.SkipBucketCreation {
+		err = s.createBucket(options.ProjectID)
+		if err != nil {
+			return
+		}
+	}
+
+	s.prefix, err = s.readPrefixMarker()
+	if err != nil {
+		return
+	}
+
+	storage = s
+	return
+}
+
+func (s *GCSStorage) newPrefix() string {
+	if s.prefix == "a/" {
+		return "b/"
+	}
+	return "a/"
+}
+
+func (s *GCSStorage) locationPrefix(location Location) string {
+	if location == Permanent {
+		return s.prefix
+	}
+	return s.newPrefix()
+}
+
+// object returns the handle of a file under a prefix
+func (s *GCSStorage) object(prefix string, filename string) *gcs.ObjectHandle {
+	return s.bucket.Object(path.Join(s.root, prefix, filename))
+}
+
+func (s *GCSStorage) createBucket(projectID string) (err error) {
+	if projectID == "" {
+		return errors.New("a project ID is needed to create a Google Cloud Storage bucket")
+	}
+	err = s.bucket.Create(context.Background(), projectID, nil)
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusConflict {
+		// bucket already exists
+		return nil
+	}
+	if err == nil {
+		slog.Info("Bucket created", "bucket", s.bucket.BucketName())
+	}
+	return
+}
+
+// readPrefixMarker returns the current prefix from the marker object, or an
+// empty prefix if the marker does not exist yet
+func (s *GCSStorage) readPrefixMarker() (prefix string, err error) {
+	reader, err := s.object("", currentPrefixKey).NewReader(context.Background())
+	if err != nil {
+		if errors.Is(err, gcs.ErrObjectNotExist) {
+			return "", nil
+		}
+		return
+	}
+	defer reader.Close()
+
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		return
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+// writePrefixMarker stores the current prefix in the marker object
+func (s *GCSStorage) writePrefixMarker(prefix string) (err error) {
+	writer := s.object("", currentPrefixKey).NewWriter(context.Background())
+	writer.ContentType = "text/plain"
+	_, err = io.WriteString(writer, prefix)
+	if err != nil {
+		writer.Close()
+		return
+	}
+	return writer.Close()
+}
+
+// NewReader returns a Reader for a file in a location, returns ErrFileNotFound
+// if the requested path was not found at all
+func (s *GCSStorage) NewReader(filename string, location Location) (reader io.ReadCloser, err error) {
+	reader, err = s.object(s.locationPrefix(location), filename).NewReader(context.Background())
+	if errors.Is(err, gcs.ErrObjectNotExist) {
+		err = ErrFileNotFound
+	}
+	return
+}
+
+// StoringMapper returns a mapper that will store read data to a temporary location specified by filename
+func (s *GCSStorage) StoringMapper(filename string, checksum string, hash crypto.Hash) util.ReaderMapper {
+	return func(reader io.ReadCloser) (result io.ReadCloser, err error) {
+		object := s.object(s.newPrefix(), filename)
+		upload := object.NewWriter(context.Background())
+		if hash != 0 {
+			// the object is deleted on close if the checksum turns out not to match
+			upload.Metadata = map[string]string{checksumMetadataKey: checksumMetadata(hash, checksum)}
+		}
+
+		writer := util.NewChecksummingWriter(upload, checksum, hash)
+		result = util.NewTeeReadCloser(reader, &deletingCloser{writer, func() error {
+			return s.delete(object)
+		}})
+		return
+	}
+}
+
+func (s *GCSStorage) delete(object *gcs.ObjectHandle) (err error) {
+	err = object.Delete(context.Background())
+	if errors.Is(err, gcs.ErrObjectNotExist) {
+		return nil
+	}
+	return
+}
+
+// Checksum returns the checksum of a file in a location. The checksum stored
+// in the object metadata at upload time is used if available, otherwise the
+// object is downloaded
+func (s *GCSStorage) Checksum(filename string, location Location, hash crypto.Hash) (checksum string, err error) {
+	attrs, err := s.object(s.locationPrefix(location), filename).Attrs(context.Background())
+	if err != nil {
+		if errors.Is(err, gcs.ErrObjectNotExist) {
+			err = ErrFileNotFound
+		}
+		return
+	}
+
+	if value, found := attrs.Metadata[checksumMetadataKey]; found {
+		if cached, ok := parseChecksumMetadata(value, hash); ok {
+			return cached, nil
+		}
+	}
+
+	reader, err := s.NewReader(filename, location)
+	if err != nil {
+		return
+	}
+	defer reader.Close()
+	return util.Checksum(reader, hash)
+}
+
+// Recycle will copy a file from the permanent to the temporary location
+func (s *GCSStorage) Recycle(filename string) (err error) {
+	source := s.object(s.prefix, filename)
+	_, err = s.object(s.newPrefix(), filename).CopierFrom(source).Run(context.Background())
+	return
+}
+
+// Commit moves any temporary file accumulated so far to the permanent location
+func (s *GCSStorage) Commit() (err error) {
+	newPrefix := s.newPrefix()
+	err = s.writePrefixMarker(newPrefix)
+	if err != nil {
+		return
+	}
+
+	oldPrefix := s.prefix
+	s.prefix = newPrefix
+	if oldPrefix == "" {
+		return
+	}
+
+	objects := s.bucket.Objects(context.Background(), &gcs.Query{Prefix: path.Join(s.root, oldPrefix) + "/"})
+	for {
+		attrs, err := objects.Next()
+		if errors.Is(err, iterator.Done) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		err = s.delete(s.bucket.Object(attrs.Name))
+		if err != nil {
+			return err
+		}
+	}
+}
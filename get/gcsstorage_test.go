@@ -0,0 +1,33 @@
+package get
+
+import (
+	"testing"
+
+	"github.com/fsouza/fake-gcs-server/fakestorage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGCSStorage(t *testing.T) {
+	server, err := fakestorage.NewServerWithOptions(fakestorage.Options{Scheme: "http", Host: "127.0.0.1", PublicHost: "127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	options := GCSOptions{Endpoint: server.URL(), ProjectID: "minima-test"}
+	storage, err := NewGCSStorage("minima-test", "/repo/", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStorage(t, storage)
+
+	// an existing bucket is reused, and the committed prefix read back
+	storage, err = NewGCSStorage("minima-test", "/repo/", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "b/", storage.(*GCSStorage).prefix)
+	objects, _, err := server.ListObjectsWithOptions("minima-test", fakestorage.ListOptions{Prefix: "repo/a/"})
+	assert.NoError(t, err)
+	assert.Empty(t, objects)
+}
@@ -1,15 +1,21 @@
 package get
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // UnexpectedStatusCodeError signals a successful request that resulted in an unexpected status code
 type UnexpectedStatusCodeError struct {
 	URL        string
 	StatusCode int
+	// RetryAfter is the delay requested by the server via Retry-After, if any
+	RetryAfter time.Duration
 }
 
 func (e UnexpectedStatusCodeError) Error() string {
@@ -18,13 +24,19 @@ func (e UnexpectedStatusCodeError) Error() string {
 
 // ReadURL returns a Reader for bytes from an http URL
 func ReadURL(url string) (r io.ReadCloser, err error) {
-	response, err := http.Get(url)
+	return readURL(http.DefaultClient, url)
+}
+
+// readURL returns a Reader for bytes from an http URL, using a client
+func readURL(client *http.Client, url string) (r io.ReadCloser, err error) {
+	response, err := client.Get(url)
 	if err != nil {
 		return
 	}
 
 	if response.StatusCode != 200 {
-		err = &UnexpectedStatusCodeError{url, response.StatusCode}
+		response.Body.Close()
+		err = &UnexpectedStatusCodeError{URL: url, StatusCode: response.StatusCode, RetryAfter: retryAfter(response)}
 		return
 	}
 
@@ -32,3 +44,55 @@ func ReadURL(url string) (r io.ReadCloser, err error) {
 
 	return
 }
+
+// errRangeNotSupported is returned if a server does not serve byte ranges
+var errRangeNotSupported = errors.New("byte ranges not supported")
+
+// readURLRange returns a Reader for a range of bytes from an http URL, from
+// start to end included
+func readURLRange(client *http.Client, url string, start int64, end int64) (r io.ReadCloser, err error) {
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return
+	}
+	request.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	response, err := client.Do(request)
+	if err != nil {
+		return
+	}
+
+	switch {
+	case response.StatusCode == 200:
+		response.Body.Close()
+		err = errRangeNotSupported
+		return
+	case response.StatusCode != 206:
+		response.Body.Close()
+		err = &UnexpectedStatusCodeError{URL: url, StatusCode: response.StatusCode, RetryAfter: retryAfter(response)}
+		return
+	case !strings.HasPrefix(response.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-%d/", start, end)):
+		response.Body.Close()
+		err = fmt.Errorf("unexpected range '%s' from %s", response.Header.Get("Content-Range"), url)
+		return
+	}
+
+	r = response.Body
+	return
+}
+
+// retryAfter returns the delay in the Retry-After header of a response, if any
+func retryAfter(response *http.Response) time.Duration {
+	value := response.Header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if delay := time.Until(date); delay > 0 {
+			return delay
+		}
+	}
+	return 0
+}
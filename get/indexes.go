@@ -0,0 +1,168 @@
+package get
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+)
+
+// Selection of the indexes listed in a metadata file, eg. to leave out
+// translations or Contents files of Debian repos. Metadata files listing
+// indexes that are left out are rewritten, and signed if a key is configured
+
+// matchesIndexPattern returns whether a repo-relative path, or one of its
+// parent directories, matches a pattern in path.Match syntax. Patterns
+// without a slash match names at any depth
+func matchesIndexPattern(pattern string, relativePath string) bool {
+	anyDepth := !strings.Contains(pattern, "/")
+	for current := path.Clean(relativePath); current != "." && current != "/"; current = path.Dir(current) {
+		name := current
+		if anyDepth {
+			name = path.Base(current)
+		}
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// includesIndex returns whether an index is synced according to the
+// configured include and exclude patterns
+func (r *Syncer) includesIndex(relativePath string) bool {
+	included := len(r.includeIndexes) == 0
+	for _, pattern := range r.includeIndexes {
+		if matchesIndexPattern(pattern, relativePath) {
+			included = true
+			break
+		}
+	}
+	for _, pattern := range r.excludeIndexes {
+		if matchesIndexPattern(pattern, relativePath) {
+			return false
+		}
+	}
+	return included
+}
+
+// selectingIndexes returns whether indexes of a repo are selected by
+// patterns
+func (r *Syncer) selectingIndexes(repoType RepoType) bool {
+	return (len(r.includeIndexes) > 0 || len(r.excludeIndexes) > 0) && repoType.FilterMetadata != nil
+}
+
+// selectIndexes returns the entries of a metadata file that are synced, and
+// whether any was left out
+func (r *Syncer) selectIndexes(data []XMLData) (selected []XMLData, excluded bool) {
+	for _, entry := range data {
+		if !r.includesIndex(entry.Location.Href) {
+			r.logger().Debug("Leaving out index", "file", entry.Location.Href)
+			excluded = true
+			continue
+		}
+		selected = append(selected, entry)
+	}
+	return
+}
+
+// releaseChecksumFields are the fields of a Debian Release file listing
+// indexes with their checksums
+var releaseChecksumFields = map[string]bool{
+	"MD5Sum": true,
+	"SHA1":   true,
+	"SHA256": true,
+	"SHA512": true,
+}
+
+// filterRelease returns a Debian Release file only listing indexes for which
+// keep returns true, otherwise unchanged
+func filterRelease(release []byte, keep func(string) bool) ([]byte, error) {
+	var result bytes.Buffer
+	inChecksums := false
+	for _, line := range strings.SplitAfter(string(release), "\n") {
+		content := strings.TrimRight(line, "\r\n")
+		switch {
+		case strings.HasPrefix(content, " "):
+			if inChecksums {
+				fields := strings.Fields(content)
+				if len(fields) != 3 {
+					return nil, fmt.Errorf("badly formatted file entry: '%s'", content)
+				}
+				if !keep(fields[2]) {
+					continue
+				}
+			}
+		case content != "":
+			field, _, _ := strings.Cut(content, ":")
+			inChecksums = releaseChecksumFields[field]
+		}
+		result.WriteString(line)
+	}
+	return result.Bytes(), nil
+}
+
+// signMetadata returns an armored detached signature of a metadata file made
+// with an armored OpenPGP private key, and the armored public key
+func signMetadata(privateKey []byte, metadata []byte) (signature []byte, publicKey []byte, err error) {
+	entities, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(privateKey))
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid signing key: %w", err)
+	}
+	signer := entities[0]
+	if signer.PrivateKey == nil {
+		return nil, nil, errors.New("invalid signing key: not a private key")
+	}
+	if signer.PrivateKey.Encrypted {
+		return nil, nil, errors.New("invalid signing key: the key is protected by a passphrase")
+	}
+
+	var signatureBuffer bytes.Buffer
+	if err = openpgp.ArmoredDetachSign(&signatureBuffer, signer, bytes.NewReader(metadata), nil); err != nil {
+		return
+	}
+
+	var keyBuffer bytes.Buffer
+	writer, err := armor.Encode(&keyBuffer, openpgp.PublicKeyType, nil)
+	if err != nil {
+		return
+	}
+	if err = signer.Serialize(writer); err != nil {
+		return
+	}
+	if err = writer.Close(); err != nil {
+		return
+	}
+	return signatureBuffer.Bytes(), keyBuffer.Bytes(), nil
+}
+
+// storeRewrittenMetadata stores a metadata file generated by minima with its
+// signature and signing key, if a signing key is configured
+func (r *Syncer) storeRewrittenMetadata(metadataPath string, metadata []byte, repoType RepoType) error {
+	if err := r.storeBytes(metadataPath, metadata); err != nil {
+		return err
+	}
+	if repoType.MetadataSignatureExt == "" {
+		return nil
+	}
+	if len(r.signingKey) == 0 {
+		r.logger().Warn("No signing key configured, rewritten metadata is not signed", "file", metadataPath)
+		return nil
+	}
+
+	signature, publicKey, err := signMetadata(r.signingKey, metadata)
+	if err != nil {
+		return err
+	}
+	if err = r.storeBytes(metadataPath+repoType.MetadataSignatureExt, signature); err != nil {
+		return err
+	}
+	if repoType.MetadataKeyExt != "" {
+		return r.storeBytes(metadataPath+repoType.MetadataKeyExt, publicKey)
+	}
+	return nil
+}
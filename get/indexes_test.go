@@ -0,0 +1,207 @@
+package get
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIncludesIndex(t *testing.T) {
+	assert.True(t, matchesIndexPattern("main/binary-*", "main/binary-amd64/by-hash/SHA256/abc"))
+	assert.True(t, matchesIndexPattern("Contents-*", "Contents-amd64.gz"))
+	assert.True(t, matchesIndexPattern("Contents-*", "main/Contents-amd64.gz"))
+	assert.False(t, matchesIndexPattern("main/Contents-*", "contrib/Contents-amd64.gz"))
+	assert.False(t, matchesIndexPattern("main/i18n", "main/i18n-other/Index"))
+
+	repoURL, _ := url.Parse("http://example.com/debian/dists/stable/")
+	syncer := NewSyncer(*repoURL, nil)
+	assert.True(t, syncer.includesIndex("main/i18n/Translation-de.bz2"))
+
+	syncer = NewSyncer(*repoURL, nil, WithIncludeIndexes("main/binary-amd64", "main/i18n/Translation-en*"), WithExcludeIndexes("*.bz2"))
+	for relativePath, expected := range map[string]bool{
+		"main/binary-amd64/Packages.xz":   true,
+		"main/binary-amd64/Packages.bz2":  false,
+		"main/binary-arm64/Packages.xz":   false,
+		"main/i18n/Translation-en.xz":     true,
+		"main/i18n/Translation-de.xz":     false,
+		"main/installer-amd64/MANIFEST":   false,
+		"main/dep11/Components-amd64.yml": false,
+	} {
+		assert.Equal(t, expected, syncer.includesIndex(relativePath), relativePath)
+	}
+}
+
+func TestFilterRelease(t *testing.T) {
+	release := "Origin: Debian\nMD5Sum:\n 123 4 main/binary-amd64/Packages\n 456 7 main/i18n/Translation-en\n" +
+		"SHA256:\n abc 4 main/binary-amd64/Packages\n def 7 main/i18n/Translation-en\nAcquire-By-Hash: yes\n"
+	filtered, err := filterRelease([]byte(release), func(relativePath string) bool {
+		return !strings.Contains(relativePath, "i18n")
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "Origin: Debian\nMD5Sum:\n 123 4 main/binary-amd64/Packages\n"+
+		"SHA256:\n abc 4 main/binary-amd64/Packages\nAcquire-By-Hash: yes\n", string(filtered))
+
+	_, err = filterRelease([]byte("SHA256:\n abc main/binary-amd64/Packages\n"), func(string) bool { return true })
+	assert.Error(t, err)
+}
+
+func TestSignMetadata(t *testing.T) {
+	privateKey := testSigningKey(t)
+	signature, publicKey, err := signMetadata(privateKey, []byte("metadata"))
+	assert.NoError(t, err)
+
+	keyring, err := readKeyRing([][]byte{publicKey})
+	assert.NoError(t, err)
+	assert.Nil(t, keyring[0].PrivateKey)
+	assert.NoError(t, checkDetachedSignature(keyring, []byte("metadata"), signature))
+	assert.Error(t, checkDetachedSignature(keyring, []byte("other metadata"), signature))
+
+	_, _, err = signMetadata(publicKey, []byte("metadata"))
+	assert.Error(t, err)
+}
+
+func TestStoreDebRepoIndexes(t *testing.T) {
+	// the test repo, with compressed translations only, the uncompressed
+	// variant being listed but not published
+	repoDirectory := t.TempDir()
+	if err := os.CopyFS(repoDirectory, os.DirFS(filepath.Join("testdata", "deb_repo"))); err != nil {
+		t.Fatal(err)
+	}
+	translation := []byte("Package: hoag-dummy\nDescription-en: hoag\n")
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write(translation)
+	writer.Close()
+	if err := os.MkdirAll(filepath.Join(repoDirectory, "i18n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(repoDirectory, "i18n", "Translation-en.gz"), compressed.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	addReleaseEntry(t, repoDirectory, "i18n/Translation-en", translation)
+	addReleaseEntry(t, repoDirectory, "i18n/Translation-en.gz", compressed.Bytes())
+	original, err := os.ReadFile(filepath.Join(repoDirectory, "Release"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.FileServer(http.Dir(repoDirectory)))
+	defer server.Close()
+	repoURL, err := url.Parse(server.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// all indexes
+	directory := t.TempDir()
+	syncer := NewSyncer(*repoURL, NewFileStorage(directory), WithHTTPClient(server.Client()), WithArchs("amd64"))
+	assert.NoError(t, syncer.StoreRepo())
+	synced, err := os.ReadFile(filepath.Join(directory, "Release"))
+	assert.NoError(t, err)
+	assert.Equal(t, original, synced)
+	_, err = os.Stat(filepath.Join(directory, "i18n", "Translation-en.gz"))
+	assert.NoError(t, err)
+
+	// translations left out, Release rewritten and signed
+	privateKey := testSigningKey(t)
+	directory = t.TempDir()
+	syncer = NewSyncer(*repoURL, NewFileStorage(directory),
+		WithHTTPClient(server.Client()),
+		WithArchs("amd64"),
+		WithExcludeIndexes("i18n"),
+		WithSigningKey(privateKey),
+	)
+	assert.NoError(t, syncer.StoreRepo())
+	_, err = os.Stat(filepath.Join(directory, "i18n", "Translation-en.gz"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(directory, "amd64", "hoag-dummy_1.1-2.1_amd64.deb"))
+	assert.NoError(t, err)
+
+	release, err := os.ReadFile(filepath.Join(directory, "Release"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotContains(t, string(release), "i18n")
+	assert.Contains(t, string(release), " Packages.gz\n")
+	signature, err := os.ReadFile(filepath.Join(directory, "Release.gpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, err := os.ReadFile(filepath.Join(directory, "Release.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring, err := readKeyRing([][]byte{publicKey})
+	assert.NoError(t, err)
+	assert.NoError(t, checkDetachedSignature(keyring, release, signature))
+
+	// second sync
+	assert.NoError(t, syncer.StoreRepo())
+
+	// a rewritten Release is never published unsigned
+	directory = t.TempDir()
+	syncer = NewSyncer(*repoURL, NewFileStorage(directory), WithHTTPClient(server.Client()), WithArchs("amd64"), WithExcludeIndexes("i18n"))
+	assert.ErrorContains(t, syncer.StoreRepo(), "no signing key")
+	_, err = os.Stat(filepath.Join(directory, "Release"))
+	assert.True(t, os.IsNotExist(err))
+
+	// a listed index is missing, with no compressed variant to replace it
+	addReleaseEntry(t, repoDirectory, "Contents-amd64.gz", []byte("not published"))
+	directory = t.TempDir()
+	syncer = NewSyncer(*repoURL, NewFileStorage(directory), WithHTTPClient(server.Client()), WithArchs("amd64"))
+	assert.ErrorContains(t, syncer.StoreRepo(), "404")
+	_, err = os.Stat(filepath.Join(directory, "Release"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+// addReleaseEntry lists a file in the Release file of a deb repo
+func addReleaseEntry(t *testing.T, repoDirectory string, relativePath string, content []byte) {
+	releasePath := filepath.Join(repoDirectory, "Release")
+	release, err := os.ReadFile(releasePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	md5Sum := md5.Sum(content)
+	sha1Sum := sha1.Sum(content)
+	sha256Sum := sha256.Sum256(content)
+	for field, sum := range map[string][]byte{"MD5Sum:\n": md5Sum[:], "SHA1:\n": sha1Sum[:], "SHA256:\n": sha256Sum[:]} {
+		entry := fmt.Sprintf(" %s %d %s\n", hex.EncodeToString(sum), len(content), relativePath)
+		release = bytes.Replace(release, []byte(field), []byte(field+entry), 1)
+	}
+	if err := os.WriteFile(releasePath, release, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testSigningKey returns a new armored OpenPGP private key
+func testSigningKey(t *testing.T) []byte {
+	entity, err := openpgp.NewEntity("minima test", "", "test@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buffer bytes.Buffer
+	writer, err := armor.Encode(&buffer, openpgp.PrivateKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = entity.SerializePrivate(writer, nil); err != nil {
+		t.Fatal(err)
+	}
+	writer.Close()
+	return buffer.Bytes()
+}
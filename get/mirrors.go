@@ -0,0 +1,213 @@
+package get
+
+import (
+	"bufio"
+	"crypto"
+	"encoding/xml"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/uyuni-project/minima/util"
+)
+
+// metalink files, version 3 (http://www.metalinker.org/) or 4 (RFC 5854)
+
+// xmlMetalink maps a <metalink> tag
+type xmlMetalink struct {
+	// version 3
+	Files []xmlMetalinkFile `xml:"files>file"`
+	// version 4
+	Files4 []xmlMetalinkFile `xml:"file"`
+}
+
+// xmlMetalinkFile maps a <file> tag in a metalink
+type xmlMetalinkFile struct {
+	Name string `xml:"name,attr"`
+	// version 3
+	Hashes []xmlMetalinkHash `xml:"verification>hash"`
+	URLs   []xmlMetalinkURL  `xml:"resources>url"`
+	// version 4
+	Hashes4 []xmlMetalinkHash `xml:"hash"`
+	URLs4   []xmlMetalinkURL  `xml:"url"`
+}
+
+// xmlMetalinkHash maps a <hash> tag in a metalink
+type xmlMetalinkHash struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+// xmlMetalinkURL maps a <url> tag in a metalink
+type xmlMetalinkURL struct {
+	// version 3, higher is preferred
+	Preference int `xml:"preference,attr"`
+	// version 4, lower is preferred
+	Priority int    `xml:"priority,attr"`
+	Value    string `xml:",chardata"`
+}
+
+// metalinkHashes lists supported hash types from the strongest
+var metalinkHashes = []string{"sha512", "sha256", "sha1"}
+
+// loadMirrors sets the mirrors packages are downloaded from and, if a metalink
+// is used, the checksum repomd.xml must have
+func (r *Syncer) loadMirrors() (err error) {
+	r.mirrors = nil
+	r.nextMirror = 0
+	r.repomdChecksum = XMLChecksum{}
+
+	switch {
+	case r.Metalink != "":
+		var mirrors []url.URL
+		mirrors, r.repomdChecksum, err = readMetalink(r.client, r.Metalink)
+		if err != nil {
+			return
+		}
+		r.mirrors = mirrors
+	case r.Mirrorlist != "":
+		var mirrors []url.URL
+		mirrors, err = readMirrorlist(r.client, r.Mirrorlist)
+		if err != nil {
+			// mirrors are an optimization, the repo URL still works
+			r.logger().Warn("Cannot read mirrorlist, using the repo URL only", "mirrorlist", r.Mirrorlist, "error", err)
+			return nil
+		}
+		r.mirrors = mirrors
+	default:
+		return
+	}
+
+	// the repo URL is the last resort
+	for _, mirror := range r.mirrors {
+		if mirror.Host == r.URL.Host && strings.TrimSuffix(mirror.Path, "/") == strings.TrimSuffix(r.URL.Path, "/") {
+			return
+		}
+	}
+	r.mirrors = append(r.mirrors, r.URL)
+	return
+}
+
+// readMirrorlist returns base URLs from a mirrorlist, one URL per line
+func readMirrorlist(client *http.Client, mirrorlistURL string) (mirrors []url.URL, err error) {
+	body, err := readURL(client, mirrorlistURL)
+	if err != nil {
+		return
+	}
+	defer body.Close()
+
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		mirror, err := url.Parse(line)
+		if err != nil || (mirror.Scheme != "http" && mirror.Scheme != "https") {
+			slog.Warn("Ignoring invalid mirror", "mirror", line)
+			continue
+		}
+		mirrors = append(mirrors, *mirror)
+	}
+	if err = scanner.Err(); err != nil {
+		return
+	}
+	if len(mirrors) == 0 {
+		err = errors.New("no mirrors found")
+	}
+	return
+}
+
+// readMetalink returns base URLs of mirrors from a metalink for repomd.xml,
+// most preferred first, and the checksum repomd.xml must have
+func readMetalink(client *http.Client, metalinkURL string) (mirrors []url.URL, checksum XMLChecksum, err error) {
+	body, err := readURL(client, metalinkURL)
+	if err != nil {
+		return
+	}
+	defer body.Close()
+	return decodeMetalink(body)
+}
+
+func decodeMetalink(reader io.Reader) (mirrors []url.URL, checksum XMLChecksum, err error) {
+	var metalink xmlMetalink
+	if err = xml.NewDecoder(reader).Decode(&metalink); err != nil {
+		return
+	}
+
+	var file *xmlMetalinkFile
+	for _, f := range append(metalink.Files, metalink.Files4...) {
+		if f.Name == "repomd.xml" {
+			file = &f
+			break
+		}
+	}
+	if file == nil {
+		err = errors.New("metalink does not describe repomd.xml")
+		return
+	}
+
+	hashes := map[string]string{}
+	for _, h := range append(file.Hashes, file.Hashes4...) {
+		// version 4 uses eg. sha-256
+		hashes[strings.ReplaceAll(strings.ToLower(h.Type), "-", "")] = strings.TrimSpace(h.Value)
+	}
+	for _, hashType := range metalinkHashes {
+		if value, found := hashes[hashType]; found {
+			checksum = XMLChecksum{Type: hashType, Checksum: value}
+			break
+		}
+	}
+	if checksum.Checksum == "" {
+		err = errors.New("metalink has no supported hash for repomd.xml")
+		return
+	}
+
+	urls := append(file.URLs, file.URLs4...)
+	sort.SliceStable(urls, func(i, j int) bool {
+		if urls[i].Preference != urls[j].Preference {
+			return urls[i].Preference > urls[j].Preference
+		}
+		return urls[i].Priority < urls[j].Priority
+	})
+	for _, u := range urls {
+		mirror, err := url.Parse(strings.TrimSpace(u.Value))
+		if err != nil || (mirror.Scheme != "http" && mirror.Scheme != "https") || !strings.HasSuffix(mirror.Path, repomdPath) {
+			continue
+		}
+		mirror.Path = strings.TrimSuffix(mirror.Path, repomdPath)
+		mirrors = append(mirrors, *mirror)
+	}
+	return
+}
+
+// downloadStoreApplyFromMirrors downloads a file with a known checksum from
+// the next mirror, failing over to the others in case of errors or checksum
+// mismatches, while applying a ReaderConsumer. If all mirrors fail, they are
+// retried according to the retry policy
+func (r *Syncer) downloadStoreApplyFromMirrors(relativePath string, checksum string, description string, hash crypto.Hash, size int64, f util.ReaderConsumer) (err error) {
+	r.mirrorMutex.Lock()
+	start := r.nextMirror
+	r.nextMirror = (r.nextMirror + 1) % len(r.mirrors)
+	r.mirrorMutex.Unlock()
+
+	return r.withRetries(description, func() (err error) {
+		for i := range r.mirrors {
+			mirror := r.mirrors[(start+i)%len(r.mirrors)]
+			err = r.downloadStoreApplyOnce(mirror, relativePath, checksum, description, hash, size, f)
+			if err == nil {
+				return
+			}
+			if _, consumerErr := err.(*consumerError); consumerErr {
+				return
+			}
+			r.logger().Warn("Download from mirror failed", "file", relativePath, "mirror", mirror.Host, "error", err)
+		}
+		r.logger().Warn("All mirrors failed", "file", relativePath)
+		return
+	})
+}
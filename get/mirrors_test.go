@@ -0,0 +1,121 @@
+package get
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/uyuni-project/minima/util"
+)
+
+func TestDecodeMetalink(t *testing.T) {
+	metalink3 := `<?xml version="1.0" encoding="utf-8"?>
+<metalink version="3.0" xmlns="http://www.metalinker.org/">
+ <files>
+  <file name="repomd.xml">
+   <verification>
+    <hash type="md5">d41d8cd98f00b204e9800998ecf8427e</hash>
+    <hash type="sha256">abc</hash>
+   </verification>
+   <resources>
+    <url protocol="https" type="https" preference="90">https://b.example.com/repo/repodata/repomd.xml</url>
+    <url protocol="rsync" type="rsync" preference="100">rsync://c.example.com/repo/repodata/repomd.xml</url>
+    <url protocol="https" type="https" preference="100">https://a.example.com/repo/repodata/repomd.xml</url>
+   </resources>
+  </file>
+ </files>
+</metalink>`
+	mirrors, checksum, err := decodeMetalink(strings.NewReader(metalink3))
+	assert.NoError(t, err)
+	assert.Equal(t, XMLChecksum{Type: "sha256", Checksum: "abc"}, checksum)
+	if assert.Len(t, mirrors, 2) {
+		assert.Equal(t, "https://a.example.com/repo/", mirrors[0].String())
+		assert.Equal(t, "https://b.example.com/repo/", mirrors[1].String())
+	}
+
+	metalink4 := `<?xml version="1.0" encoding="UTF-8"?>
+<metalink xmlns="urn:ietf:params:xml:ns:metalink">
+  <file name="repomd.xml">
+    <hash type="sha-256">abc</hash>
+    <hash type="sha-512">def</hash>
+    <url location="de" priority="2">http://b.example.com/repo/repodata/repomd.xml</url>
+    <url location="de" priority="1">http://a.example.com/repo/repodata/repomd.xml</url>
+  </file>
+</metalink>`
+	mirrors, checksum, err = decodeMetalink(strings.NewReader(metalink4))
+	assert.NoError(t, err)
+	assert.Equal(t, XMLChecksum{Type: "sha512", Checksum: "def"}, checksum)
+	if assert.Len(t, mirrors, 2) {
+		assert.Equal(t, "http://a.example.com/repo/", mirrors[0].String())
+	}
+
+	_, _, err = decodeMetalink(strings.NewReader(`<metalink><file name="other.xml"/></metalink>`))
+	assert.Error(t, err)
+}
+
+func TestStoreRepoMetalink(t *testing.T) {
+	repomd, err := os.ReadFile(filepath.Join("testdata", "repo", "repodata", "repomd.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(repomd)
+	repomdChecksum := hex.EncodeToString(sum[:])
+
+	var brokenRequests, workingRequests atomic.Int32
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		brokenRequests.Add(1)
+		w.WriteHeader(500)
+	}))
+	defer broken.Close()
+	fileServer := http.FileServer(http.Dir("testdata"))
+	working := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		workingRequests.Add(1)
+		fileServer.ServeHTTP(w, r)
+	}))
+	defer working.Close()
+
+	var metalinkChecksum atomic.Value
+	metalinkChecksum.Store(repomdChecksum)
+	metalink := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `<metalink xmlns="urn:ietf:params:xml:ns:metalink"><file name="repomd.xml">
+<hash type="sha-256">%s</hash>
+<url priority="1">%s/repo/repodata/repomd.xml</url>
+<url priority="2">%s/repo/repodata/repomd.xml</url>
+</file></metalink>`, metalinkChecksum.Load(), broken.URL, working.URL)
+	}))
+	defer metalink.Close()
+
+	repoURL, err := url.Parse(working.URL + "/repo/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage := NewFileStorage(filepath.Join(t.TempDir(), "repo"))
+	syncer := NewSyncer(*repoURL, storage, WithArchs("x86_64"), WithQuiet(true), WithMetalink(metalink.URL))
+
+	err = syncer.StoreRepo()
+	assert.NoError(t, err)
+	assert.Greater(t, brokenRequests.Load(), int32(0))
+	assert.Greater(t, workingRequests.Load(), int32(0))
+
+	// the broken mirror was failed over
+	reader, err := storage.NewReader(filepath.Join("x86_64", "milkyway-dummy-2.0-1.1.x86_64.rpm"), Permanent)
+	if assert.NoError(t, err) {
+		reader.Close()
+	}
+
+	// repomd.xml not matching the metalink
+	metalinkChecksum.Store(strings.Repeat("0", 64))
+	assert.NoError(t, syncer.loadMirrors())
+	err = syncer.downloadStoreApplyFrom(syncer.URL, repomdPath, syncer.repomdChecksum.Checksum, "repomd.xml", hashMap[syncer.repomdChecksum.Type], 0, util.Nop)
+	_, checksumError := err.(*util.ChecksumError)
+	assert.True(t, checksumError)
+}
@@ -0,0 +1,261 @@
+package get
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/uyuni-project/minima/util"
+)
+
+// SyncerOption configures a Syncer, see NewSyncer
+type SyncerOption func(*Syncer)
+
+// WithHTTPClient sets the client used to download from the repo, its mirrors,
+// mirrorlist and metalink. The default is http.DefaultClient
+func WithHTTPClient(client *http.Client) SyncerOption {
+	return func(r *Syncer) {
+		r.client = client
+	}
+}
+
+// WithLogger sets the logger for messages about the repo. The default is
+// slog.Default()
+func WithLogger(logger *slog.Logger) SyncerOption {
+	return func(r *Syncer) {
+		r.log = logger
+	}
+}
+
+// WithArchs only syncs packages of the given architectures, plus noarch
+// packages. By default all packages are synced
+func WithArchs(archs ...string) SyncerOption {
+	return func(r *Syncer) {
+		r.archs = map[string]bool{}
+		for _, arch := range archs {
+			r.archs[arch] = true
+		}
+	}
+}
+
+// WithSkipLegacy skips i586 and i686 packages, which are otherwise synced
+// along x86_64 ones
+func WithSkipLegacy(skipLegacy bool) SyncerOption {
+	return func(r *Syncer) {
+		r.skipLegacy = skipLegacy
+	}
+}
+
+// WithFilter only syncs packages for which filter returns true, in addition to
+// architecture filtering
+func WithFilter(filter func(XMLPackage) bool) SyncerOption {
+	return func(r *Syncer) {
+		r.filter = filter
+	}
+}
+
+// WithConcurrency downloads up to n packages at once. The default is 1
+func WithConcurrency(n int) SyncerOption {
+	return func(r *Syncer) {
+		r.concurrency = n
+	}
+}
+
+// WithEventHandler calls handler on sync events. With concurrency, handler
+// can be called from several goroutines at once
+func WithEventHandler(handler func(Event)) SyncerOption {
+	return func(r *Syncer) {
+		r.onEvent = handler
+	}
+}
+
+// WithRepoType sets the registered name of the repo type, by default
+// RepoTypeAuto detects it
+func WithRepoType(name string) SyncerOption {
+	return func(r *Syncer) {
+		r.repoType = name
+	}
+}
+
+// WithRepoName sets the repo name, used in metadata paths of some repo types
+// such as pacman. By default it is taken from the URL path
+func WithRepoName(name string) SyncerOption {
+	return func(r *Syncer) {
+		r.name = name
+	}
+}
+
+// WithRegenerateMetadata rewrites repo metadata so that it only refers to
+// synced packages, eg. when filtering by arch. Regenerated metadata is only
+// signed with WithSigningKey. Only rpm repos are supported, others are
+// mirrored as they are
+func WithRegenerateMetadata(regenerate bool) SyncerOption {
+	return func(r *Syncer) {
+		r.regenerate = regenerate
+	}
+}
+
+// WithDeltaRPMs also syncs delta rpms listed in deltainfo or prestodelta
+// metadata of rpm repos, if they update synced packages
+func WithDeltaRPMs(deltaRPMs bool) SyncerOption {
+	return func(r *Syncer) {
+		r.deltaRPMs = deltaRPMs
+	}
+}
+
+// WithSources sets whether source packages (src and nosrc rpms, Debian source
+// packages listed in Sources) are synced, by default they are synced like
+// others, by arch
+func WithSources(policy PackagePolicy) SyncerOption {
+	return func(r *Syncer) {
+		r.sources = policy
+	}
+}
+
+// WithDebuginfo sets whether debugging information packages (-debuginfo and
+// -debugsource rpms, -dbgsym Debian packages) are synced, by default they are
+// synced like others, by arch
+func WithDebuginfo(policy PackagePolicy) SyncerOption {
+	return func(r *Syncer) {
+		r.debuginfo = policy
+	}
+}
+
+// WithVerifyAllChecksums verifies files against all the checksums listed in
+// metadata, eg. the MD5Sum, SHA1 and SHA512 ones of Debian repos, not only
+// against the one they are primarily verified against
+func WithVerifyAllChecksums(verify bool) SyncerOption {
+	return func(r *Syncer) {
+		r.allChecksums = verify
+	}
+}
+
+// WithIncludeIndexes only syncs indexes listed in repo metadata whose path,
+// or a parent directory of it, matches one of the patterns (in path.Match
+// syntax), eg. main/i18n/Translation-en*. Patterns without a slash match names
+// at any depth, eg. Contents-*. Only supported for deb repos, whose Release
+// file is rewritten to only list synced indexes and signed with the key set
+// by WithSigningKey, which is then required. Only files listed in Release
+// are indexes: installer images, only listed in installer SHA256SUMS files,
+// are not synced
+func WithIncludeIndexes(patterns ...string) SyncerOption {
+	return func(r *Syncer) {
+		r.includeIndexes = patterns
+	}
+}
+
+// WithExcludeIndexes does not sync indexes matching any of the patterns, like
+// WithIncludeIndexes, eg. dep11
+func WithExcludeIndexes(patterns ...string) SyncerOption {
+	return func(r *Syncer) {
+		r.excludeIndexes = patterns
+	}
+}
+
+// WithSigningKey signs metadata rewritten by minima with an armored OpenPGP
+// private key, not protected by a passphrase. The public key is stored next
+// to the signature, where the repo type expects it
+func WithSigningKey(key []byte) SyncerOption {
+	return func(r *Syncer) {
+		r.signingKey = key
+	}
+}
+
+// WithKeys sets public keys trusted to sign metadata, for repo types whose
+// keys are not published in the repo: PEM RSA keys for apk, OpenPGP keys for
+// pacman. Syncing such repos fails without keys
+func WithKeys(keys ...[]byte) SyncerOption {
+	return func(r *Syncer) {
+		r.keys = keys
+	}
+}
+
+// WithQuiet omits the log message for each downloaded file
+func WithQuiet(quiet bool) SyncerOption {
+	return func(r *Syncer) {
+		r.quiet = quiet
+	}
+}
+
+// WithMirrorlist downloads files other than repomd.xml from the mirrors in a
+// mirrorlist, see Syncer.Mirrorlist
+func WithMirrorlist(mirrorlistURL string) SyncerOption {
+	return func(r *Syncer) {
+		r.Mirrorlist = mirrorlistURL
+	}
+}
+
+// WithMetalink downloads files other than repomd.xml from the mirrors in a
+// metalink, see Syncer.Metalink
+func WithMetalink(metalinkURL string) SyncerOption {
+	return func(r *Syncer) {
+		r.Metalink = metalinkURL
+	}
+}
+
+// WithRetry sets the policy to retry failed downloads
+func WithRetry(retry RetryConfig) SyncerOption {
+	return func(r *Syncer) {
+		r.Retry = retry
+	}
+}
+
+// WithLimiters throttles downloads through all given limiters
+func WithLimiters(limiters ...*util.RateLimiter) SyncerOption {
+	return func(r *Syncer) {
+		r.Limiters = limiters
+	}
+}
+
+// WithProgress reports the progress of package downloads to a ProgressTracker
+func WithProgress(progress *ProgressTracker) SyncerOption {
+	return func(r *Syncer) {
+		r.Progress = progress
+	}
+}
+
+// EventType is the kind of an Event
+type EventType int
+
+const (
+	// EventRepoStarted is sent when a repo sync starts, or restarts
+	EventRepoStarted EventType = iota
+	// EventFileDownloaded is sent when a file was downloaded and stored, Size is set
+	EventFileDownloaded
+	// EventFileRecycled is sent when a file was kept from the previous sync
+	EventFileRecycled
+	// EventDownloadRetried is sent when a download failed and is retried,
+	// Attempt, Delay and Err are set
+	EventDownloadRetried
+	// EventRepoRestarted is sent when metadata changed while syncing and the
+	// sync restarts, Attempt, Delay and Err are set
+	EventRepoRestarted
+	// EventRepoCommitted is sent when a repo sync was committed to storage
+	EventRepoCommitted
+)
+
+// Event describes progress of a Syncer
+type Event struct {
+	Type EventType
+	// Repo is the URL of the repo
+	Repo string
+	// File is the file the event refers to, if any
+	File string
+	// Size is the number of bytes downloaded
+	Size int64
+	// Attempt is the number of the failed attempt
+	Attempt int
+	// Delay is the time waited before trying again
+	Delay time.Duration
+	// Err is the error that caused a retry
+	Err error
+}
+
+// emit sends an event to the event handler, if any
+func (r *Syncer) emit(event Event) {
+	if r.onEvent == nil {
+		return
+	}
+	event.Repo = r.URL.String()
+	r.onEvent(event)
+}
@@ -0,0 +1,69 @@
+package get
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PackagePolicy tells whether a kind of packages, eg. source packages, is
+// synced
+type PackagePolicy string
+
+const (
+	// PolicyDefault syncs packages of the kind like others, by arch
+	PolicyDefault PackagePolicy = ""
+	// PolicyInclude syncs packages of the kind. Source packages are synced
+	// whatever the configured archs
+	PolicyInclude PackagePolicy = "include"
+	// PolicyExclude does not sync packages of the kind
+	PolicyExclude PackagePolicy = "exclude"
+	// PolicyOnly only syncs packages of the kind
+	PolicyOnly PackagePolicy = "only"
+)
+
+// ValidPackagePolicy returns an error if policy is not a known policy
+func ValidPackagePolicy(policy PackagePolicy) error {
+	switch policy {
+	case PolicyDefault, PolicyInclude, PolicyExclude, PolicyOnly:
+		return nil
+	}
+	return fmt.Errorf("unknown package policy %s, expected one of %s, %s, %s", policy, PolicyInclude, PolicyExclude, PolicyOnly)
+}
+
+// allows returns whether the policy allows syncing a package, which is of the
+// kind or not
+func (p PackagePolicy) allows(ofKind bool) bool {
+	switch p {
+	case PolicyExclude:
+		return !ofKind
+	case PolicyOnly:
+		return ofKind
+	}
+	return true
+}
+
+// forced returns whether the policy syncs packages of the kind whatever their
+// arch
+func (p PackagePolicy) forced() bool {
+	return p == PolicyInclude || p == PolicyOnly
+}
+
+// isSourcePackage returns whether a package is a source package: src and
+// nosrc rpms, files of Debian source packages
+func isSourcePackage(pack XMLPackage) bool {
+	return pack.Arch == "src" || pack.Arch == "nosrc" || pack.Arch == "source"
+}
+
+// isDebugPackage returns whether a package only has debugging information,
+// by naming conventions: -debuginfo and -debugsource rpms (possibly with a
+// suffix such as -32bit), -dbgsym Debian packages. Packages such as
+// elfutils-debuginfod merely start with those suffixes
+func isDebugPackage(pack XMLPackage) bool {
+	return hasNameSuffix(pack.Name, "-debuginfo") || hasNameSuffix(pack.Name, "-debugsource") || strings.HasSuffix(pack.Name, "-dbgsym")
+}
+
+// hasNameSuffix returns whether a package name ends with a suffix, possibly
+// followed by further dash-separated suffixes
+func hasNameSuffix(name string, suffix string) bool {
+	return strings.HasSuffix(name, suffix) || strings.Contains(name, suffix+"-")
+}
@@ -0,0 +1,62 @@
+package get
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPackagePolicies(t *testing.T) {
+	primary := XMLMetaData{Packages: []XMLPackage{
+		{Name: "a", Arch: "x86_64", Location: XMLLocation{Href: "a.x86_64.rpm"}},
+		{Name: "a", Arch: "aarch64", Location: XMLLocation{Href: "a.aarch64.rpm"}},
+		{Name: "a", Arch: "src", Location: XMLLocation{Href: "a.src.rpm"}},
+		{Name: "a-debuginfo", Arch: "x86_64", Location: XMLLocation{Href: "a-debuginfo.x86_64.rpm"}},
+		{Name: "a-debuginfo-32bit", Arch: "x86_64", Location: XMLLocation{Href: "a-debuginfo-32bit.x86_64.rpm"}},
+		{Name: "a-debugsource", Arch: "aarch64", Location: XMLLocation{Href: "a-debugsource.aarch64.rpm"}},
+		{Name: "b", Arch: "nosrc", Location: XMLLocation{Href: "b.nosrc.rpm"}},
+		{Name: "b-dbgsym", Arch: "amd64", Location: XMLLocation{Href: "b-dbgsym.amd64.deb"}},
+	}}
+	repoType, _ := LookupRepoType("rpm")
+	repoURL, _ := url.Parse("http://example.com/repo")
+
+	tests := []struct {
+		archs     []string
+		sources   PackagePolicy
+		debuginfo PackagePolicy
+		expected  []string
+	}{
+		{nil, PolicyDefault, PolicyDefault, []string{"a.x86_64.rpm", "a.aarch64.rpm", "a.src.rpm", "a-debuginfo.x86_64.rpm", "a-debuginfo-32bit.x86_64.rpm", "a-debugsource.aarch64.rpm", "b.nosrc.rpm", "b-dbgsym.amd64.deb"}},
+		{[]string{"x86_64"}, PolicyDefault, PolicyDefault, []string{"a.x86_64.rpm", "a-debuginfo.x86_64.rpm", "a-debuginfo-32bit.x86_64.rpm"}},
+		{[]string{"x86_64"}, PolicyInclude, PolicyExclude, []string{"a.x86_64.rpm", "a.src.rpm", "b.nosrc.rpm"}},
+		{[]string{"x86_64"}, PolicyOnly, PolicyDefault, []string{"a.src.rpm", "b.nosrc.rpm"}},
+		{[]string{"x86_64"}, PolicyExclude, PolicyOnly, []string{"a-debuginfo.x86_64.rpm", "a-debuginfo-32bit.x86_64.rpm"}},
+		{nil, PolicyExclude, PolicyOnly, []string{"a-debuginfo.x86_64.rpm", "a-debuginfo-32bit.x86_64.rpm", "a-debugsource.aarch64.rpm", "b-dbgsym.amd64.deb"}},
+		{nil, PolicyExclude, PolicyExclude, []string{"a.x86_64.rpm", "a.aarch64.rpm"}},
+	}
+	for _, test := range tests {
+		syncer := NewSyncer(*repoURL, nil, WithArchs(test.archs...), WithSources(test.sources), WithDebuginfo(test.debuginfo))
+		locations := []string{}
+		for _, pack := range syncer.syncedPackages(primary, repoType) {
+			locations = append(locations, pack.Location.Href)
+		}
+		assert.Equal(t, test.expected, locations, "archs %v, sources %s, debuginfo %s", test.archs, test.sources, test.debuginfo)
+	}
+
+	for name, expected := range map[string]bool{
+		"a-debuginfo":                          true,
+		"a-debuginfo-32bit":                    true,
+		"a-debugsource":                        true,
+		"b-dbgsym":                             true,
+		"elfutils-debuginfod":                  false,
+		"elfutils-debuginfod-client":           false,
+		"elfutils-debuginfod-client-debuginfo": true,
+	} {
+		assert.Equal(t, expected, isDebugPackage(XMLPackage{Name: name}), name)
+	}
+
+	assert.NoError(t, ValidPackagePolicy(PolicyDefault))
+	assert.NoError(t, ValidPackagePolicy(PolicyOnly))
+	assert.Error(t, ValidPackagePolicy("sometimes"))
+}
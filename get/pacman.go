@@ -0,0 +1,269 @@
+package get
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// Functions to handle Arch Linux pacman repositories. A repo is a directory
+// with packages, their detached signatures and <name>.db, a compressed tar
+// with one desc file per package
+
+// signatureChecksumType marks detached package signatures not included in
+// the database: their checksum is the one of the signed package, and they are
+// checked against the configured keys once the package is stored
+const signatureChecksumType = "signature"
+
+// pacmanRepoPath matches paths of Arch Linux repos, eg. /core/os/x86_64/
+var pacmanRepoPath = regexp.MustCompile(`/([^/]+)/os/[^/]+/?$`)
+
+// repoName returns the configured repo name or, by default, the repo name in
+// Arch Linux style paths or else the last element of the URL path
+func (r *Syncer) repoName() string {
+	if r.name != "" {
+		return r.name
+	}
+	if matches := pacmanRepoPath.FindStringSubmatch(r.URL.Path); matches != nil {
+		return matches[1]
+	}
+	return path.Base(path.Clean("/" + r.URL.Path))
+}
+
+// decodePacmanDB returns packages and their signatures listed in a pacman
+// database, compressed or not
+func decodePacmanDB(reader io.Reader, _ string) (metadata XMLMetaData, err error) {
+	tarReader, err := uncompressPacmanDB(reader)
+	if err != nil {
+		return
+	}
+
+	packages := make([]XMLPackage, 0)
+	archive := tar.NewReader(tarReader)
+	for {
+		var header *tar.Header
+		header, err = archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return
+		}
+		if path.Base(header.Name) != "desc" {
+			continue
+		}
+
+		var desc map[string][]string
+		desc, err = parsePacmanDesc(archive)
+		if err != nil {
+			return
+		}
+		var entries []XMLPackage
+		entries, err = pacmanPackages(header.Name, desc)
+		if err != nil {
+			return
+		}
+		packages = append(packages, entries...)
+	}
+	metadata = XMLMetaData{Packages: packages}
+	err = nil
+	return
+}
+
+// uncompressPacmanDB uncompresses a pacman database by its magic bytes, as
+// its name does not tell the compression
+func uncompressPacmanDB(reader io.Reader) (io.Reader, error) {
+	buffered := bufio.NewReader(reader)
+	magic, err := buffered.Peek(4)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return gzip.NewReader(buffered)
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		decoder, err := zstd.NewReader(buffered)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	case bytes.HasPrefix(magic, []byte("BZh")):
+		return bzip2.NewReader(buffered), nil
+	case bytes.HasPrefix(magic, []byte{0xfd, '7', 'z', 'X'}):
+		return xz.NewReader(buffered)
+	}
+	return buffered, nil
+}
+
+// parsePacmanDesc parses a desc file, made of %FIELD% lines followed by one
+// value per line up to an empty line
+func parsePacmanDesc(reader io.Reader) (desc map[string][]string, err error) {
+	desc = map[string][]string{}
+	field := ""
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			field = ""
+		case field == "" && strings.HasPrefix(line, "%") && strings.HasSuffix(line, "%"):
+			field = strings.Trim(line, "%")
+			desc[field] = []string{}
+		case field != "":
+			desc[field] = append(desc[field], line)
+		default:
+			return nil, fmt.Errorf("badly formatted desc line: '%s'", line)
+		}
+	}
+	err = scanner.Err()
+	return
+}
+
+// pacmanPackages returns the package described by a desc file and its
+// detached signature
+func pacmanPackages(name string, desc map[string][]string) (packages []XMLPackage, err error) {
+	value := func(field string) string {
+		if len(desc[field]) == 0 {
+			return ""
+		}
+		return desc[field][0]
+	}
+
+	filename := value("FILENAME")
+	checksum := value("SHA256SUM")
+	if filename == "" || strings.Contains(filename, "/") || checksum == "" {
+		return nil, fmt.Errorf("badly formatted pacman database entry %s", name)
+	}
+	size, _ := strconv.ParseInt(value("CSIZE"), 10, 64)
+	arch := value("ARCH")
+	packages = append(packages, XMLPackage{
+		Name:     value("NAME"),
+		Arch:     arch,
+		Location: XMLLocation{Href: filename},
+		Checksum: XMLChecksum{Type: "sha256", Checksum: checksum},
+		Size:     XMLSize{Package: size},
+	})
+
+	// the signature is known, so it can be checked like any other file
+	if encoded := strings.Join(desc["PGPSIG"], ""); encoded != "" {
+		signature, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("badly formatted signature in pacman database entry %s: %v", name, err)
+		}
+		sum := sha256.Sum256(signature)
+		packages = append(packages, XMLPackage{
+			Name:     value("NAME"),
+			Arch:     arch,
+			Location: XMLLocation{Href: filename + ".sig"},
+			Checksum: XMLChecksum{Type: "sha256", Checksum: hex.EncodeToString(sum[:])},
+			Size:     XMLSize{Package: int64(len(signature))},
+		})
+	} else {
+		// recent databases leave signatures out, they are checked once downloaded
+		packages = append(packages, XMLPackage{
+			Name:     value("NAME"),
+			Arch:     arch,
+			Location: XMLLocation{Href: filename + ".sig"},
+			Checksum: XMLChecksum{Type: signatureChecksumType, Checksum: checksum},
+		})
+	}
+	return
+}
+
+// verifyPackageSignatures checks downloaded package signatures that are not
+// included in the database against the configured keys, once the packages
+// they sign are stored
+func (r *Syncer) verifyPackageSignatures(packages []XMLPackage) error {
+	var keyring openpgp.EntityList
+	for _, pack := range packages {
+		if pack.Checksum.Type != signatureChecksumType {
+			continue
+		}
+		if keyring == nil {
+			var err error
+			keyring, err = readKeyRing(r.keys)
+			if err != nil {
+				return err
+			}
+		}
+
+		signature, err := r.readStored(pack.Location.Href)
+		if err != nil {
+			return err
+		}
+		packagePath := strings.TrimSuffix(pack.Location.Href, ".sig")
+		signed, err := r.storage.NewReader(packagePath, Temporary)
+		if err == ErrFileNotFound {
+			return &SignatureError{Reason: pack.Location.Href + " signs " + packagePath + ", which is not synced"}
+		}
+		if err != nil {
+			return err
+		}
+		err = checkDetachedSignatureOf(keyring, signed, signature)
+		signed.Close()
+		if err != nil {
+			return &SignatureError{Reason: pack.Location.Href + " signature check failed, signature is not valid"}
+		}
+	}
+	return nil
+}
+
+// readStored returns the content of a file stored in the temporary location
+func (r *Syncer) readStored(location string) ([]byte, error) {
+	reader, err := r.storage.NewReader(location, Temporary)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+// readKeyRing reads OpenPGP public keys, armored or not
+func readKeyRing(keys [][]byte) (keyring openpgp.EntityList, err error) {
+	for _, key := range keys {
+		var entities openpgp.EntityList
+		if bytes.Contains(key, []byte("-----BEGIN PGP")) {
+			entities, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(key))
+		} else {
+			entities, err = openpgp.ReadKeyRing(bytes.NewReader(key))
+		}
+		if err != nil {
+			return nil, err
+		}
+		keyring = append(keyring, entities...)
+	}
+	return
+}
+
+// checkDetachedSignature checks an OpenPGP signature, armored or not
+func checkDetachedSignature(keyring openpgp.KeyRing, signed []byte, signature []byte) error {
+	return checkDetachedSignatureOf(keyring, bytes.NewReader(signed), signature)
+}
+
+// checkDetachedSignatureOf checks an OpenPGP signature, armored or not, of
+// content read from a reader
+func checkDetachedSignatureOf(keyring openpgp.KeyRing, signed io.Reader, signature []byte) (err error) {
+	if bytes.HasPrefix(bytes.TrimSpace(signature), []byte("-----BEGIN PGP")) {
+		_, err = openpgp.CheckArmoredDetachedSignature(keyring, signed, bytes.NewReader(signature), nil)
+	} else {
+		_, err = openpgp.CheckDetachedSignature(keyring, signed, bytes.NewReader(signature), nil)
+	}
+	return
+}
@@ -0,0 +1,239 @@
+package get
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ulikunitz/xz"
+)
+
+func TestDecodePacmanDB(t *testing.T) {
+	db, err := os.Open(filepath.Join("testdata", "pacman_repo", "core", "os", "x86_64", "core.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	metadata, err := decodePacmanDB(db, "db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	locations := []string{}
+	for _, pack := range metadata.Packages {
+		locations = append(locations, pack.Arch+" "+pack.Location.Href+" "+pack.Checksum.Type)
+		assert.Len(t, pack.Checksum.Checksum, 64)
+	}
+	// the signature of hello-doc is not included in the database
+	assert.Equal(t, []string{
+		"x86_64 hello-1.0-1-x86_64.pkg.tar.zst sha256",
+		"x86_64 hello-1.0-1-x86_64.pkg.tar.zst.sig sha256",
+		"any hello-doc-1.0-1-any.pkg.tar.zst sha256",
+		"any hello-doc-1.0-1-any.pkg.tar.zst.sig signature",
+		"aarch64 hello-arm-1.0-1-aarch64.pkg.tar.zst sha256",
+		"aarch64 hello-arm-1.0-1-aarch64.pkg.tar.zst.sig sha256",
+	}, locations)
+
+	// uncompressed databases
+	desc := "%FILENAME%\na-1-1-any.pkg.tar.zst\n\n%SHA256SUM%\nabc\n\n%CSIZE%\n12\n\n%ARCH%\nany\n"
+	metadata, err = decodePacmanDB(strings.NewReader(tarOf(t, "a-1-1/desc", desc)), "db")
+	assert.NoError(t, err)
+	expected := []XMLPackage{{
+		Arch:     "any",
+		Location: XMLLocation{Href: "a-1-1-any.pkg.tar.zst"},
+		Checksum: XMLChecksum{Type: "sha256", Checksum: "abc"},
+		Size:     XMLSize{Package: 12},
+	}, {
+		Arch:     "any",
+		Location: XMLLocation{Href: "a-1-1-any.pkg.tar.zst.sig"},
+		Checksum: XMLChecksum{Type: signatureChecksumType, Checksum: "abc"},
+	}}
+	assert.Equal(t, expected, metadata.Packages)
+
+	// xz compressed databases
+	var compressed bytes.Buffer
+	writer, err := xz.NewWriter(&compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.Write([]byte(tarOf(t, "a-1-1/desc", desc)))
+	writer.Close()
+	metadata, err = decodePacmanDB(&compressed, "db")
+	assert.NoError(t, err)
+	assert.Equal(t, expected, metadata.Packages)
+
+	_, err = decodePacmanDB(strings.NewReader(tarOf(t, "a-1-1/desc", "%FILENAME%\na-1-1-any.pkg.tar.zst\n")), "db")
+	assert.Error(t, err)
+	_, err = decodePacmanDB(strings.NewReader(tarOf(t, "a-1-1/desc", "%FILENAME%\n../a.pkg.tar.zst\n\n%SHA256SUM%\nabc\n")), "db")
+	assert.Error(t, err)
+}
+
+func TestRepoName(t *testing.T) {
+	for repoURL, expected := range map[string]string{
+		"https://geo.mirror.pkgbuild.com/core/os/x86_64/": "core",
+		"https://geo.mirror.pkgbuild.com/extra/os/x86_64": "extra",
+		"https://example.com/custom/repo/":                "repo",
+	} {
+		parsed, err := url.Parse(repoURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, expected, NewSyncer(*parsed, nil).repoName(), repoURL)
+	}
+
+	parsed, _ := url.Parse("https://example.com/custom/repo/")
+	assert.Equal(t, "mine", NewSyncer(*parsed, nil, WithRepoName("mine")).repoName())
+}
+
+func TestStorePacmanRepo(t *testing.T) {
+	server := httptest.NewServer(http.FileServer(http.Dir("testdata")))
+	defer server.Close()
+
+	key, err := os.ReadFile(filepath.Join("testdata", "pacman_repo.asc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	repoURL, err := url.Parse(server.URL + "/pacman_repo/core/os/x86_64/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	directory := t.TempDir()
+	syncer := NewSyncer(*repoURL, NewFileStorage(directory),
+		WithHTTPClient(server.Client()),
+		WithArchs("x86_64"),
+		WithKeys(key),
+	)
+	repoType, err := syncer.detectRepoType()
+	assert.NoError(t, err)
+	assert.Equal(t, "pacman", repoType.Name)
+
+	// first sync
+	assert.NoError(t, syncer.StoreRepo())
+
+	expectedFiles := []string{
+		"core.db",
+		"core.db.sig",
+		"hello-1.0-1-x86_64.pkg.tar.zst",
+		"hello-1.0-1-x86_64.pkg.tar.zst.sig",
+		"hello-doc-1.0-1-any.pkg.tar.zst",
+		"hello-doc-1.0-1-any.pkg.tar.zst.sig",
+	}
+	for _, file := range expectedFiles {
+		original, err := os.ReadFile(filepath.Join("testdata", "pacman_repo", "core", "os", "x86_64", file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		synced, err := os.ReadFile(filepath.Join(directory, file))
+		if assert.NoError(t, err) {
+			assert.Equal(t, original, synced, file)
+		}
+	}
+	_, err = os.Stat(filepath.Join(directory, "hello-arm-1.0-1-aarch64.pkg.tar.zst"))
+	assert.True(t, os.IsNotExist(err))
+
+	// second sync, signatures not included in the database are recycled
+	recycled := []string{}
+	syncer = NewSyncer(*repoURL, NewFileStorage(directory),
+		WithHTTPClient(server.Client()),
+		WithArchs("x86_64"),
+		WithKeys(key),
+		WithEventHandler(func(event Event) {
+			if event.Type == EventFileRecycled {
+				recycled = append(recycled, event.File)
+			}
+		}),
+	)
+	assert.NoError(t, syncer.StoreRepo())
+	assert.Contains(t, recycled, "hello-doc-1.0-1-any.pkg.tar.zst.sig")
+
+	// database signed by an untrusted key
+	otherKey, err := os.ReadFile(filepath.Join("testdata", "pacman_other.asc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	syncer = NewSyncer(*repoURL, NewFileStorage(t.TempDir()),
+		WithHTTPClient(server.Client()),
+		WithRepoType("pacman"),
+		WithKeys(otherKey),
+		WithRetry(RetryConfig{InitialBackoff: time.Millisecond, MetadataRestarts: 1}),
+	)
+	var signatureErr *SignatureError
+	assert.True(t, errors.As(syncer.StoreRepo(), &signatureErr))
+
+	// the database is not synced unverified
+	syncer = NewSyncer(*repoURL, NewFileStorage(t.TempDir()), WithHTTPClient(server.Client()), WithArchs("x86_64"))
+	assert.True(t, errors.As(syncer.StoreRepo(), &signatureErr))
+
+	// nor without its signature
+	repoDirectory := t.TempDir()
+	if err := os.CopyFS(repoDirectory, os.DirFS(filepath.Join("testdata", "pacman_repo"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(repoDirectory, "core", "os", "x86_64", "core.db.sig")); err != nil {
+		t.Fatal(err)
+	}
+	unsignedServer := httptest.NewServer(http.FileServer(http.Dir(repoDirectory)))
+	defer unsignedServer.Close()
+	unsignedURL, err := url.Parse(unsignedServer.URL + "/core/os/x86_64/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	syncer = NewSyncer(*unsignedURL, NewFileStorage(t.TempDir()),
+		WithHTTPClient(unsignedServer.Client()),
+		WithArchs("x86_64"),
+		WithKeys(key),
+		WithRetry(RetryConfig{InitialBackoff: time.Millisecond, MetadataRestarts: 1}),
+	)
+	assert.True(t, errors.As(syncer.StoreRepo(), &signatureErr))
+
+	// a package signature not included in the database is checked too
+	if err := os.WriteFile(filepath.Join(repoDirectory, "core", "os", "x86_64", "core.db.sig"), mustReadFile(t, "pacman_repo", "core", "os", "x86_64", "core.db.sig"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(repoDirectory, "core", "os", "x86_64", "hello-doc-1.0-1-any.pkg.tar.zst.sig"), mustReadFile(t, "pacman_repo", "core", "os", "x86_64", "hello-1.0-1-x86_64.pkg.tar.zst.sig"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	directory = t.TempDir()
+	syncer = NewSyncer(*unsignedURL, NewFileStorage(directory),
+		WithHTTPClient(unsignedServer.Client()),
+		WithArchs("x86_64"),
+		WithKeys(key),
+		WithRetry(RetryConfig{InitialBackoff: time.Millisecond, MetadataRestarts: 1}),
+	)
+	if assert.True(t, errors.As(syncer.StoreRepo(), &signatureErr)) {
+		assert.Contains(t, signatureErr.Reason, "hello-doc-1.0-1-any.pkg.tar.zst.sig")
+	}
+	_, err = os.Stat(filepath.Join(directory, "hello-doc-1.0-1-any.pkg.tar.zst.sig"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+// mustReadFile returns the content of a file in testdata
+func mustReadFile(t *testing.T, elements ...string) []byte {
+	content, err := os.ReadFile(filepath.Join(append([]string{"testdata"}, elements...)...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+// tarOf returns a tar archive with a single file
+func tarOf(t *testing.T, name string, content string) string {
+	var buffer bytes.Buffer
+	writer := tar.NewWriter(&buffer)
+	if err := writer.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content))}); err != nil {
+		t.Fatal(err)
+	}
+	writer.Write([]byte(content))
+	writer.Close()
+	return buffer.String()
+}
@@ -0,0 +1,257 @@
+package get
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// ProgressTracker reports the progress of package downloads. On terminals a
+// status line is redrawn continuously, otherwise a summary is logged
+// periodically. A nil ProgressTracker does not report anything
+type ProgressTracker struct {
+	mutex sync.Mutex
+	out   io.Writer
+	// interactive redraws a status line instead of logging summaries
+	interactive bool
+	// interval between summaries, if not interactive
+	interval time.Duration
+
+	repo          string
+	totalPackages int
+	totalBytes    int64
+	donePackages  int
+	doneBytes     int64
+	// bytes of files being downloaded
+	currentBytes int64
+	// all bytes downloaded, including failed attempts, to compute throughput
+	transferred int64
+	start       time.Time
+	lastLine    string
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewProgressTracker returns a ProgressTracker writing to a file, drawing a
+// status line if the file is a terminal and quiet is false
+func NewProgressTracker(out *os.File, quiet bool) *ProgressTracker {
+	return &ProgressTracker{
+		out:         out,
+		interactive: !quiet && isTerminal(out),
+		interval:    30 * time.Second,
+	}
+}
+
+// isTerminal returns whether a file is a terminal
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// Write writes log output, keeping the status line below it. Use as the
+// writer of a slog.Handler
+func (p *ProgressTracker) Write(b []byte) (int, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.interactive && p.lastLine != "" {
+		fmt.Fprint(p.out, "\r\x1b[K")
+		n, err := p.out.Write(b)
+		fmt.Fprint(p.out, p.lastLine)
+		return n, err
+	}
+	return p.out.Write(b)
+}
+
+// StartRepo starts tracking package downloads of a repo
+func (p *ProgressTracker) StartRepo(repo string, packages int, bytes int64) {
+	if p == nil {
+		return
+	}
+	p.FinishRepo()
+
+	p.mutex.Lock()
+	p.repo = repo
+	p.totalPackages = packages
+	p.totalBytes = bytes
+	p.donePackages = 0
+	p.doneBytes = 0
+	p.currentBytes = 0
+	p.transferred = 0
+	p.start = time.Now()
+	p.stop = make(chan struct{})
+	p.done = make(chan struct{})
+	p.mutex.Unlock()
+
+	interval := p.interval
+	if p.interactive {
+		interval = 250 * time.Millisecond
+	}
+	go func(stop chan struct{}, done chan struct{}) {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.report()
+			case <-stop:
+				return
+			}
+		}
+	}(p.stop, p.done)
+}
+
+// Add counts bytes downloaded for a package being downloaded
+func (p *ProgressTracker) Add(n int64) {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	if p.stop != nil {
+		p.currentBytes += n
+		p.transferred += n
+	}
+	p.mutex.Unlock()
+}
+
+// release stops counting bytes read by a progressReader as in progress, once
+// its download attempt is over. Bytes of successful attempts are counted as done
+func (p *ProgressTracker) release(reader *progressReader, succeeded bool) {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	if p.stop != nil {
+		p.currentBytes -= reader.read
+		if succeeded {
+			p.doneBytes += reader.read
+		}
+	}
+	p.mutex.Unlock()
+}
+
+// PackageDone signals a package was stored
+func (p *ProgressTracker) PackageDone() {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	p.donePackages++
+	p.mutex.Unlock()
+}
+
+// FinishRepo stops tracking the current repo, if any, logging a summary
+func (p *ProgressTracker) FinishRepo() {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	stop, done := p.stop, p.done
+	p.stop = nil
+	p.mutex.Unlock()
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+
+	p.mutex.Lock()
+	attrs := p.attrs()
+	if p.interactive {
+		fmt.Fprint(p.out, "\r\x1b[K")
+		p.lastLine = ""
+	}
+	p.mutex.Unlock()
+	slog.Info("Package downloads finished", attrs...)
+}
+
+// report draws the status line or logs a summary
+func (p *ProgressTracker) report() {
+	p.mutex.Lock()
+	if p.interactive {
+		p.lastLine = p.status()
+		fmt.Fprint(p.out, "\r\x1b[K"+p.lastLine)
+		p.mutex.Unlock()
+		return
+	}
+	attrs := p.attrs()
+	p.mutex.Unlock()
+	slog.Info("Package download progress", attrs...)
+}
+
+// status returns a summary of the progress, to be called with the mutex held
+func (p *ProgressTracker) status() string {
+	done, throughput, eta := p.stats()
+	return fmt.Sprintf("%s: %d/%d packages, %s/%s, %s/s, ETA %s", p.repo, p.donePackages, p.totalPackages,
+		formatBytes(done), formatBytes(p.totalBytes), formatBytes(int64(throughput)), eta)
+}
+
+// attrs returns the progress as log attributes, to be called with the mutex held
+func (p *ProgressTracker) attrs() []any {
+	done, throughput, eta := p.stats()
+	return []any{
+		"repo", p.repo,
+		"packages", p.donePackages,
+		"total_packages", p.totalPackages,
+		"bytes", done,
+		"total_bytes", p.totalBytes,
+		"throughput", formatBytes(int64(throughput)) + "/s",
+		"eta", eta,
+	}
+}
+
+// stats returns bytes done, throughput in bytes per second and the estimated
+// time left, to be called with the mutex held
+func (p *ProgressTracker) stats() (done int64, throughput float64, eta string) {
+	elapsed := time.Since(p.start)
+	throughput = float64(p.transferred) / elapsed.Seconds()
+	done = p.doneBytes + p.currentBytes
+
+	eta = "unknown"
+	if p.totalBytes > 0 && throughput > 0 {
+		remaining := p.totalBytes - done
+		if remaining < 0 {
+			remaining = 0
+		}
+		eta = time.Duration(float64(remaining) / throughput * float64(time.Second)).Round(time.Second).String()
+	} else if p.donePackages > 0 {
+		remaining := p.totalPackages - p.donePackages
+		eta = (elapsed / time.Duration(p.donePackages) * time.Duration(remaining)).Round(time.Second).String()
+	}
+	return
+}
+
+// formatBytes formats a number of bytes with a binary unit
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// progressReader counts bytes read in a ProgressTracker
+type progressReader struct {
+	io.ReadCloser
+	tracker *ProgressTracker
+	read    int64
+}
+
+func (r *progressReader) Read(b []byte) (n int, err error) {
+	n, err = r.ReadCloser.Read(b)
+	r.read += int64(n)
+	r.tracker.Add(int64(n))
+	return
+}
@@ -0,0 +1,92 @@
+package get
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatBytes(t *testing.T) {
+	assert.Equal(t, "512 B", formatBytes(512))
+	assert.Equal(t, "1.5 KiB", formatBytes(1536))
+	assert.Equal(t, "5.0 MiB", formatBytes(5*1024*1024))
+	assert.Equal(t, "2.0 GiB", formatBytes(2*1024*1024*1024))
+}
+
+func TestProgressTracker(t *testing.T) {
+	out := &bytes.Buffer{}
+	tracker := &ProgressTracker{out: out, interactive: true, interval: time.Hour}
+
+	tracker.StartRepo("repo", 2, 2048)
+	// failed attempt, started over
+	failed := &progressReader{ReadCloser: io.NopCloser(strings.NewReader(strings.Repeat("a", 512))), tracker: tracker}
+	io.ReadAll(failed)
+	tracker.release(failed, false)
+	succeeded := &progressReader{ReadCloser: io.NopCloser(strings.NewReader(strings.Repeat("a", 1024))), tracker: tracker}
+	io.ReadAll(succeeded)
+	tracker.release(succeeded, true)
+	tracker.PackageDone()
+	tracker.report()
+
+	tracker.mutex.Lock()
+	status := tracker.status()
+	tracker.mutex.Unlock()
+	assert.True(t, strings.HasPrefix(status, "repo: 1/2 packages, 1.0 KiB/2.0 KiB, "), status)
+
+	// log lines are written above the status line
+	out.Reset()
+	tracker.Write([]byte("hello\n"))
+	assert.Equal(t, "\r\x1b[Khello\n"+tracker.lastLine, out.String())
+	tracker.FinishRepo()
+
+	// bytes read are done even if metadata has no sizes
+	tracker.StartRepo("repo", 1, 0)
+	unsized := &progressReader{ReadCloser: io.NopCloser(strings.NewReader(strings.Repeat("a", 256))), tracker: tracker}
+	io.ReadAll(unsized)
+	tracker.release(unsized, true)
+	tracker.PackageDone()
+	tracker.mutex.Lock()
+	done, _, _ := tracker.stats()
+	tracker.mutex.Unlock()
+	assert.Equal(t, int64(256), done)
+	tracker.FinishRepo()
+
+	// a nil tracker does nothing
+	var nilTracker *ProgressTracker
+	nilTracker.StartRepo("repo", 1, 1)
+	nilTracker.Add(1)
+	nilTracker.PackageDone()
+	nilTracker.FinishRepo()
+}
+
+func TestPackageSizes(t *testing.T) {
+	matches, err := filepath.Glob(filepath.Join("testdata", "repo", "repodata", "*-primary.xml.gz"))
+	if err != nil || len(matches) != 1 {
+		t.Fatal("primary.xml.gz not found")
+	}
+	file, err := os.Open(matches[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	primary, err := readMetaData(file, "gz")
+	assert.NoError(t, err)
+	for _, pack := range primary.Packages {
+		assert.Greater(t, pack.Size.Package, int64(0), pack.Location.Href)
+	}
+
+	file, err = os.Open(filepath.Join("testdata", "deb_repo", "Packages"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	packages, err := decodePackages(file, "")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(8720), packages.Packages[0].Size.Package)
+}
@@ -0,0 +1,319 @@
+package get
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/uyuni-project/minima/util"
+)
+
+// Regeneration of RPM metadata, so that a filtered repo only lists the
+// packages it contains. Regenerated metadata is only signed if a signing key
+// is configured
+
+// verbatimTypes are types of metadata that do not refer to packages, which are
+// kept as they are in regenerated metadata
+var verbatimTypes = map[string]bool{
+	"suseinfo": true,
+	"products": true,
+	"product":  true,
+	"license":  true,
+}
+
+// xmlRepomdOut is a regenerated repodata/repomd.xml
+type xmlRepomdOut struct {
+	XMLName  xml.Name     `xml:"http://linux.duke.edu/metadata/repo repomd"`
+	RPM      string       `xml:"xmlns:rpm,attr"`
+	Revision string       `xml:"revision,omitempty"`
+	Tags     *xmlRaw      `xml:"tags"`
+	Data     []xmlDataOut `xml:"data"`
+}
+
+// xmlRaw keeps the content of an element as it is
+type xmlRaw struct {
+	Content string `xml:",innerxml"`
+}
+
+type xmlDataOut struct {
+	Type         string          `xml:"type,attr"`
+	Checksum     xmlChecksumOut  `xml:"checksum"`
+	OpenChecksum *xmlChecksumOut `xml:"open-checksum"`
+	Location     XMLLocation     `xml:"location"`
+	Timestamp    string          `xml:"timestamp,omitempty"`
+	Size         int64           `xml:"size,omitempty"`
+	OpenSize     int64           `xml:"open-size,omitempty"`
+}
+
+type xmlChecksumOut struct {
+	Type     string `xml:"type,attr"`
+	Checksum string `xml:",chardata"`
+}
+
+// regenerating returns whether metadata of a repo is regenerated
+func (r *Syncer) regenerating(repoType RepoType) bool {
+	return r.regenerate && repoType.regenerable
+}
+
+// regenerateMetadata downloads the metadata listed in repomd.xml and stores
+// it, rewritten to only refer to synced packages. It returns packages to
+// download and recycle, and the content of the regenerated repomd.xml
+func (r *Syncer) regenerateMetadata(repomd XMLRepomd, checksumMap map[string]XMLChecksum, repoType RepoType) (packagesToDownload []XMLPackage, packagesToRecycle []XMLPackage, regenerated []byte, err error) {
+	// packages are filtered first, as other metadata refers to them
+	var primaryEntry *XMLData
+	for i := range repomd.Data {
+		if repomd.Data[i].Type == repoType.PackagesType {
+			primaryEntry = &repomd.Data[i]
+		}
+	}
+	if primaryEntry == nil {
+		err = fmt.Errorf("no %s metadata found", repoType.PackagesType)
+		return
+	}
+	var primaryContent []byte
+	err = r.downloadApply(primaryEntry.Location.Href, primaryEntry.Checksum.Checksum, path.Base(primaryEntry.Location.Href), hashMap[primaryEntry.Checksum.Type], primaryEntry.Size, func(reader io.ReadCloser) (err error) {
+		primaryContent, err = io.ReadAll(reader)
+		return
+	})
+	if err != nil {
+		return
+	}
+	compType := strings.Trim(filepath.Ext(primaryEntry.Location.Href), ".")
+	primary, err := repoType.DecodePackages(bytes.NewReader(primaryContent), compType)
+	if err != nil {
+		return
+	}
+	packagesToDownload, packagesToRecycle = r.filterPackages(primary, checksumMap, repoType)
+	packages := newPackageSet(primary.Packages, r.syncedPackages(primary, repoType))
+
+	data := []xmlDataOut{}
+	deltaTargets := []deltaPackage{}
+	for _, entry := range repomd.Data {
+		href := entry.Location.Href
+		if verbatimTypes[entry.Type] {
+			err = r.downloadStoreApply(href, entry.Checksum.Checksum, path.Base(href), hashMap[entry.Checksum.Type], entry.Size, r.openChecksumVerifier(entry))
+			if err != nil {
+				return
+			}
+			data = append(data, dataOut(entry))
+			continue
+		}
+
+		filter := filterFor(entry.Type)
+		if filter == nil {
+			r.logger().Info("Dropping metadata that cannot be regenerated", "file", href, "type", entry.Type)
+			continue
+		}
+		if r.deltaRPMs && isDeltainfo(entry.Type) {
+			filter = deltainfoFilter(&deltaTargets)
+		}
+		var regeneratedEntry xmlDataOut
+		if entry.Type == repoType.PackagesType {
+			regeneratedEntry, err = r.regenerateData(entry, bytes.NewReader(primaryContent), filter, packages)
+		} else {
+			err = r.downloadApply(href, entry.Checksum.Checksum, path.Base(href), hashMap[entry.Checksum.Type], entry.Size, func(reader io.ReadCloser) (err error) {
+				regeneratedEntry, err = r.regenerateData(entry, reader, filter, packages)
+				return
+			})
+		}
+		if errors.Is(err, errUnsupportedCompression) {
+			r.logger().Warn("Dropping metadata that cannot be regenerated", "file", href, "error", err)
+			continue
+		}
+		if err != nil {
+			return
+		}
+		data = append(data, regeneratedEntry)
+	}
+
+	deltasToDownload, deltasToRecycle, err := r.filterDeltas(deltaTargets, packages, checksumMap)
+	if err != nil {
+		return
+	}
+	packagesToDownload = append(packagesToDownload, deltasToDownload...)
+	packagesToRecycle = append(packagesToRecycle, deltasToRecycle...)
+
+	out := xmlRepomdOut{RPM: "http://linux.duke.edu/metadata/rpm", Revision: repomd.Revision, Data: data}
+	if repomd.Tags.Content != "" {
+		out.Tags = &repomd.Tags
+	}
+	content, err := xml.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return
+	}
+	regenerated = append([]byte(xml.Header), content...)
+	regenerated = append(regenerated, '\n')
+	return
+}
+
+// dataOut returns a repomd.xml entry as it is
+func dataOut(entry XMLData) xmlDataOut {
+	result := xmlDataOut{
+		Type:      entry.Type,
+		Checksum:  xmlChecksumOut(entry.Checksum),
+		Location:  entry.Location,
+		Timestamp: entry.Timestamp,
+		Size:      entry.Size,
+		OpenSize:  entry.OpenSize,
+	}
+	if entry.OpenChecksum.Checksum != "" {
+		openChecksum := xmlChecksumOut(entry.OpenChecksum)
+		result.OpenChecksum = &openChecksum
+	}
+	return result
+}
+
+// regenerateData filters a metadata file, checks it against its
+// open-checksum, stores the result with the same compression and returns its
+// repomd.xml entry
+func (r *Syncer) regenerateData(entry XMLData, reader io.Reader, filter metadataFilter, packages *packageSet) (result xmlDataOut, err error) {
+	href := entry.Location.Href
+	compType := strings.Trim(filepath.Ext(href), ".")
+	uncompressed, err := uncompress(reader, compType)
+	if err != nil {
+		return
+	}
+	defer uncompressed.Close()
+
+	var compressed bytes.Buffer
+	compressor, compType, err := compress(&compressed, compType)
+	if err != nil {
+		return
+	}
+	input := &measuringWriter{hash: openChecksumHash(entry).New()}
+	output := &measuringWriter{hash: sha256.New()}
+
+	tee := io.TeeReader(uncompressed, input)
+	if err = filter(tee, io.MultiWriter(compressor, output), packages); err != nil {
+		return
+	}
+	// read what the filter left, eg. trailing whitespace, to check the whole file
+	if _, err = io.Copy(io.Discard, tee); err != nil {
+		return
+	}
+	if err = compressor.Close(); err != nil {
+		return
+	}
+	if err = checkOpenChecksum(entry, input); err != nil {
+		return
+	}
+
+	sum := sha256.Sum256(compressed.Bytes())
+	checksum := hex.EncodeToString(sum[:])
+	name := strings.TrimPrefix(path.Base(href), entry.Checksum.Checksum+"-")
+	name = strings.TrimSuffix(name, filepath.Ext(name))
+	if compType != "" {
+		name += "." + compType
+	}
+	location := path.Join(path.Dir(href), checksum+"-"+name)
+	if err = r.storeBytes(location, compressed.Bytes()); err != nil {
+		return
+	}
+
+	return xmlDataOut{
+		Type:         entry.Type,
+		Checksum:     xmlChecksumOut{Type: "sha256", Checksum: checksum},
+		OpenChecksum: &xmlChecksumOut{Type: "sha256", Checksum: hex.EncodeToString(output.hash.Sum(nil))},
+		Location:     XMLLocation{Href: location},
+		Timestamp:    entry.Timestamp,
+		Size:         int64(compressed.Len()),
+		OpenSize:     output.size,
+	}, nil
+}
+
+// compress returns a writer compressing like a metadata file with the given
+// extension, and the extension of the result. Compressions without a writer
+// are replaced by gzip
+func compress(writer io.Writer, compType string) (io.WriteCloser, string, error) {
+	switch compType {
+	case "gz":
+		return gzip.NewWriter(writer), compType, nil
+	case "zst":
+		encoder, err := zstd.NewWriter(writer)
+		return encoder, compType, err
+	case "xml", "yaml":
+		return util.NewNopWriteCloser(writer), compType, nil
+	}
+	return gzip.NewWriter(writer), "gz", nil
+}
+
+// measuringWriter hashes and counts written bytes
+type measuringWriter struct {
+	hash hash.Hash
+	size int64
+}
+
+func (w *measuringWriter) Write(p []byte) (int, error) {
+	w.hash.Write(p)
+	w.size += int64(len(p))
+	return len(p), nil
+}
+
+// openChecksumHash returns the hash of the open-checksum of an entry, or
+// sha256 if it has none
+func openChecksumHash(entry XMLData) crypto.Hash {
+	if hash, found := hashMap[entry.OpenChecksum.Type]; found {
+		return hash
+	}
+	return crypto.SHA256
+}
+
+// checkOpenChecksum checks the measured uncompressed content of a metadata
+// file against its open-checksum and open-size, if any
+func checkOpenChecksum(entry XMLData, content *measuringWriter) error {
+	if entry.OpenChecksum.Checksum != "" {
+		actual := hex.EncodeToString(content.hash.Sum(nil))
+		if actual != entry.OpenChecksum.Checksum {
+			return util.NewChecksumError(entry.OpenChecksum.Checksum, actual)
+		}
+	}
+	if entry.OpenSize > 0 && content.size != entry.OpenSize {
+		return util.NewChecksumError(fmt.Sprintf("open-size %d", entry.OpenSize), fmt.Sprintf("open-size %d", content.size))
+	}
+	return nil
+}
+
+// openChecksumVerifier returns a ReaderConsumer checking the uncompressed
+// content of a metadata file against its open-checksum and open-size, if any
+func (r *Syncer) openChecksumVerifier(entry XMLData) util.ReaderConsumer {
+	if entry.OpenChecksum.Checksum == "" && entry.OpenSize == 0 {
+		return util.Nop
+	}
+	return func(reader io.ReadCloser) error {
+		compType := strings.Trim(filepath.Ext(entry.Location.Href), ".")
+		uncompressed, err := uncompress(reader, compType)
+		if errors.Is(err, errUnsupportedCompression) {
+			r.logger().Debug("Not checking open-checksum", "file", entry.Location.Href, "error", err)
+			return nil
+		}
+		if err != nil {
+			// the file does not match its checksum either
+			return util.NewChecksumError(entry.OpenChecksum.Checksum, err.Error())
+		}
+		defer uncompressed.Close()
+
+		content := &measuringWriter{hash: openChecksumHash(entry).New()}
+		if _, err = io.Copy(content, uncompressed); err != nil {
+			return util.NewChecksumError(entry.OpenChecksum.Checksum, err.Error())
+		}
+		return checkOpenChecksum(entry, content)
+	}
+}
+
+// storeBytes stores content generated by minima at a repo-relative path
+func (r *Syncer) storeBytes(relativePath string, content []byte) error {
+	sum := sha256.Sum256(content)
+	mapper := r.storage.StoringMapper(relativePath, hex.EncodeToString(sum[:]), crypto.SHA256)
+	return util.Compose(mapper, util.Nop)(util.NewNopReadCloser(bytes.NewReader(content)))
+}
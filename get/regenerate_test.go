@@ -0,0 +1,108 @@
+package get
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStoreRepoRegenerate(t *testing.T) {
+	server := httptest.NewServer(http.FileServer(http.Dir("testdata")))
+	defer server.Close()
+
+	repoURL, err := url.Parse(server.URL + "/repo/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	directory := t.TempDir()
+	syncer := NewSyncer(*repoURL, NewFileStorage(directory),
+		WithHTTPClient(server.Client()),
+		WithArchs("x86_64"),
+		WithSkipLegacy(true),
+		WithRegenerateMetadata(true),
+	)
+
+	// first sync
+	assert.NoError(t, syncer.StoreRepo())
+
+	content, err := os.ReadFile(filepath.Join(directory, "repodata", "repomd.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var repomd XMLRepomd
+	if err = xml.Unmarshal(content, &repomd); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "1436435242", repomd.Revision)
+
+	// every entry refers to a stored file with the listed checksums
+	files := map[string][]byte{}
+	types := []string{}
+	for _, data := range repomd.Data {
+		types = append(types, data.Type)
+		assert.NoError(t, validateData(data))
+		compressed, err := os.ReadFile(filepath.Join(directory, filepath.FromSlash(data.Location.Href)))
+		if !assert.NoError(t, err, data.Location.Href) {
+			continue
+		}
+		sum := sha256.Sum256(compressed)
+		assert.Equal(t, data.Checksum.Checksum, hex.EncodeToString(sum[:]), data.Type)
+		assert.Equal(t, int64(len(compressed)), data.Size, data.Type)
+
+		reader, err := uncompress(bytes.NewReader(compressed), "gz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		uncompressed, err := io.ReadAll(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sum = sha256.Sum256(uncompressed)
+		assert.Equal(t, data.OpenChecksum.Checksum, hex.EncodeToString(sum[:]), data.Type)
+		assert.Equal(t, int64(len(uncompressed)), data.OpenSize, data.Type)
+		files[data.Type] = uncompressed
+	}
+	assert.ElementsMatch(t, []string{"filelists", "updateinfo", "other", "primary"}, types)
+
+	// only synced packages are listed
+	primary, err := readMetaData(bytes.NewReader(files["primary"]), "xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotEmpty(t, primary.Packages)
+	for _, pack := range primary.Packages {
+		assert.Contains(t, []string{"x86_64", "noarch"}, pack.Arch, pack.Location.Href)
+		_, err := os.Stat(filepath.Join(directory, filepath.FromSlash(pack.Location.Href)))
+		assert.NoError(t, err, pack.Location.Href)
+	}
+	assert.Contains(t, string(files["filelists"]), `packages="`+strconv.Itoa(len(primary.Packages))+`"`)
+	updateinfo := string(files["updateinfo"])
+	assert.Contains(t, updateinfo, "milkyway-dummy-2.0-1.1.x86_64.rpm")
+	assert.NotContains(t, updateinfo, ".i586.rpm")
+	assert.NotContains(t, updateinfo, ".src.rpm")
+
+	// original metadata is not stored
+	entries, err := os.ReadDir(filepath.Join(directory, "repodata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		assert.False(t, strings.HasPrefix(entry.Name(), "dadb7d32493327d1afdead2b4f191f8bcd449bcfe48fda241a0b94555c5495f6"), entry.Name())
+	}
+	assert.Len(t, entries, len(repomd.Data)+1)
+
+	// second sync
+	assert.NoError(t, syncer.StoreRepo())
+}
@@ -0,0 +1,62 @@
+package get
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// suseRepoPath matches paths of SUSE repos, eg. /SUSE/Updates/SLE-Product-SLES/15-SP5/x86_64/update/
+var suseRepoPath = regexp.MustCompile(`^/SUSE/(?:Products|Updates)/([^/]+)/([^/]+)/([^/]+)/`)
+
+// templateVariable matches a variable in a path template, eg. {arch}
+var templateVariable = regexp.MustCompile(`{([^{}]*)}`)
+
+// RepoPath returns the path a repo is stored at. By default that is the path
+// of the repo URL, unless a template is configured. Templates can use:
+//   - {path}: the path of the repo URL
+//   - {host}: the host of the repo URL
+//   - {name}: the repo name, by default the last element of the URL path
+//   - {product}, {version} and {arch}: taken from SUSE repo URLs such as
+//     /SUSE/Updates/SLE-Product-SLES/15-SP5/x86_64/update/. {arch} defaults
+//     to the configured arch if there is only one
+func RepoPath(repo HTTPRepoConfig, repoURL *url.URL) (string, error) {
+	if repo.Path == "" {
+		return repoURL.Path, nil
+	}
+
+	name := repo.Name
+	if name == "" {
+		name = path.Base(path.Clean("/" + repoURL.Path))
+	}
+	variables := map[string]string{
+		"path": repoURL.Path,
+		"host": repoURL.Hostname(),
+		"name": name,
+	}
+	if len(repo.Archs) == 1 {
+		variables["arch"] = repo.Archs[0]
+	}
+	if matches := suseRepoPath.FindStringSubmatch(repoURL.Path); matches != nil {
+		variables["product"] = matches[1]
+		variables["version"] = matches[2]
+		variables["arch"] = matches[3]
+	}
+
+	var err error
+	result := templateVariable.ReplaceAllStringFunc(repo.Path, func(match string) string {
+		value, found := variables[strings.Trim(match, "{}")]
+		if !found && err == nil {
+			err = fmt.Errorf("cannot expand %s in path %s for repo %s", match, repo.Path, repoURL.String())
+		}
+		return value
+	})
+	if err != nil {
+		return "", err
+	}
+
+	// keep the result inside the storage root
+	return path.Join("/", result) + "/", nil
+}
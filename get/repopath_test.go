@@ -0,0 +1,65 @@
+package get
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRepoPath(t *testing.T) {
+	tests := []struct {
+		name    string
+		repo    HTTPRepoConfig
+		want    string
+		wantErr bool
+	}{
+		{
+			"No template",
+			HTTPRepoConfig{URL: "https://updates.suse.com/SUSE/Updates/SLE-Product-SLES/15-SP5/x86_64/update/"},
+			"/SUSE/Updates/SLE-Product-SLES/15-SP5/x86_64/update/",
+			false,
+		},
+		{
+			"SUSE variables",
+			HTTPRepoConfig{
+				URL:  "https://updates.suse.com/SUSE/Updates/SLE-Product-SLES/15-SP5/x86_64/update/",
+				Path: "{product}/{version}/{arch}",
+			},
+			"/SLE-Product-SLES/15-SP5/x86_64/",
+			false,
+		},
+		{
+			"Name, host and single arch",
+			HTTPRepoConfig{
+				URL:   "http://download.opensuse.org/repositories/myrepo1/openSUSE_Leap_42.3/",
+				Archs: []string{"x86_64"},
+				Path:  "mirrors/{host}/{name}-{arch}",
+			},
+			"/mirrors/download.opensuse.org/openSUSE_Leap_42.3-x86_64/",
+			false,
+		},
+		{
+			"Literal path outside of root",
+			HTTPRepoConfig{URL: "http://test/repo/", Path: "../../etc"},
+			"/etc/",
+			false,
+		},
+		{
+			"Unknown variable",
+			HTTPRepoConfig{URL: "http://test/repo/", Path: "{product}"},
+			"",
+			true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repoURL, err := url.Parse(tt.repo.URL)
+			assert.NoError(t, err)
+			got, err := RepoPath(tt.repo, repoURL)
+			assert.EqualValues(t, tt.wantErr, (err != nil))
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,273 @@
+package get
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// RepoType describes a format of repo metadata, eg. RPM or Debian
+type RepoType struct {
+	// Name is the name the type is registered with, set by RegisterRepoType
+	Name string
+	// MetadataPath is the repo-relative path of the file listing all other
+	// metadata files, eg. repodata/repomd.xml. It can contain {arch} if there
+	// is one such file per arch, and {name} for the repo name
+	MetadataPath string
+	// PackagesType is the type of the metadata entry listing packages. If
+	// empty, the metadata file lists packages itself, with locations relative
+	// to its directory
+	PackagesType string
+	// DecodeMetadata decodes the file at MetadataPath
+	DecodeMetadata func(io.Reader) (XMLRepomd, error)
+	// DecodePackages decodes the file listing packages, given the extension of
+	// its path without the dot, eg. gz
+	DecodePackages func(io.Reader, string) (XMLMetaData, error)
+	// SourcesType is the base name, without compression extension, of the
+	// metadata entries listing source packages, if they are listed
+	// separately. One variant is processed per directory. Optional
+	SourcesType string
+	// DecodeSources decodes the file listing source packages, like
+	// DecodePackages. Each file of a source package is returned as a package
+	DecodeSources func(io.Reader, string) (XMLMetaData, error)
+	// MetadataSignatureExt is appended to MetadataPath to get its detached
+	// signature, if any
+	MetadataSignatureExt string
+	// MetadataKeyExt is appended to MetadataPath to get the OpenPGP key the
+	// detached signature is checked with. If empty, configured keys are used
+	MetadataKeyExt string
+	// Noarch is the architecture of packages that fit all architectures
+	Noarch string
+	// PackageExtensions are suffixes of package file names, eg. .rpm
+	PackageExtensions []string
+	// VerifyMetadata checks a signature embedded in the metadata file against
+	// trusted keys, instead of a detached signature. Optional
+	VerifyMetadata func(metadata []byte, keys [][]byte) error
+	// FilterMetadata rewrites the file at MetadataPath to only list indexes
+	// for which keep returns true, given their path. Optional
+	FilterMetadata func(metadata []byte, keep func(string) bool) ([]byte, error)
+	// UnpublishedIndexes is set if uncompressed variants of compressed
+	// indexes can be listed without being published, as in Debian Release
+	// files. They are skipped if a compressed variant is published
+	UnpublishedIndexes bool
+	// VerifyPackage checks a package against its checksum, if it is not a
+	// checksum of the whole file. It must read the whole package. Optional
+	VerifyPackage func(reader io.Reader, checksum XMLChecksum) error
+
+	// regenerable is set for types whose metadata minima can regenerate
+	regenerable bool
+}
+
+// NeedsKeys returns whether metadata signatures of the type are checked
+// against configured keys, which are then mandatory
+func (t RepoType) NeedsKeys() bool {
+	return t.VerifyMetadata != nil || (t.MetadataSignatureExt != "" && t.MetadataKeyExt == "")
+}
+
+// RepoTypeAuto detects the type of a repo by probing it for the metadata of
+// each registered type, in registration order
+const RepoTypeAuto = "auto"
+
+// ErrRepoTypeNotDetected is returned if no registered repo type was found
+// while probing a repo
+var ErrRepoTypeNotDetected = errors.New("repo type not detected")
+
+var (
+	repoTypesMutex sync.RWMutex
+	repoTypes      = map[string]RepoType{}
+	// repoTypeNames lists registered types in registration order
+	repoTypeNames []string
+)
+
+func init() {
+	RegisterRepoType("rpm", RepoType{
+		MetadataPath: repomdPath,
+		PackagesType: "primary",
+		DecodeMetadata: func(reader io.Reader) (repomd XMLRepomd, err error) {
+			decoder := xml.NewDecoder(reader)
+			err = decoder.Decode(&repomd)
+			return
+		},
+		DecodePackages:       readMetaData,
+		MetadataSignatureExt: ".asc",
+		MetadataKeyExt:       ".key",
+		Noarch:               "noarch",
+		PackageExtensions:    []string{".rpm", ".drpm"},
+		regenerable:          true,
+	})
+	RegisterRepoType("deb", RepoType{
+		MetadataPath:         releasePath,
+		PackagesType:         "Packages",
+		DecodeMetadata:       decodeRelease,
+		DecodePackages:       decodePackages,
+		SourcesType:          "Sources",
+		DecodeSources:        decodeSources,
+		FilterMetadata:       filterRelease,
+		UnpublishedIndexes:   true,
+		MetadataSignatureExt: ".gpg",
+		MetadataKeyExt:       ".key",
+		Noarch:               "all",
+		PackageExtensions:    []string{".deb", ".udeb", ".dsc"},
+	})
+	RegisterRepoType("apk", RepoType{
+		MetadataPath: "{arch}/APKINDEX.tar.gz",
+		DecodeMetadata: func(io.Reader) (XMLRepomd, error) {
+			// APKINDEX.tar.gz only lists packages
+			return XMLRepomd{}, nil
+		},
+		DecodePackages:    decodeAPKIndex,
+		Noarch:            "noarch",
+		PackageExtensions: []string{".apk"},
+		VerifyMetadata:    verifyAPKIndex,
+		VerifyPackage:     verifyAPK,
+	})
+	RegisterRepoType("pacman", RepoType{
+		MetadataPath: "{name}.db",
+		DecodeMetadata: func(io.Reader) (XMLRepomd, error) {
+			// the database only lists packages
+			return XMLRepomd{}, nil
+		},
+		DecodePackages:       decodePacmanDB,
+		MetadataSignatureExt: ".sig",
+		Noarch:               "any",
+		PackageExtensions:    []string{".pkg.tar.zst", ".pkg.tar.xz", ".pkg.tar.zst.sig", ".pkg.tar.xz.sig"},
+	})
+}
+
+// RegisterRepoType makes a repo type available under a name, to be set per
+// repo or found by auto-detection
+func RegisterRepoType(name string, repoType RepoType) error {
+	if name == "" || name == RepoTypeAuto {
+		return fmt.Errorf("invalid repo type name %q", name)
+	}
+	if repoType.MetadataPath == "" || repoType.DecodeMetadata == nil || repoType.DecodePackages == nil {
+		return fmt.Errorf("repo type %s needs MetadataPath, DecodeMetadata and DecodePackages", name)
+	}
+
+	repoTypesMutex.Lock()
+	defer repoTypesMutex.Unlock()
+	if _, found := repoTypes[name]; found {
+		return fmt.Errorf("repo type %s is already registered", name)
+	}
+	repoType.Name = name
+	repoTypes[name] = repoType
+	repoTypeNames = append(repoTypeNames, name)
+	return nil
+}
+
+// LookupRepoType returns the repo type registered with a name
+func LookupRepoType(name string) (repoType RepoType, found bool) {
+	repoTypesMutex.RLock()
+	defer repoTypesMutex.RUnlock()
+	repoType, found = repoTypes[name]
+	return
+}
+
+// RegisteredRepoTypes returns all registered repo types, in registration order
+func RegisteredRepoTypes() []RepoType {
+	repoTypesMutex.RLock()
+	defer repoTypesMutex.RUnlock()
+	result := make([]RepoType, 0, len(repoTypeNames))
+	for _, name := range repoTypeNames {
+		result = append(result, repoTypes[name])
+	}
+	return result
+}
+
+// ValidRepoType returns an error if name is neither a registered repo type,
+// nor empty or auto
+func ValidRepoType(name string) error {
+	if name == "" || name == RepoTypeAuto {
+		return nil
+	}
+	if _, found := LookupRepoType(name); !found {
+		names := []string{RepoTypeAuto}
+		for _, repoType := range RegisteredRepoTypes() {
+			names = append(names, repoType.Name)
+		}
+		return fmt.Errorf("unknown repo type %s, expected one of %s", name, strings.Join(names, ", "))
+	}
+	return nil
+}
+
+// isPackageFile returns whether a path has the extension of packages of any
+// registered repo type
+func isPackageFile(path string) bool {
+	for _, repoType := range RegisteredRepoTypes() {
+		for _, extension := range repoType.PackageExtensions {
+			if strings.HasSuffix(path, extension) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// detectRepoType returns the configured repo type or, if auto, the first
+// registered type whose metadata file is found in the repo
+func (r *Syncer) detectRepoType() (repoType RepoType, err error) {
+	if r.repoType != "" && r.repoType != RepoTypeAuto {
+		if err = ValidRepoType(r.repoType); err != nil {
+			return
+		}
+		repoType, _ = LookupRepoType(r.repoType)
+		return
+	}
+
+	for _, repoType = range RegisteredRepoTypes() {
+		metadataPaths, pathsErr := r.metadataPaths(repoType)
+		if pathsErr != nil {
+			// eg. the type has one metadata file per arch and no archs are set
+			continue
+		}
+		var found bool
+		found, err = r.probe(metadataPaths[0])
+		if err != nil {
+			return
+		}
+		if found {
+			r.logger().Debug("Detected repo type", "type", repoType.Name)
+			return
+		}
+	}
+	err = fmt.Errorf("%w at %s", ErrRepoTypeNotDetected, r.URL.String())
+	return
+}
+
+// probe returns whether a repo-relative path exists at the repo URL. Only
+// status codes meaning a missing file count as not found, other errors are
+// returned after retries. S3 and CloudFront answer 403 for missing files
+// when listing is not allowed, so it counts as not found as well
+func (r *Syncer) probe(relativePath string) (found bool, err error) {
+	probeURL := fileURL(r.URL, relativePath)
+	err = r.withRetries(relativePath, func() error {
+		response, err := r.client.Head(probeURL)
+		if err != nil {
+			return err
+		}
+		response.Body.Close()
+		// some servers do not implement HEAD
+		if response.StatusCode == http.StatusMethodNotAllowed || response.StatusCode == http.StatusNotImplemented {
+			response, err = r.client.Get(probeURL)
+			if err != nil {
+				return err
+			}
+			response.Body.Close()
+		}
+
+		switch response.StatusCode {
+		case http.StatusOK:
+			found = true
+		case http.StatusNotFound, http.StatusGone, http.StatusForbidden:
+			found = false
+		default:
+			return &UnexpectedStatusCodeError{URL: probeURL, StatusCode: response.StatusCode, RetryAfter: retryAfter(response)}
+		}
+		return nil
+	})
+	return
+}
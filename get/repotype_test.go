@@ -0,0 +1,91 @@
+package get
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDetectRepoType(t *testing.T) {
+	files := http.FileServer(http.Dir("testdata"))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/broken/") {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		// like S3 and CloudFront without list permissions, missing files are forbidden
+		if relativePath, found := strings.CutPrefix(r.URL.Path, "/forbidden/"); found {
+			if _, err := os.Stat(filepath.Join("testdata", filepath.FromSlash(relativePath))); err != nil {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			r.URL.Path = "/" + relativePath
+		}
+		files.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	detect := func(repo string, options ...SyncerOption) (RepoType, error) {
+		repoURL, err := url.Parse(server.URL + "/" + repo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		storage := NewFileStorage(filepath.Join(t.TempDir(), "repo"))
+		options = append(options, WithHTTPClient(server.Client()), WithRetry(RetryConfig{Attempts: map[string]int{ErrorClassServer: 1}}))
+		return NewSyncer(*repoURL, storage, options...).detectRepoType()
+	}
+
+	repoType, err := detect("repo")
+	assert.NoError(t, err)
+	assert.Equal(t, "rpm", repoType.Name)
+
+	repoType, err = detect("deb_repo")
+	assert.NoError(t, err)
+	assert.Equal(t, "deb", repoType.Name)
+
+	repoType, err = detect("forbidden/deb_repo")
+	assert.NoError(t, err)
+	assert.Equal(t, "deb", repoType.Name)
+
+	repoType, err = detect("deb_repo", WithRepoType("rpm"))
+	assert.NoError(t, err)
+	assert.Equal(t, "rpm", repoType.Name)
+
+	_, err = detect("missing")
+	assert.True(t, errors.Is(err, ErrRepoTypeNotDetected), err)
+
+	// server errors are not mistaken for a missing type
+	_, err = detect("broken/repo")
+	var statusErr *UnexpectedStatusCodeError
+	if assert.True(t, errors.As(err, &statusErr), err) {
+		assert.Equal(t, http.StatusInternalServerError, statusErr.StatusCode)
+	}
+
+	_, err = detect("repo", WithRepoType("unknown"))
+	assert.Error(t, err)
+}
+
+func TestRegisterRepoType(t *testing.T) {
+	assert.Error(t, RegisterRepoType("rpm", RepoType{MetadataPath: "x", DecodeMetadata: decodeRelease, DecodePackages: decodePackages}))
+	assert.Error(t, RegisterRepoType(RepoTypeAuto, RepoType{MetadataPath: "x", DecodeMetadata: decodeRelease, DecodePackages: decodePackages}))
+	assert.Error(t, RegisterRepoType("incomplete", RepoType{MetadataPath: "x"}))
+
+	assert.NoError(t, ValidRepoType(""))
+	assert.NoError(t, ValidRepoType("deb"))
+	assert.Error(t, ValidRepoType("unknown"))
+
+	assert.True(t, isPackageFile("x86_64/a-1.0-1.x86_64.rpm"))
+	assert.True(t, isPackageFile("pool/main/a_1.0_amd64.udeb"))
+	assert.True(t, isPackageFile("x86_64/a-1.0-r0.apk"))
+	assert.True(t, isPackageFile("a-1.0-1-x86_64.pkg.tar.zst.sig"))
+	assert.True(t, isPackageFile("x86_64/a-0.9-1_1.0-1.x86_64.drpm"))
+	assert.False(t, isPackageFile("core.db.sig"))
+	assert.False(t, isPackageFile("repodata/repomd.xml"))
+}
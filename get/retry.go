@@ -0,0 +1,216 @@
+package get
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/uyuni-project/minima/util"
+)
+
+// Error classes a RetryConfig can set the number of attempts for
+const (
+	// ErrorClassNetwork covers connection failures, timeouts and interrupted transfers
+	ErrorClassNetwork = "network"
+	// ErrorClassServer covers 5xx status codes
+	ErrorClassServer = "server"
+	// ErrorClassThrottled covers the 429 status code
+	ErrorClassThrottled = "throttled"
+	// ErrorClassNotFound covers 404 and 410 status codes
+	ErrorClassNotFound = "not_found"
+	// ErrorClassForbidden covers 401 and 403 status codes
+	ErrorClassForbidden = "forbidden"
+	// ErrorClassChecksum covers downloaded files not matching their checksum
+	ErrorClassChecksum = "checksum"
+	// ErrorClassSize covers downloaded files larger or smaller than expected
+	ErrorClassSize = "size"
+	// ErrorClassOther covers anything else, eg. storage errors
+	ErrorClassOther = "other"
+)
+
+// defaultAttempts is the number of attempts per file for each error class
+var defaultAttempts = map[string]int{
+	ErrorClassNetwork:   5,
+	ErrorClassServer:    5,
+	ErrorClassThrottled: 10,
+	ErrorClassNotFound:  1,
+	ErrorClassForbidden: 1,
+	ErrorClassChecksum:  2,
+	ErrorClassSize:      2,
+	ErrorClassOther:     1,
+}
+
+// RetryConfig defines how failed downloads are retried. Each file is retried
+// with exponential backoff and jitter, honoring Retry-After if sent, up to
+// MaxBackoff. The whole
+// repo is only synced again if metadata changed upstream while syncing
+type RetryConfig struct {
+	// Attempts maps error classes to the maximum number of attempts per file
+	Attempts map[string]int
+	// InitialBackoff is the delay before the first retry, default 1s
+	InitialBackoff time.Duration `yaml:"initial_backoff"`
+	// MaxBackoff caps the delay between retries, including delays asked for
+	// by servers with Retry-After, default 1m
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+	// MetadataRestarts is the maximum number of times the whole repo is synced
+	// again because of metadata changes, default 20
+	MetadataRestarts int `yaml:"metadata_restarts"`
+}
+
+// attempts returns the maximum number of attempts for an error class
+func (c RetryConfig) attempts(class string) int {
+	if attempts, found := c.Attempts[class]; found {
+		return attempts
+	}
+	return defaultAttempts[class]
+}
+
+func (c RetryConfig) metadataRestarts() int {
+	if c.MetadataRestarts > 0 {
+		return c.MetadataRestarts
+	}
+	return 20
+}
+
+func (c RetryConfig) maxBackoff() time.Duration {
+	if c.MaxBackoff > 0 {
+		return c.MaxBackoff
+	}
+	return time.Minute
+}
+
+// backoff returns a randomized delay before retry number attempt (from 1)
+func (c RetryConfig) backoff(attempt int) time.Duration {
+	initial := c.InitialBackoff
+	if initial <= 0 {
+		initial = time.Second
+	}
+	max := c.maxBackoff()
+
+	delay := initial
+	for i := 1; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	// "equal jitter": half fixed, half random
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// errorClass returns the class of a download error
+func errorClass(err error) string {
+	var statusErr *UnexpectedStatusCodeError
+	if errors.As(err, &statusErr) {
+		switch code := statusErr.StatusCode; {
+		case code == 429:
+			return ErrorClassThrottled
+		case code == 401 || code == 403:
+			return ErrorClassForbidden
+		case code == 404 || code == 410:
+			return ErrorClassNotFound
+		case code >= 500:
+			return ErrorClassServer
+		}
+		return ErrorClassOther
+	}
+
+	var checksumErr *util.ChecksumError
+	if errors.As(err, &checksumErr) {
+		return ErrorClassChecksum
+	}
+	var sizeErr *util.SizeError
+	if errors.As(err, &sizeErr) {
+		return ErrorClassSize
+	}
+
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) && urlErr.Op == "parse" {
+		return ErrorClassOther
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return ErrorClassNetwork
+	}
+	return ErrorClassOther
+}
+
+// withRetries runs a download until it succeeds or the attempts for the class
+// of its error are exhausted
+func (r *Syncer) withRetries(description string, download func() error) (err error) {
+	for attempt := 1; ; attempt++ {
+		err = download()
+		if err == nil {
+			return
+		}
+		if consumerErr, ok := err.(*consumerError); ok {
+			return consumerErr.err
+		}
+
+		class := errorClass(err)
+		if attempt >= r.Retry.attempts(class) {
+			return
+		}
+
+		delay := r.Retry.backoff(attempt)
+		var statusErr *UnexpectedStatusCodeError
+		if errors.As(err, &statusErr) && statusErr.RetryAfter > 0 {
+			delay = min(statusErr.RetryAfter, r.Retry.maxBackoff())
+		}
+		r.logger().Warn("Download failed, retrying", "file", description, "class", class, "error", err, "delay", delay.Round(time.Millisecond))
+		r.emit(Event{Type: EventDownloadRetried, File: description, Attempt: attempt, Delay: delay, Err: err})
+		time.Sleep(delay)
+	}
+}
+
+// MetadataRaceError signals that repo metadata did not match while syncing,
+// presumably because the repo was published in the meantime
+type MetadataRaceError struct {
+	Err error
+}
+
+func (e *MetadataRaceError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *MetadataRaceError) Unwrap() error {
+	return e.Err
+}
+
+// metadataRace wraps checksum, size and signature errors into a MetadataRaceError
+func metadataRace(err error) error {
+	var checksumErr *util.ChecksumError
+	var sizeErr *util.SizeError
+	var signatureErr *SignatureError
+	if errors.As(err, &checksumErr) || errors.As(err, &sizeErr) || errors.As(err, &signatureErr) {
+		return &MetadataRaceError{err}
+	}
+	return err
+}
+
+// consumerError wraps errors of code consuming a download, which are not retried
+type consumerError struct {
+	err error
+}
+
+func (e *consumerError) Error() string {
+	return e.err.Error()
+}
+
+// readErrorRecorder remembers errors reading a response body, to tell them
+// apart from errors of the code consuming it
+type readErrorRecorder struct {
+	io.ReadCloser
+	err error
+}
+
+func (r *readErrorRecorder) Read(p []byte) (n int, err error) {
+	n, err = r.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return
+}
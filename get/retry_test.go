@@ -0,0 +1,118 @@
+package get
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/uyuni-project/minima/util"
+)
+
+func TestErrorClass(t *testing.T) {
+	assert.Equal(t, ErrorClassThrottled, errorClass(&UnexpectedStatusCodeError{StatusCode: 429}))
+	assert.Equal(t, ErrorClassServer, errorClass(&UnexpectedStatusCodeError{StatusCode: 503}))
+	assert.Equal(t, ErrorClassNotFound, errorClass(&UnexpectedStatusCodeError{StatusCode: 404}))
+	assert.Equal(t, ErrorClassForbidden, errorClass(&UnexpectedStatusCodeError{StatusCode: 401}))
+	assert.Equal(t, ErrorClassNetwork, errorClass(io.ErrUnexpectedEOF))
+	assert.Equal(t, ErrorClassNetwork, errorClass(&url.Error{Op: "Get", URL: "http://test", Err: errors.New("connection refused")}))
+	assert.Equal(t, ErrorClassOther, errorClass(&url.Error{Op: "parse", URL: "http://test:x", Err: errors.New("invalid port")}))
+	assert.Equal(t, ErrorClassSize, errorClass(util.NewSizeError(5, 12)))
+	assert.Equal(t, ErrorClassOther, errorClass(errors.New("disk full")))
+}
+
+func TestBackoff(t *testing.T) {
+	config := RetryConfig{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second}
+	for attempt, max := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		delay := config.backoff(attempt + 1)
+		assert.GreaterOrEqual(t, delay, max/2)
+		assert.LessOrEqual(t, delay, max)
+	}
+}
+
+func TestDownloadRetries(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch requests.Add(1) {
+		case 1:
+			w.WriteHeader(503)
+		case 2:
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(429)
+		default:
+			w.Write([]byte("Hello, World"))
+		}
+	}))
+	defer server.Close()
+
+	serverURL, err := url.Parse(server.URL + "/repo/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage := NewFileStorage(filepath.Join(t.TempDir(), "repo"))
+	syncer := NewSyncer(*serverURL, storage, WithQuiet(true), WithRetry(RetryConfig{InitialBackoff: time.Millisecond}))
+
+	start := time.Now()
+	err = syncer.downloadStoreApply("a.rpm", "", "a.rpm", 0, 0, util.Nop)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(3), requests.Load())
+	// Retry-After was honored
+	assert.GreaterOrEqual(t, time.Since(start), time.Second)
+
+	// not found is not retried by default
+	server.Config.Handler = http.NotFoundHandler()
+	err = syncer.downloadStoreApply("a.rpm", "", "a.rpm", 0, 0, util.Nop)
+	assert.Equal(t, ErrorClassNotFound, errorClass(err))
+
+	// errors of consumers are not retried
+	requests.Store(10)
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Write([]byte("Hello, World"))
+	})
+	syncer.Retry.Attempts = map[string]int{ErrorClassOther: 3}
+	consumerErr := errors.New("cannot parse")
+	err = syncer.downloadStoreApply("a.rpm", "", "a.rpm", 0, 0, func(reader io.ReadCloser) error {
+		return consumerErr
+	})
+	assert.Equal(t, consumerErr, err)
+	assert.Equal(t, int32(11), requests.Load())
+
+	// sizes not matching are retried, even when read by consumers
+	requests.Store(0)
+	syncer.Retry.Attempts = nil
+	for _, size := range []int64{5, 20} {
+		err = syncer.downloadStoreApply("a.rpm", "", "a.rpm", 0, size, util.Nop)
+		assert.Equal(t, ErrorClassSize, errorClass(err))
+		err = syncer.downloadStoreApply("a.rpm", "", "a.rpm", 0, size, func(reader io.ReadCloser) error {
+			_, err := io.ReadAll(reader)
+			return fmt.Errorf("cannot parse: %w", err)
+		})
+		assert.Equal(t, ErrorClassSize, errorClass(err))
+	}
+	assert.Equal(t, int32(8), requests.Load())
+	assert.NoError(t, syncer.downloadStoreApply("a.rpm", "", "a.rpm", 0, 12, util.Nop))
+
+	// Retry-After is capped by MaxBackoff
+	requests.Store(0)
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			w.Header().Set("Retry-After", "86400")
+			w.WriteHeader(429)
+			return
+		}
+		w.Write([]byte("Hello, World"))
+	})
+	syncer.Retry.MaxBackoff = 10 * time.Millisecond
+	start = time.Now()
+	assert.NoError(t, syncer.downloadStoreApply("a.rpm", "", "a.rpm", 0, 0, util.Nop))
+	assert.Equal(t, int32(2), requests.Load())
+	assert.Less(t, time.Since(start), time.Minute)
+}
@@ -0,0 +1,550 @@
+package get
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Parsers of RPM metadata other than primary, to keep it consistent with the
+// packages of a filtered repo. Metadata is rewritten as it was written,
+// keeping namespace prefixes, whitespace and unknown content, except for
+// elements referring to packages that are not synced
+
+// xmlElement is an element of a metadata file. Name.Space holds the namespace
+// prefix as written, not the namespace URL
+type xmlElement struct {
+	Name xml.Name
+	Attr []xml.Attr
+	// Children are *xmlElement, xml.CharData, xml.Comment, xml.ProcInst or
+	// xml.Directive
+	Children []any
+}
+
+// attr returns the value of an unprefixed attribute
+func (e *xmlElement) attr(name string) string {
+	for _, attr := range e.Attr {
+		if attr.Name.Space == "" && attr.Name.Local == name {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+// setAttr sets the value of an unprefixed attribute, if present
+func setAttr(attrs []xml.Attr, name string, value string) {
+	for i := range attrs {
+		if attrs[i].Name.Space == "" && attrs[i].Name.Local == name {
+			attrs[i].Value = value
+		}
+	}
+}
+
+// children returns child elements with a local name, whatever their prefix
+func (e *xmlElement) children(name string) []*xmlElement {
+	result := []*xmlElement{}
+	for _, child := range e.Children {
+		if element, ok := child.(*xmlElement); ok && element.Name.Local == name {
+			result = append(result, element)
+		}
+	}
+	return result
+}
+
+// text returns the character data directly inside an element
+func (e *xmlElement) text() string {
+	var builder strings.Builder
+	for _, child := range e.Children {
+		if data, ok := child.(xml.CharData); ok {
+			builder.Write(data)
+		}
+	}
+	return strings.TrimSpace(builder.String())
+}
+
+// childText returns the text of the first child element with a local name
+func (e *xmlElement) childText(name string) string {
+	for _, child := range e.children(name) {
+		return child.text()
+	}
+	return ""
+}
+
+// removeChildren removes child elements for which remove returns true,
+// along with the whitespace before them, and returns how many were removed
+func (e *xmlElement) removeChildren(remove func(*xmlElement) bool) (removed int) {
+	children := make([]any, 0, len(e.Children))
+	for _, child := range e.Children {
+		if element, ok := child.(*xmlElement); ok && remove(element) {
+			if last := len(children) - 1; last >= 0 {
+				if data, ok := children[last].(xml.CharData); ok && len(strings.TrimSpace(string(data))) == 0 {
+					children = children[:last]
+				}
+			}
+			removed++
+			continue
+		}
+		children = append(children, child)
+	}
+	e.Children = children
+	return
+}
+
+// readElement reads the rest of an element after its start tag
+func readElement(decoder *xml.Decoder, start xml.StartElement) (*xmlElement, error) {
+	element := &xmlElement{Name: start.Name, Attr: start.Attr}
+	for {
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			child, err := readElement(decoder, t.Copy())
+			if err != nil {
+				return nil, err
+			}
+			element.Children = append(element.Children, child)
+		case xml.EndElement:
+			if t.Name != start.Name {
+				return nil, fmt.Errorf("element <%s> closed by </%s>", prefixedName(start.Name), prefixedName(t.Name))
+			}
+			return element, nil
+		default:
+			element.Children = append(element.Children, xml.CopyToken(token))
+		}
+	}
+}
+
+// rewriteXML copies an XML document, passing each element directly inside
+// the root element to keep, and attributes of the root element to rootAttr
+func rewriteXML(reader io.Reader, writer io.Writer, rootAttr func([]xml.Attr), keep func(*xmlElement) bool) error {
+	decoder := xml.NewDecoder(reader)
+	w := bufio.NewWriter(writer)
+	inRoot := false
+	// whitespace before an element is only written if the element is kept
+	var pending []xml.CharData
+	for {
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			if !inRoot {
+				start := t.Copy()
+				if rootAttr != nil {
+					rootAttr(start.Attr)
+				}
+				writeStartElement(w, start.Name, start.Attr, false)
+				inRoot = true
+				continue
+			}
+			element, err := readElement(decoder, t.Copy())
+			if err != nil {
+				return err
+			}
+			if keep(element) {
+				for _, data := range pending {
+					writeToken(w, data)
+				}
+				writeXMLElement(w, element)
+			}
+			pending = nil
+		case xml.EndElement:
+			for _, data := range pending {
+				writeToken(w, data)
+			}
+			pending = nil
+			writeToken(w, t)
+			inRoot = false
+		case xml.CharData:
+			if inRoot {
+				pending = append(pending, t.Copy())
+			} else {
+				writeToken(w, t)
+			}
+		default:
+			for _, data := range pending {
+				writeToken(w, data)
+			}
+			pending = nil
+			writeToken(w, token)
+		}
+	}
+	return w.Flush()
+}
+
+var (
+	textEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+	attrEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;",
+		"\n", "&#xA;", "\r", "&#xD;", "\t", "&#x9;")
+)
+
+func prefixedName(name xml.Name) string {
+	if name.Space == "" {
+		return name.Local
+	}
+	return name.Space + ":" + name.Local
+}
+
+func writeStartElement(w *bufio.Writer, name xml.Name, attrs []xml.Attr, empty bool) {
+	w.WriteString("<" + prefixedName(name))
+	for _, attr := range attrs {
+		w.WriteString(" " + prefixedName(attr.Name) + `="` + attrEscaper.Replace(attr.Value) + `"`)
+	}
+	if empty {
+		w.WriteString("/>")
+	} else {
+		w.WriteString(">")
+	}
+}
+
+func writeXMLElement(w *bufio.Writer, element *xmlElement) {
+	if len(element.Children) == 0 {
+		writeStartElement(w, element.Name, element.Attr, true)
+		return
+	}
+	writeStartElement(w, element.Name, element.Attr, false)
+	for _, child := range element.Children {
+		if childElement, ok := child.(*xmlElement); ok {
+			writeXMLElement(w, childElement)
+		} else {
+			writeToken(w, child)
+		}
+	}
+	w.WriteString("</" + prefixedName(element.Name) + ">")
+}
+
+func writeToken(w *bufio.Writer, token any) {
+	switch t := token.(type) {
+	case xml.CharData:
+		w.WriteString(textEscaper.Replace(string(t)))
+	case xml.EndElement:
+		w.WriteString("</" + prefixedName(t.Name) + ">")
+	case xml.Comment:
+		w.WriteString("<!--" + string(t) + "-->")
+	case xml.ProcInst:
+		w.WriteString("<?" + t.Target + " " + string(t.Inst) + "?>")
+	case xml.Directive:
+		w.WriteString("<!" + string(t) + ">")
+	}
+}
+
+// packageSet describes the packages of a filtered repo
+type packageSet struct {
+	// pkgids are checksums of synced packages
+	pkgids map[string]bool
+	// nevras are name-epoch:version-release.arch of synced packages
+	nevras map[string]bool
+	// removedNames are names of packages in the repo none of which is synced
+	removedNames map[string]bool
+}
+
+// newPackageSet returns the set of kept packages, out of all packages in a repo
+func newPackageSet(all []XMLPackage, kept []XMLPackage) *packageSet {
+	packages := &packageSet{pkgids: map[string]bool{}, nevras: map[string]bool{}, removedNames: map[string]bool{}}
+	keptNames := map[string]bool{}
+	for _, pack := range kept {
+		packages.pkgids[pack.Checksum.Checksum] = true
+		packages.nevras[nevra(pack.Name, pack.Version.Epoch, pack.Version.Ver, pack.Version.Rel, pack.Arch)] = true
+		keptNames[pack.Name] = true
+	}
+	for _, pack := range all {
+		if !keptNames[pack.Name] {
+			packages.removedNames[pack.Name] = true
+		}
+	}
+	return packages
+}
+
+// nevra returns the name-epoch:version-release.arch of a package, as used in
+// modules.yaml
+func nevra(name string, epoch string, version string, release string, arch string) string {
+	if epoch == "" {
+		epoch = "0"
+	}
+	return name + "-" + epoch + ":" + version + "-" + release + "." + arch
+}
+
+// metadataFilter copies a metadata file, leaving out references to packages
+// that are not synced
+type metadataFilter func(reader io.Reader, writer io.Writer, packages *packageSet) error
+
+// filterFor returns the filter for a type of metadata, nil if the type
+// is not known
+func filterFor(metadataType string) metadataFilter {
+	switch {
+	case metadataType == "primary" || metadataType == "filelists" || metadataType == "filelists-ext" || metadataType == "other":
+		return filterPackageList
+	case strings.HasPrefix(metadataType, "susedata"):
+		return filterPackageList
+	case metadataType == "updateinfo":
+		return filterUpdateinfo
+	case metadataType == "group" || metadataType == "group_gz":
+		return filterComps
+	case metadataType == "patterns":
+		return filterPatterns
+	case metadataType == "deltainfo" || metadataType == "prestodelta":
+		return filterDeltainfo
+	case metadataType == "modules":
+		return filterModules
+	}
+	return nil
+}
+
+// packagePkgid returns the pkgid of a <package> in primary, filelists, other
+// or susedata: its pkgid attribute, or its checksum in primary
+func packagePkgid(element *xmlElement) string {
+	if pkgid := element.attr("pkgid"); pkgid != "" {
+		return pkgid
+	}
+	return element.childText("checksum")
+}
+
+// filterPackageList filters metadata with one <package> per package, identified
+// by pkgid
+func filterPackageList(reader io.Reader, writer io.Writer, packages *packageSet) error {
+	rootAttr := func(attrs []xml.Attr) {
+		setAttr(attrs, "packages", strconv.Itoa(len(packages.pkgids)))
+	}
+	return rewriteXML(reader, writer, rootAttr, func(element *xmlElement) bool {
+		return element.Name.Local != "package" || packages.pkgids[packagePkgid(element)]
+	})
+}
+
+// updatePackage is a <package> in the <pkglist> of an advisory in updateinfo.xml
+type updatePackage struct {
+	Name     string
+	Epoch    string
+	Version  string
+	Release  string
+	Arch     string
+	Filename string
+}
+
+func parseUpdatePackage(element *xmlElement) updatePackage {
+	return updatePackage{
+		Name:     element.attr("name"),
+		Epoch:    element.attr("epoch"),
+		Version:  element.attr("version"),
+		Release:  element.attr("release"),
+		Arch:     element.attr("arch"),
+		Filename: element.childText("filename"),
+	}
+}
+
+func (p updatePackage) nevra() string {
+	return nevra(p.Name, p.Epoch, p.Version, p.Release, p.Arch)
+}
+
+// filterUpdateinfo keeps packages of advisories that are synced, and only
+// advisories with such packages
+func filterUpdateinfo(reader io.Reader, writer io.Writer, packages *packageSet) error {
+	return rewriteXML(reader, writer, nil, func(update *xmlElement) bool {
+		if update.Name.Local != "update" {
+			return true
+		}
+		listed, kept := 0, 0
+		for _, pkglist := range update.children("pkglist") {
+			for _, collection := range pkglist.children("collection") {
+				collection.removeChildren(func(element *xmlElement) bool {
+					if element.Name.Local != "package" {
+						return false
+					}
+					listed++
+					if packages.nevras[parseUpdatePackage(element).nevra()] {
+						kept++
+						return false
+					}
+					return true
+				})
+			}
+			pkglist.removeChildren(func(collection *xmlElement) bool {
+				return collection.Name.Local == "collection" && len(collection.children("package")) == 0
+			})
+		}
+		return listed == 0 || kept > 0
+	})
+}
+
+// filterComps removes package requirements of groups that refer to packages
+// that are not synced
+func filterComps(reader io.Reader, writer io.Writer, packages *packageSet) error {
+	return rewriteXML(reader, writer, nil, func(group *xmlElement) bool {
+		for _, packagelist := range group.children("packagelist") {
+			packagelist.removeChildren(func(packagereq *xmlElement) bool {
+				return packagereq.Name.Local == "packagereq" && packages.removedNames[packagereq.text()]
+			})
+		}
+		return true
+	})
+}
+
+// filterPatterns removes dependencies of patterns on packages that are not
+// synced. Other dependencies, eg. on capabilities, are kept
+func filterPatterns(reader io.Reader, writer io.Writer, packages *packageSet) error {
+	return rewriteXML(reader, writer, nil, func(pattern *xmlElement) bool {
+		for _, child := range pattern.Children {
+			if dependencies, ok := child.(*xmlElement); ok && dependencies.Name.Space == "rpm" {
+				dependencies.removeChildren(func(entry *xmlElement) bool {
+					return entry.Name.Local == "entry" && packages.removedNames[entry.attr("name")]
+				})
+			}
+		}
+		return true
+	})
+}
+
+// deltaPackage is a <newpackage> in deltainfo.xml or prestodelta.xml, with
+// deltas to it from older versions
+type deltaPackage struct {
+	Name    string
+	Epoch   string
+	Version string
+	Release string
+	Arch    string
+	Deltas  []packageDelta
+}
+
+// packageDelta is a <delta> to a package
+type packageDelta struct {
+	Filename string
+	Checksum XMLChecksum
+	Size     int64
+}
+
+func parseDeltaPackage(element *xmlElement) deltaPackage {
+	result := deltaPackage{
+		Name:    element.attr("name"),
+		Epoch:   element.attr("epoch"),
+		Version: element.attr("version"),
+		Release: element.attr("release"),
+		Arch:    element.attr("arch"),
+	}
+	for _, delta := range element.children("delta") {
+		size, _ := strconv.ParseInt(delta.childText("size"), 10, 64)
+		var checksum XMLChecksum
+		for _, checksumElement := range delta.children("checksum") {
+			checksum = XMLChecksum{Type: checksumElement.attr("type"), Checksum: checksumElement.text()}
+		}
+		result.Deltas = append(result.Deltas, packageDelta{Filename: delta.childText("filename"), Checksum: checksum, Size: size})
+	}
+	return result
+}
+
+func (p deltaPackage) nevra() string {
+	return nevra(p.Name, p.Epoch, p.Version, p.Release, p.Arch)
+}
+
+// filterDeltainfo keeps deltas to packages that are synced
+func filterDeltainfo(reader io.Reader, writer io.Writer, packages *packageSet) error {
+	return deltainfoFilter(nil)(reader, writer, packages)
+}
+
+// deltainfoFilter returns a filter like filterDeltainfo, which also appends
+// kept packages to kept if not nil
+func deltainfoFilter(kept *[]deltaPackage) metadataFilter {
+	return func(reader io.Reader, writer io.Writer, packages *packageSet) error {
+		return rewriteXML(reader, writer, nil, func(element *xmlElement) bool {
+			if element.Name.Local != "newpackage" {
+				return true
+			}
+			target := parseDeltaPackage(element)
+			if !packages.nevras[target.nevra()] {
+				return false
+			}
+			if kept != nil {
+				*kept = append(*kept, target)
+			}
+			return true
+		})
+	}
+}
+
+// moduleArtifacts returns the packages of a module, listed in data.artifacts.rpms
+// of a modulemd document in modules.yaml, and whether there is such a list
+func moduleArtifacts(document yaml.MapSlice) (rpms []string, found bool) {
+	if documentType, _ := yamlValue(document, "document").(string); documentType != "modulemd" {
+		return nil, false
+	}
+	data, _ := yamlValue(document, "data").(yaml.MapSlice)
+	artifacts, _ := yamlValue(data, "artifacts").(yaml.MapSlice)
+	list, found := yamlValue(artifacts, "rpms").([]any)
+	for _, item := range list {
+		if rpm, ok := item.(string); ok {
+			rpms = append(rpms, rpm)
+		}
+	}
+	return
+}
+
+// setModuleArtifacts replaces data.artifacts.rpms of a modulemd document
+func setModuleArtifacts(document yaml.MapSlice, rpms []string) {
+	data, _ := yamlValue(document, "data").(yaml.MapSlice)
+	artifacts, _ := yamlValue(data, "artifacts").(yaml.MapSlice)
+	list := make([]any, len(rpms))
+	for i, rpm := range rpms {
+		list[i] = rpm
+	}
+	for i := range artifacts {
+		if artifacts[i].Key == "rpms" {
+			artifacts[i].Value = list
+		}
+	}
+}
+
+func yamlValue(mapping yaml.MapSlice, key string) any {
+	for _, item := range mapping {
+		if item.Key == key {
+			return item.Value
+		}
+	}
+	return nil
+}
+
+// filterModules keeps packages of modules that are synced, and only modules
+// with such packages
+func filterModules(reader io.Reader, writer io.Writer, packages *packageSet) error {
+	decoder := yaml.NewDecoder(reader)
+	encoder := yaml.NewEncoder(writer)
+	for {
+		var document yaml.MapSlice
+		err := decoder.Decode(&document)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if rpms, found := moduleArtifacts(document); found {
+			kept := []string{}
+			for _, rpm := range rpms {
+				if packages.nevras[rpm] {
+					kept = append(kept, rpm)
+				}
+			}
+			if len(kept) == 0 && len(rpms) > 0 {
+				continue
+			}
+			setModuleArtifacts(document, kept)
+		}
+		if err = encoder.Encode(document); err != nil {
+			return err
+		}
+	}
+	return encoder.Close()
+}
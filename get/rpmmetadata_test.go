@@ -0,0 +1,243 @@
+package get
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testPackageSet() *packageSet {
+	all := []XMLPackage{
+		{Name: "a", Arch: "x86_64", Version: XMLVersion{Epoch: "0", Ver: "1.0", Rel: "1"}, Checksum: XMLChecksum{Type: "sha256", Checksum: "aaa"}},
+		{Name: "a", Arch: "i586", Version: XMLVersion{Epoch: "0", Ver: "1.0", Rel: "1"}, Checksum: XMLChecksum{Type: "sha256", Checksum: "bbb"}},
+		{Name: "b", Arch: "i586", Version: XMLVersion{Epoch: "1", Ver: "2.0", Rel: "3"}, Checksum: XMLChecksum{Type: "sha256", Checksum: "ccc"}},
+	}
+	return newPackageSet(all, all[:1])
+}
+
+func filtered(t *testing.T, filter metadataFilter, input string) string {
+	var output bytes.Buffer
+	if err := filter(strings.NewReader(input), &output, testPackageSet()); err != nil {
+		t.Fatal(err)
+	}
+	return output.String()
+}
+
+func TestFilterPackageList(t *testing.T) {
+	input := `<?xml version="1.0" encoding="UTF-8"?>
+<metadata xmlns="http://linux.duke.edu/metadata/common" xmlns:rpm="http://linux.duke.edu/metadata/rpm" packages="2">
+<package type="rpm">
+  <name>a</name>
+  <checksum type="sha256" pkgid="YES">aaa</checksum>
+  <format><rpm:license>MIT &amp; BSD</rpm:license><rpm:provides/></format>
+</package>
+<!-- a comment -->
+<package type="rpm">
+  <name>a</name>
+  <checksum type="sha256" pkgid="YES">bbb</checksum>
+</package>
+</metadata>
+`
+	expected := `<?xml version="1.0" encoding="UTF-8"?>
+<metadata xmlns="http://linux.duke.edu/metadata/common" xmlns:rpm="http://linux.duke.edu/metadata/rpm" packages="1">
+<package type="rpm">
+  <name>a</name>
+  <checksum type="sha256" pkgid="YES">aaa</checksum>
+  <format><rpm:license>MIT &amp; BSD</rpm:license><rpm:provides/></format>
+</package>
+<!-- a comment -->
+</metadata>
+`
+	assert.Equal(t, expected, filtered(t, filterPackageList, input))
+
+	input = `<filelists packages="2"><package pkgid="bbb" name="a" arch="i586"/><package pkgid="aaa" name="a" arch="x86_64"><file>/a</file></package></filelists>`
+	expected = `<filelists packages="1"><package pkgid="aaa" name="a" arch="x86_64"><file>/a</file></package></filelists>`
+	assert.Equal(t, expected, filtered(t, filterPackageList, input))
+}
+
+func TestFilterUpdateinfo(t *testing.T) {
+	input := `<updates>
+  <update type="security">
+    <id>kept</id>
+    <pkglist>
+      <collection>
+        <package name="a" epoch="0" version="1.0" release="1" arch="i586"><filename>a-1.0-1.i586.rpm</filename></package>
+        <package name="a" epoch="0" version="1.0" release="1" arch="x86_64"><filename>a-1.0-1.x86_64.rpm</filename></package>
+      </collection>
+      <collection>
+        <package name="b" epoch="1" version="2.0" release="3" arch="i586"><filename>b-2.0-3.i586.rpm</filename></package>
+      </collection>
+    </pkglist>
+  </update>
+  <update type="recommended">
+    <id>dropped</id>
+    <pkglist><collection><package name="b" epoch="1" version="2.0" release="3" arch="i586"/></collection></pkglist>
+  </update>
+  <update type="optional">
+    <id>without packages</id>
+  </update>
+</updates>`
+	expected := `<updates>
+  <update type="security">
+    <id>kept</id>
+    <pkglist>
+      <collection>
+        <package name="a" epoch="0" version="1.0" release="1" arch="x86_64"><filename>a-1.0-1.x86_64.rpm</filename></package>
+      </collection>
+    </pkglist>
+  </update>
+  <update type="optional">
+    <id>without packages</id>
+  </update>
+</updates>`
+	assert.Equal(t, expected, filtered(t, filterUpdateinfo, input))
+}
+
+func TestFilterComps(t *testing.T) {
+	input := `<comps>
+  <group>
+    <id>g</id>
+    <packagelist>
+      <packagereq type="default">a</packagereq>
+      <packagereq type="optional">b</packagereq>
+      <packagereq type="optional">elsewhere</packagereq>
+    </packagelist>
+  </group>
+</comps>`
+	expected := `<comps>
+  <group>
+    <id>g</id>
+    <packagelist>
+      <packagereq type="default">a</packagereq>
+      <packagereq type="optional">elsewhere</packagereq>
+    </packagelist>
+  </group>
+</comps>`
+	assert.Equal(t, expected, filtered(t, filterComps, input))
+}
+
+func TestFilterPatterns(t *testing.T) {
+	input := `<patterns xmlns="http://novell.com/package/metadata/suse/pattern" xmlns:rpm="http://linux.duke.edu/metadata/rpm" count="1">
+  <pattern>
+    <name>p</name>
+    <rpm:requires>
+      <rpm:entry name="a"/>
+      <rpm:entry name="b"/>
+      <rpm:entry name="pattern() = base"/>
+    </rpm:requires>
+  </pattern>
+</patterns>`
+	expected := `<patterns xmlns="http://novell.com/package/metadata/suse/pattern" xmlns:rpm="http://linux.duke.edu/metadata/rpm" count="1">
+  <pattern>
+    <name>p</name>
+    <rpm:requires>
+      <rpm:entry name="a"/>
+      <rpm:entry name="pattern() = base"/>
+    </rpm:requires>
+  </pattern>
+</patterns>`
+	assert.Equal(t, expected, filtered(t, filterPatterns, input))
+}
+
+func TestFilterDeltainfo(t *testing.T) {
+	input := `<deltainfo>
+  <newpackage name="a" epoch="0" version="1.0" release="1" arch="x86_64">
+    <delta oldepoch="0" oldversion="0.9" oldrelease="1">
+      <filename>x86_64/a-0.9-1_1.0-1.x86_64.drpm</filename>
+      <sequence>a-0.9-1-abc</sequence>
+      <size>123</size>
+      <checksum type="sha256">ddd</checksum>
+    </delta>
+  </newpackage>
+  <newpackage name="b" epoch="1" version="2.0" release="3" arch="i586"/>
+</deltainfo>`
+	expected := `<deltainfo>
+  <newpackage name="a" epoch="0" version="1.0" release="1" arch="x86_64">
+    <delta oldepoch="0" oldversion="0.9" oldrelease="1">
+      <filename>x86_64/a-0.9-1_1.0-1.x86_64.drpm</filename>
+      <sequence>a-0.9-1-abc</sequence>
+      <size>123</size>
+      <checksum type="sha256">ddd</checksum>
+    </delta>
+  </newpackage>
+</deltainfo>`
+	assert.Equal(t, expected, filtered(t, filterDeltainfo, input))
+}
+
+func TestFilterModules(t *testing.T) {
+	input := `---
+document: modulemd
+version: 2
+data:
+  name: kept
+  stream: "1.0"
+  artifacts:
+    rpms:
+    - a-0:1.0-1.i586
+    - a-0:1.0-1.x86_64
+...
+---
+document: modulemd
+version: 2
+data:
+  name: dropped
+  stream: "1.0"
+  artifacts:
+    rpms:
+    - b-1:2.0-3.i586
+...
+---
+document: modulemd-defaults
+version: 1
+data:
+  module: kept
+  stream: "1.0"
+...
+`
+	expected := `document: modulemd
+version: 2
+data:
+  name: kept
+  stream: "1.0"
+  artifacts:
+    rpms:
+    - a-0:1.0-1.x86_64
+---
+document: modulemd-defaults
+version: 1
+data:
+  module: kept
+  stream: "1.0"
+`
+	assert.Equal(t, expected, filtered(t, filterModules, input))
+}
+
+func TestValidateData(t *testing.T) {
+	sha256 := strings.Repeat("ab", 32)
+	valid := XMLData{Type: "primary", Location: XMLLocation{Href: "repodata/primary.xml.gz"}, Checksum: XMLChecksum{Type: "sha256", Checksum: sha256}}
+	assert.NoError(t, validateData(valid))
+
+	withOpenChecksum := valid
+	withOpenChecksum.OpenChecksum = XMLChecksum{Type: "sha256", Checksum: sha256}
+	assert.NoError(t, validateData(withOpenChecksum))
+
+	for _, href := range []string{"", "/etc/passwd", "../outside.xml.gz", "repodata/../../outside.xml.gz", "https://example.com/primary.xml.gz"} {
+		invalid := valid
+		invalid.Location.Href = href
+		assert.Error(t, validateData(invalid), href)
+	}
+	for _, checksum := range []XMLChecksum{{Type: "crc32", Checksum: "abcd"}, {Type: "sha256", Checksum: "abcd"}, {Type: "sha256", Checksum: strings.Repeat("zz", 32)}} {
+		invalid := valid
+		invalid.Checksum = checksum
+		assert.Error(t, validateData(invalid), checksum)
+
+		invalid = valid
+		invalid.OpenChecksum = checksum
+		assert.Error(t, validateData(invalid), checksum)
+	}
+	invalid := valid
+	invalid.Size = -1
+	assert.Error(t, validateData(invalid))
+}
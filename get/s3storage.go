@@ -4,11 +4,13 @@ import (
 	"crypto"
 	"errors"
 	"io"
-	"log"
+	"log/slog"
+	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
@@ -17,34 +19,143 @@ import (
 
 // S3Storage allows to store data in an Amazon S3 bucket
 type S3Storage struct {
-	region string
-	bucket string
-	prefix string
-	svc    *s3.S3
+	region  string
+	bucket  string
+	prefix  string
+	svc     *s3.S3
+	options S3Options
 }
 
+// S3Options holds optional settings of an S3Storage
+type S3Options struct {
+	// AccessKeyID and SecretAccessKey are static credentials. If empty, the
+	// default AWS credential chain is used (environment variables, shared
+	// config and profiles, web identity, EC2/ECS instance metadata)
+	AccessKeyID     string
+	SecretAccessKey string
+	// Profile selects a profile from the shared AWS config and credentials files
+	Profile string
+	// RoleARN is a role to assume with the credentials found above
+	RoleARN string
+
+	// options below are mostly useful to target S3-compatible services such
+	// as MinIO or Ceph RGW
+
+	// Endpoint overrides the default AWS endpoint, eg. http://localhost:9000
+	Endpoint string
+	// ForcePathStyle uses http://endpoint/bucket/key instead of http://bucket.endpoint/key URLs
+	ForcePathStyle bool
+	// DisableSSL uses plain HTTP to connect to the endpoint
+	DisableSSL bool
+	// SkipBucketCreation assumes the bucket already exists
+	SkipBucketCreation bool
+	// SkipWebsiteConfiguration does not use the bucket website configuration
+	// to publish the current prefix, a marker object is used instead
+	SkipWebsiteConfiguration bool
+
+	// UploadLimiter throttles uploads, optional
+	UploadLimiter *util.RateLimiter
+}
+
+// currentPrefixKey is the marker object storing the current prefix when the
+// bucket website configuration is not used
+const currentPrefixKey = "minima-current-prefix"
+
 // NewS3Storage returns a new Storage backed by an S3 bucket
-func NewS3Storage(accessKeyID string, secretAccessKey string, region string, bucket string) (storage Storage, err error) {
-	creds := credentials.NewStaticCredentials(accessKeyID, secretAccessKey, "")
-	config := aws.NewConfig().WithRegion(region).WithCredentials(creds)
-	svc := s3.New(session.New(), config)
+func NewS3Storage(region string, bucket string, options S3Options) (storage Storage, err error) {
+	config := aws.NewConfig().WithRegion(region).
+		WithS3ForcePathStyle(options.ForcePathStyle).
+		WithDisableSSL(options.DisableSSL)
+	if options.Endpoint != "" {
+		config = config.WithEndpoint(options.Endpoint)
+	}
+	if options.AccessKeyID != "" {
+		config = config.WithCredentials(credentials.NewStaticCredentials(options.AccessKeyID, options.SecretAccessKey, ""))
+	}
 
-	err = configureBucket(region, bucket, svc)
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            *config,
+		Profile:           options.Profile,
+		SharedConfigState: session.SharedConfigEnable,
+	})
 	if err != nil {
 		return
 	}
 
-	prefix, err := getCurrentPrefix(region, bucket, svc)
+	if options.RoleARN != "" {
+		config = config.WithCredentials(stscreds.NewCredentials(sess, options.RoleARN))
+	}
+	svc := s3.New(sess, config)
+
+	if !options.SkipBucketCreation {
+		err = configureBucket(region, bucket, svc)
+		if err != nil {
+			return
+		}
+	}
+
+	s := &S3Storage{region: region, bucket: bucket, svc: svc, options: options}
+	if options.SkipWebsiteConfiguration {
+		s.prefix, err = s.readPrefixMarker()
+		if err != nil {
+			return
+		}
+	} else {
+		s.prefix, err = getCurrentPrefix(region, bucket, svc)
+		if err != nil {
+			return
+		}
+
+		err = configureWebsite(region, bucket, s.prefix, svc)
+		if err != nil {
+			return
+		}
+	}
+
+	storage = s
+	return
+}
+
+// isNotFound returns true if err signals a missing object
+func isNotFound(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case "NotFound", s3.ErrCodeNoSuchKey:
+			return true
+		}
+	}
+	return false
+}
+
+// readPrefixMarker returns the current prefix from the marker object, or an
+// empty prefix if the marker does not exist yet
+func (s *S3Storage) readPrefixMarker() (prefix string, err error) {
+	info, err := s.svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(currentPrefixKey),
+	})
 	if err != nil {
+		if isNotFound(err) {
+			return "", nil
+		}
 		return
 	}
+	defer info.Body.Close()
 
-	err = configureWebsite(region, bucket, prefix, svc)
+	content, err := io.ReadAll(info.Body)
 	if err != nil {
 		return
 	}
+	return strings.TrimSpace(string(content)), nil
+}
 
-	storage = &S3Storage{region, bucket, prefix, svc}
+// writePrefixMarker stores the current prefix in the marker object
+func (s *S3Storage) writePrefixMarker(prefix string) (err error) {
+	_, err = s.svc.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(currentPrefixKey),
+		Body:   strings.NewReader(prefix),
+	})
 	return
 }
 
@@ -74,7 +185,7 @@ func configureBucket(region string, bucket string, svc *s3.S3) error {
 			return err
 		}
 	}
-	log.Printf("Bucket %s created\n", bucket)
+	slog.Info("Bucket created", "bucket", bucket)
 	return nil
 }
 
@@ -157,11 +268,8 @@ func (s *S3Storage) NewReader(filename string, location Location) (reader io.Rea
 
 	info, err := s.svc.GetObject(input)
 	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			case "NotFound":
-				err = ErrFileNotFound
-			}
+		if isNotFound(err) {
+			err = ErrFileNotFound
 		}
 		return
 	}
@@ -176,17 +284,30 @@ func (s *S3Storage) StoringMapper(filename string, checksum string, hash crypto.
 
 		pipeReader, pipeWriter := io.Pipe()
 
+		input := &s3manager.UploadInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(s.newPrefix() + filename),
+			Body:   util.NewLimitedReadCloser(pipeReader, s.options.UploadLimiter),
+		}
+		if hash != 0 {
+			// the object is deleted on close if the checksum turns out not to match
+			input.Metadata = map[string]*string{checksumMetadataKey: aws.String(checksumMetadata(hash, checksum))}
+		}
+
 		errs := make(chan error)
 		go func() {
-			_, err := uploader.Upload(&s3manager.UploadInput{
-				Bucket: aws.String(s.bucket),
-				Key:    aws.String(s.newPrefix() + filename),
-				Body:   pipeReader,
-			})
+			_, err := uploader.Upload(input)
 			errs <- err
 		}()
 
-		result = util.NewTeeReadCloser(reader, &waitingCloser{pipeWriter, errs, filename})
+		writer := util.NewChecksummingWriter(&waitingCloser{pipeWriter, errs, filename}, checksum, hash)
+		result = util.NewTeeReadCloser(reader, &deletingCloser{writer, func() error {
+			_, err := s.svc.DeleteObject(&s3.DeleteObjectInput{
+				Bucket: aws.String(s.bucket),
+				Key:    aws.String(s.newPrefix() + filename),
+			})
+			return err
+		}})
 		return
 	}
 }
@@ -206,6 +327,40 @@ func (w *waitingCloser) Close() error {
 	return err
 }
 
+// Checksum returns the checksum of a file in a location. The checksum stored
+// in the object metadata at upload time is used if available, otherwise the
+// object is downloaded
+func (s *S3Storage) Checksum(filename string, location Location, hash crypto.Hash) (checksum string, err error) {
+	prefix := s.prefix
+	if location == Temporary {
+		prefix = s.newPrefix()
+	}
+
+	head, err := s.svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(prefix + filename),
+	})
+	if err != nil {
+		if isNotFound(err) {
+			err = ErrFileNotFound
+		}
+		return
+	}
+
+	if value, found := head.Metadata[checksumMetadataKey]; found && value != nil {
+		if cached, ok := parseChecksumMetadata(*value, hash); ok {
+			return cached, nil
+		}
+	}
+
+	reader, err := s.NewReader(filename, location)
+	if err != nil {
+		return
+	}
+	defer reader.Close()
+	return util.Checksum(reader, hash)
+}
+
 // Recycle will copy a file from the permanent to the temporary location
 func (s *S3Storage) Recycle(filename string) (err error) {
 	input := &s3.CopyObjectInput{
@@ -221,17 +376,29 @@ func (s *S3Storage) Recycle(filename string) (err error) {
 // Commit moves any temporary file accumulated so far to the permanent location
 func (s *S3Storage) Commit() (err error) {
 	newPrefix := s.newPrefix()
-	err = configureWebsite(s.region, s.bucket, newPrefix, s.svc)
+	if s.options.SkipWebsiteConfiguration {
+		err = s.writePrefixMarker(newPrefix)
+	} else {
+		err = configureWebsite(s.region, s.bucket, newPrefix, s.svc)
+	}
 	if err != nil {
 		return
 	}
 
+	oldPrefix := s.prefix
+	s.prefix = newPrefix
+	// on first sync there is no previous prefix, and listing the empty prefix
+	// would delete the newly committed objects
+	if oldPrefix == "" {
+		return
+	}
+
 	batcher := s3manager.NewBatchDeleteWithClient(s.svc)
 	objectsToDelete := true
 	for objectsToDelete {
 		input := &s3.ListObjectsV2Input{
 			Bucket: aws.String(s.bucket),
-			Prefix: aws.String(s.prefix),
+			Prefix: aws.String(oldPrefix),
 		}
 
 		objects, err := s.svc.ListObjectsV2(input)
@@ -0,0 +1,34 @@
+package get
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestS3Storage runs against an S3-compatible service, eg. a local MinIO:
+//
+//	docker run -p 9000:9000 minio/minio server /data
+//	MINIMA_TEST_S3_ENDPOINT=http://localhost:9000 MINIMA_TEST_S3_ACCESS_KEY_ID=minioadmin \
+//	  MINIMA_TEST_S3_SECRET_ACCESS_KEY=minioadmin go test ./get -run TestS3Storage
+func TestS3Storage(t *testing.T) {
+	endpoint := os.Getenv("MINIMA_TEST_S3_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("MINIMA_TEST_S3_ENDPOINT not set")
+	}
+
+	options := S3Options{
+		AccessKeyID:              os.Getenv("MINIMA_TEST_S3_ACCESS_KEY_ID"),
+		SecretAccessKey:          os.Getenv("MINIMA_TEST_S3_SECRET_ACCESS_KEY"),
+		Endpoint:                 endpoint,
+		ForcePathStyle:           true,
+		DisableSSL:               strings.HasPrefix(endpoint, "http://"),
+		SkipWebsiteConfiguration: true,
+	}
+	storage, err := NewS3Storage("us-east-1", "minima-test", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testStorage(t, storage)
+}
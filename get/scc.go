@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"regexp"
 	"strings"
@@ -21,12 +22,54 @@ type SCC struct {
 type SCCReposConfig struct {
 	Names []string
 	Archs []string
+	// Path is a template for the path repos are stored at, see RepoPath
+	Path string
+	// Storage overrides the global storage for these repos
+	Storage *StorageConfig
+	// MaxBandwidth limits downloads of each of these repos, in addition to the global limit
+	MaxBandwidth Bandwidth `yaml:"max_bandwidth"`
 }
 
 // HTTPRepoConfig defines the configuration of an HTTP repo
 type HTTPRepoConfig struct {
 	URL   string
 	Archs []string
+	// Type is the registered name of the repo type, auto-detected if empty or auto
+	Type string
+	// Keys are paths of public keys trusted to sign metadata of apk (PEM) and
+	// pacman (OpenPGP) repos
+	Keys []string
+	// Name is the repo name, defaults to the last element of the URL path
+	Name string
+	// RegenerateMetadata rewrites rpm metadata to only refer to synced packages
+	RegenerateMetadata bool `yaml:"regenerate_metadata"`
+	// DeltaRPMs also syncs delta rpms of synced packages
+	DeltaRPMs bool `yaml:"delta_rpms"`
+	// Sources sets whether source packages are synced: include, exclude or only
+	Sources PackagePolicy
+	// Debuginfo sets whether debugging information packages are synced:
+	// include, exclude or only
+	Debuginfo PackagePolicy
+	// VerifyAllChecksums verifies files against all the checksums listed in
+	// metadata, not only one
+	VerifyAllChecksums bool `yaml:"verify_all_checksums"`
+	// IncludeIndexes are patterns of indexes to sync, by default all of them
+	IncludeIndexes []string `yaml:"include_indexes"`
+	// ExcludeIndexes are patterns of indexes not to sync
+	ExcludeIndexes []string `yaml:"exclude_indexes"`
+	// SigningKey is the path of an armored OpenPGP private key signing
+	// metadata rewritten by minima
+	SigningKey string `yaml:"signing_key"`
+	// Mirrorlist is the URL of a list of mirrors, one base URL per line
+	Mirrorlist string
+	// Metalink is the URL of a metalink for repodata/repomd.xml
+	Metalink string
+	// Path is a template for the path the repo is stored at, see RepoPath
+	Path string
+	// Storage overrides the global storage for this repo
+	Storage *StorageConfig
+	// MaxBandwidth limits downloads of this repo, in addition to the global limit
+	MaxBandwidth Bandwidth `yaml:"max_bandwidth"`
 }
 
 // Repo represents the JSON entry for a repository as retuned by SCC API
@@ -37,8 +80,8 @@ type Repo struct {
 	DistroTarget string `json:"distro_target"`
 }
 
-// maps a repo name to the available archs for it
-type sccMap map[string][]string
+// maps a repo name to its configuration
+type sccMap map[string]SCCReposConfig
 
 // SCCToHTTPConfigs returns HTTPS repos configurations (URL and archs) for repos in SCC
 func SCCToHTTPConfigs(baseURL string, username string, password string, sccConfigs []SCCReposConfig, quiet bool) ([]HTTPRepoConfig, error) {
@@ -50,7 +93,7 @@ func SCCToHTTPConfigs(baseURL string, username string, password string, sccConfi
 	sccEntries := make(sccMap)
 	for _, config := range sccConfigs {
 		for _, name := range config.Names {
-			sccEntries[name] = config.Archs
+			sccEntries[name] = config
 		}
 	}
 
@@ -58,7 +101,7 @@ func SCCToHTTPConfigs(baseURL string, username string, password string, sccConfi
 	var err error
 	next := baseURL + "/connect/organizations/repositories"
 
-	fmt.Println("Checking available SCC repositories ...")
+	slog.Info("Checking available SCC repositories")
 	for {
 		page, next, err = downloadPaged(next, token)
 		if err != nil {
@@ -73,7 +116,7 @@ func SCCToHTTPConfigs(baseURL string, username string, password string, sccConfi
 
 		for _, repo := range repos {
 			if !quiet {
-				fmt.Printf("  %s: %s\n", repo.Name, repo.Description)
+				slog.Info("SCC repository found", "name", repo.Name, "description", repo.Description)
 			}
 
 			config, ok := getHTTPConfig(repo.Name, repo.Description, repo.URL, sccEntries)
@@ -99,15 +142,19 @@ func getHTTPConfig(name, description, url string, sccEntries sccMap) (HTTPRepoCo
 		Archs: []string{},
 	}
 
-	repoArchs, ok := sccEntries[name]
+	sccConfig, ok := sccEntries[name]
 	if ok {
-		for _, arch := range repoArchs {
+		for _, arch := range sccConfig.Archs {
 			if strings.Contains(description, arch) {
 				httpConfig.Archs = append(httpConfig.Archs, arch)
 			}
 		}
 		if len(httpConfig.Archs) > 0 {
 			httpConfig.URL = url
+			httpConfig.Name = name
+			httpConfig.Path = sccConfig.Path
+			httpConfig.Storage = sccConfig.Storage
+			httpConfig.MaxBandwidth = sccConfig.MaxBandwidth
 			return httpConfig, true
 		}
 	}
@@ -128,7 +175,7 @@ func downloadPaged(url string, token string) (page []byte, next string, err erro
 	}
 
 	if resp.StatusCode != 200 {
-		err = &UnexpectedStatusCodeError{url, resp.StatusCode}
+		err = &UnexpectedStatusCodeError{URL: url, StatusCode: resp.StatusCode}
 		return
 	}
 
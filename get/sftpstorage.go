@@ -0,0 +1,457 @@
+package get
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/uyuni-project/minima/util"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SFTPStorage allows to store data in a directory of a remote host over SFTP.
+// The layout is the same as FileStorage's, with "-in-progress" and "-old"
+// sibling directories swapped by renaming on Commit
+type SFTPStorage struct {
+	directory string
+	address   string
+	config    *ssh.ClientConfig
+	cache     *checksumCache
+
+	// agentSocket is the SSH agent socket, if keys from the agent are used
+	agentSocket string
+
+	// mutex guards the connection, shared by concurrent downloads
+	mutex     sync.Mutex
+	agentConn net.Conn
+	sshClient *ssh.Client
+	client    *sftp.Client
+}
+
+// SFTPOptions holds the connection settings of an SFTPStorage
+type SFTPOptions struct {
+	// Host is the remote host, optionally followed by a port (default 22)
+	Host string
+	// User is the remote user name
+	User string
+	// KeyFile is a private key file. Keys from the SSH agent at $SSH_AUTH_SOCK,
+	// if any, are tried as well
+	KeyFile string
+	// KeyPassphrase decrypts KeyFile, if encrypted
+	KeyPassphrase string
+	// KnownHostsFile is used to verify the host key, defaults to ~/.ssh/known_hosts
+	KnownHostsFile string
+}
+
+// NewSFTPStorage returns a new Storage given a directory on a remote host.
+// The connection is established on first use and closed on Commit
+func NewSFTPStorage(directory string, options SFTPOptions) (storage Storage, err error) {
+	s := &SFTPStorage{directory: path.Clean(directory)}
+	auth := []ssh.AuthMethod{}
+	if options.KeyFile != "" {
+		key, err := os.ReadFile(options.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		var signer ssh.Signer
+		if options.KeyPassphrase != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(options.KeyPassphrase))
+		} else {
+			signer, err = ssh.ParsePrivateKey(key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot read private key %s: %v", options.KeyFile, err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+		// a stale agent socket, eg. under cron, should not prevent using the key file
+		connection, err := net.Dial("unix", socket)
+		if err != nil {
+			if len(auth) == 0 {
+				return nil, fmt.Errorf("cannot connect to SSH agent: %v", err)
+			}
+			slog.Warn("Cannot connect to SSH agent, using the key file only", "socket", socket, "error", err)
+		} else {
+			s.agentSocket = socket
+			s.agentConn = connection
+			auth = append(auth, ssh.PublicKeysCallback(s.agentSigners))
+		}
+	}
+	if len(auth) == 0 {
+		return nil, errors.New("SFTP storage needs a key file or a running SSH agent")
+	}
+	defer func() {
+		if err != nil && s.agentConn != nil {
+			s.agentConn.Close()
+		}
+	}()
+
+	knownHostsFile := options.KnownHostsFile
+	if knownHostsFile == "" {
+		var home string
+		home, err = os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read known hosts: %v", err)
+	}
+
+	address := options.Host
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "22")
+	}
+
+	// checksums of remote files are cached locally, as reading them back is expensive
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		cacheDir = os.TempDir()
+	}
+	cachePath := filepath.Join(cacheDir, "minima", "sftp", options.User+"@"+address, filepath.FromSlash(directory)+"-in-progress.checksums")
+	err = os.MkdirAll(filepath.Dir(cachePath), 0755)
+	if err != nil {
+		return
+	}
+
+	s.address = address
+	s.config = &ssh.ClientConfig{
+		User:            options.User,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         30 * time.Second,
+	}
+	s.cache = newChecksumCache(cachePath)
+	storage = s
+	return
+}
+
+// agentSigners returns the keys of the SSH agent, connecting to it again if
+// the connection was closed. It is called while connecting, with the mutex held
+func (s *SFTPStorage) agentSigners() ([]ssh.Signer, error) {
+	if s.agentConn == nil {
+		connection, err := net.Dial("unix", s.agentSocket)
+		if err != nil {
+			return nil, err
+		}
+		s.agentConn = connection
+	}
+	return agent.NewClient(s.agentConn).Signers()
+}
+
+// connect returns an SFTP client, connecting if needed
+func (s *SFTPStorage) connect() (client *sftp.Client, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.client != nil {
+		return s.client, nil
+	}
+
+	sshClient, err := ssh.Dial("tcp", s.address, s.config)
+	if err != nil {
+		return
+	}
+	client, err = sftp.NewClient(sshClient)
+	if err != nil {
+		sshClient.Close()
+		return
+	}
+	s.sshClient = sshClient
+	s.client = client
+	return
+}
+
+// disconnect closes the connection and the one to the SSH agent, if any
+func (s *SFTPStorage) disconnect() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.client != nil {
+		s.client.Close()
+		s.sshClient.Close()
+		s.client = nil
+		s.sshClient = nil
+	}
+	if s.agentConn != nil {
+		s.agentConn.Close()
+		s.agentConn = nil
+	}
+}
+
+func (s *SFTPStorage) fullPath(filename string, location Location) string {
+	if location == Permanent {
+		return path.Join(s.directory, filename)
+	}
+	return path.Join(s.directory+"-in-progress", filename)
+}
+
+// NewReader returns a Reader for a file in a location, returns ErrFileNotFound
+// if the requested path was not found at all
+func (s *SFTPStorage) NewReader(filename string, location Location) (reader io.ReadCloser, err error) {
+	client, err := s.connect()
+	if err != nil {
+		return
+	}
+
+	f, err := client.Open(s.fullPath(filename, location))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = ErrFileNotFound
+		}
+		return
+	}
+	return f, nil
+}
+
+// StoringMapper returns a mapper that will store read data to a temporary location specified by filename
+func (s *SFTPStorage) StoringMapper(filename string, checksum string, hash crypto.Hash) util.ReaderMapper {
+	return func(reader io.ReadCloser) (result io.ReadCloser, err error) {
+		client, err := s.connect()
+		if err != nil {
+			return
+		}
+
+		fullPath := s.fullPath(filename, Temporary)
+		err = client.MkdirAll(path.Dir(fullPath))
+		if err != nil {
+			return
+		}
+
+		// identities of remote files might not change when they are rewritten
+		if cerr := s.cache.remove(filename); cerr != nil {
+			slog.Warn("Cannot remove cached checksum", "file", filename, "error", cerr)
+		}
+		file, err := client.Create(fullPath)
+		if err != nil {
+			return
+		}
+
+		writer := util.NewChecksummingWriter(file, checksum, hash)
+		result = util.NewTeeReadCloser(reader, &sftpCachingWriter{writer, s, filename, fullPath, hash})
+		return
+	}
+}
+
+// sftpCachingWriter records the checksum of a fully written and verified
+// remote file in the local checksum cache
+type sftpCachingWriter struct {
+	*util.ChecksummingWriter
+	storage  *SFTPStorage
+	filename string
+	fullPath string
+	hash     crypto.Hash
+}
+
+// Close closes the underlying ChecksummingWriter and records the checksum.
+// Failing to record it does not make the written file invalid
+func (w *sftpCachingWriter) Close() (err error) {
+	err = w.ChecksummingWriter.Close()
+	if err != nil || w.hash == 0 {
+		return
+	}
+	client, cerr := w.storage.connect()
+	if cerr != nil {
+		slog.Warn("Cannot cache checksum", "file", w.filename, "error", cerr)
+		return
+	}
+	info, cerr := client.Stat(w.fullPath)
+	if cerr != nil {
+		slog.Warn("Cannot cache checksum", "file", w.filename, "error", cerr)
+		return
+	}
+	if cerr := w.storage.cache.add(w.filename, fileIdentity(info), w.hash, w.Sum()); cerr != nil {
+		slog.Warn("Cannot cache checksum", "file", w.filename, "error", cerr)
+	}
+	return
+}
+
+// Checksum returns the checksum of a file in a location. Checksums of files
+// in the temporary location are cached locally
+func (s *SFTPStorage) Checksum(filename string, location Location, hash crypto.Hash) (checksum string, err error) {
+	client, err := s.connect()
+	if err != nil {
+		return
+	}
+
+	fullPath := s.fullPath(filename, location)
+	info, err := client.Stat(fullPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = ErrFileNotFound
+		}
+		return
+	}
+	identity := fileIdentity(info)
+
+	if location == Temporary {
+		if cached, found := s.cache.get(filename, identity, hash); found {
+			return cached, nil
+		}
+	}
+
+	f, err := client.Open(fullPath)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	checksum, err = util.Checksum(f, hash)
+	if err != nil {
+		return
+	}
+
+	if location == Temporary {
+		if cerr := s.cache.add(filename, identity, hash, checksum); cerr != nil {
+			slog.Warn("Cannot cache checksum", "file", filename, "error", cerr)
+		}
+	}
+	return
+}
+
+// Recycle will copy a file from the permanent to the temporary location,
+// using a remote hard link if the server supports it
+func (s *SFTPStorage) Recycle(filename string) (err error) {
+	client, err := s.connect()
+	if err != nil {
+		return
+	}
+
+	oldPath := s.fullPath(filename, Permanent)
+	newPath := s.fullPath(filename, Temporary)
+	err = client.MkdirAll(path.Dir(newPath))
+	if err != nil {
+		return
+	}
+
+	if _, err := client.Lstat(newPath); err == nil {
+		// ignore, we are fine already
+		return nil
+	}
+	if cerr := s.cache.remove(filename); cerr != nil {
+		slog.Warn("Cannot remove cached checksum", "file", filename, "error", cerr)
+	}
+
+	if _, supported := client.HasExtension("hardlink@openssh.com"); supported {
+		if err = client.Link(oldPath, newPath); err == nil {
+			return
+		}
+	}
+
+	// fall back to copying through this host
+	source, err := client.Open(oldPath)
+	if err != nil {
+		return
+	}
+	defer source.Close()
+
+	destination, err := client.Create(newPath)
+	if err != nil {
+		return
+	}
+	_, err = io.Copy(destination, source)
+	if err != nil {
+		destination.Close()
+		return
+	}
+	return destination.Close()
+}
+
+// Commit will take care of moving downloaded metadata and packages in the target
+// path, plus cleanup old or temporary files
+func (s *SFTPStorage) Commit() (err error) {
+	client, err := s.connect()
+	if err != nil {
+		return
+	}
+	defer s.disconnect()
+
+	oldDir := s.directory + "-old"
+	tmpDir := s.directory + "-in-progress"
+
+	// checksums of temporary files are meaningless once they are moved
+	if err := s.cache.clear(); err != nil {
+		return err
+	}
+
+	// same logic as FileStorage.Commit
+	if s.hasPackages(tmpDir) {
+		removeAllRemote(client, oldDir)
+
+		if err := client.Rename(s.directory, oldDir); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := client.Rename(tmpDir, s.directory); err != nil {
+			return err
+		}
+
+		return removeAllRemote(client, oldDir)
+	}
+
+	if err := mergeRemoteDirs(client, tmpDir, s.directory); err != nil {
+		return err
+	}
+	return removeAllRemote(client, tmpDir)
+}
+
+func (s *SFTPStorage) hasPackages(dir string) bool {
+	walker := s.client.Walk(dir)
+	for walker.Step() {
+		if walker.Err() != nil {
+			continue
+		}
+		if !walker.Stat().IsDir() {
+			if isPackageFile(walker.Path()) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// removeAllRemote removes a remote path and any children, ignoring missing paths
+func removeAllRemote(client *sftp.Client, remotePath string) error {
+	err := client.RemoveAll(remotePath)
+	if err != nil && os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// mergeRemoteDirs moves the contents of the remote repository at source path into the one at target path
+func mergeRemoteDirs(client *sftp.Client, source, target string) error {
+	if err := client.MkdirAll(target); err != nil {
+		return err
+	}
+
+	entries, err := client.ReadDir(source)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		from := path.Join(source, entry.Name())
+		to := path.Join(target, entry.Name())
+		// cleanup previous entries in the target to prevent errors
+		_ = removeAllRemote(client, to)
+
+		err = client.Rename(from, to)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,190 @@
+package get
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/assert"
+	"github.com/uyuni-project/minima/util"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// startSFTPServer starts an SFTP server on a random local port serving the
+// local filesystem, accepting only the given client key. Returns the server
+// address and a known_hosts file for it
+func startSFTPServer(t *testing.T, clientKey ssh.PublicKey) (address string, knownHostsFile string) {
+	_, hostPrivateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostPrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) != string(clientKey.Marshal()) {
+				return nil, os.ErrPermission
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSFTP(conn, config)
+		}
+	}()
+
+	address = listener.Addr().String()
+	knownHostsFile = filepath.Join(t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(address)}, hostSigner.PublicKey())
+	err = os.WriteFile(knownHostsFile, []byte(line+"\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func serveSFTP(conn net.Conn, config *ssh.ServerConfig) {
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for request := range channelRequests {
+				ok := request.Type == "subsystem" && string(request.Payload[4:]) == "sftp"
+				request.Reply(ok, nil)
+				if ok {
+					server, err := sftp.NewServer(channel)
+					if err == nil {
+						server.Serve()
+					}
+					channel.Close()
+				}
+			}
+		}()
+	}
+}
+
+func TestSFTPStorage(t *testing.T) {
+	_, clientPrivateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(clientPrivateKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "id_ed25519")
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(block), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(clientPrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	address, knownHostsFile := startSFTPServer(t, signer.PublicKey())
+	// a stale agent socket falls back to the key file
+	t.Setenv("SSH_AUTH_SOCK", filepath.Join(t.TempDir(), "agent.sock"))
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	directory := filepath.Join(t.TempDir(), "repo")
+	options := SFTPOptions{Host: address, User: "minima", KeyFile: keyFile, KnownHostsFile: knownHostsFile}
+	storage, err := NewSFTPStorage(directory, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testStorage(t, storage)
+	_, err = os.Stat(directory + "-in-progress")
+	assert.True(t, os.IsNotExist(err))
+
+	// a file rewritten with the same size within the same second does not
+	// keep its cached checksum
+	checksum := "03675ac53ff9cd1535ccc7dfcdfa2c458c5218371f418dc136f2d19ac1fbe8a5"
+	store := util.Compose(storage.StoringMapper("x86_64/rewritten.rpm", checksum, crypto.SHA256), util.Nop)
+	assert.NoError(t, store(util.NewNopReadCloser(strings.NewReader("Hello, World"))))
+	store = util.Compose(storage.StoringMapper("x86_64/rewritten.rpm", checksum, crypto.SHA256), util.Nop)
+	assert.IsType(t, &util.ChecksumError{}, store(util.NewNopReadCloser(strings.NewReader("Hello, Earth"))))
+	actual, err := storage.Checksum("x86_64/rewritten.rpm", Temporary, crypto.SHA256)
+	assert.NoError(t, err)
+	assert.NotEqual(t, checksum, actual)
+	assert.NoError(t, storage.Commit())
+
+	// keys from the SSH agent are used, its connection is closed with the client
+	var agentConns sync.WaitGroup
+	agentKeyring := agent.NewKeyring()
+	assert.NoError(t, agentKeyring.Add(agent.AddedKey{PrivateKey: clientPrivateKey}))
+	agentSocket := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", agentSocket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			agentConns.Add(1)
+			go func() {
+				defer agentConns.Done()
+				agent.ServeAgent(agentKeyring, conn)
+			}()
+		}
+	}()
+	t.Setenv("SSH_AUTH_SOCK", agentSocket)
+	agentStorage, err := NewSFTPStorage(filepath.Join(t.TempDir(), "agent"), SFTPOptions{Host: address, User: "minima", KnownHostsFile: knownHostsFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStorage(t, agentStorage)
+	agentStorage.(*SFTPStorage).disconnect()
+	agentConns.Wait()
+	t.Setenv("SSH_AUTH_SOCK", filepath.Join(t.TempDir(), "agent.sock"))
+
+	_, err = NewSFTPStorage(directory, SFTPOptions{Host: address, User: "minima", KnownHostsFile: knownHostsFile})
+	assert.ErrorContains(t, err, "cannot connect to SSH agent")
+
+	// unknown host keys are rejected
+	options.KnownHostsFile = filepath.Join(t.TempDir(), "empty_known_hosts")
+	assert.NoError(t, os.WriteFile(options.KnownHostsFile, nil, 0644))
+	storage, err = NewSFTPStorage(directory, options)
+	assert.NoError(t, err)
+	_, err = storage.NewReader("x86_64/hello.rpm", Permanent)
+	assert.ErrorContains(t, err, "key is unknown")
+}
@@ -3,7 +3,9 @@ package get
 import (
 	"crypto"
 	"errors"
+	"fmt"
 	"io"
+	"strings"
 
 	"github.com/uyuni-project/minima/util"
 )
@@ -20,15 +22,39 @@ const (
 
 type StorageConfig struct {
 	Type string
-	// file-specific
+	// Name identifies the storage in logs and errors, optional
+	Name string
+	// file- and sftp-specific
 	Path string
+	// sftp-specific
+	Host           string
+	User           string
+	KeyFile        string `yaml:"key_file"`
+	KeyPassphrase  string `yaml:"key_passphrase"`
+	KnownHostsFile string `yaml:"known_hosts_file"`
 	// s3-specific
 	AccessKeyID     string `yaml:"access_key_id"`
 	SecretAccessKey string `yaml:"secret_access_key"`
+	Profile         string
+	RoleARN         string `yaml:"role_arn"`
 	Region          string
 	Bucket          string
-	JsonPath        string `yaml:"jsonpath"`
-	ProjectID       string `yaml:"projectid"`
+	// gcs-specific
+	JsonPath  string `yaml:"jsonpath"`
+	ProjectID string `yaml:"projectid"`
+	// azure-specific
+	Container               string
+	AccountName             string `yaml:"account_name"`
+	AccountKey              string `yaml:"account_key"`
+	SASToken                string `yaml:"sas_token"`
+	ManagedIdentity         bool   `yaml:"managed_identity"`
+	ManagedIdentityClientID string `yaml:"managed_identity_client_id"`
+	// s3-, gcs- and azure-compatible services
+	Endpoint                 string
+	ForcePathStyle           bool `yaml:"force_path_style"`
+	DisableSSL               bool `yaml:"disable_ssl"`
+	SkipBucketCreation       bool `yaml:"skip_bucket_creation"`
+	SkipWebsiteConfiguration bool `yaml:"skip_website_configuration"`
 }
 
 // Storage allows to store data in the form of files. Files are accumulated in
@@ -44,7 +70,50 @@ type Storage interface {
 	NewReader(filename string, location Location) (reader io.ReadCloser, err error)
 	// Recycle will copy a file from the permanent to the temporary location
 	Recycle(filename string) (err error)
+	// Checksum returns the checksum of a file in a location, possibly without
+	// reading it again if it was already computed. Returns ErrFileNotFound
+	// if the requested path was not found at all
+	Checksum(filename string, location Location, hash crypto.Hash) (checksum string, err error)
 }
 
 // ErrFileNotFound signals that the requested file was not found
 var ErrFileNotFound = errors.New("File not found")
+
+// checksumMetadataKey is the object metadata key holding the checksum of an
+// uploaded object in object storages, so that it can be checked without
+// downloading the object
+const checksumMetadataKey = "Minima-Checksum"
+
+// checksumMetadata returns the value of the checksum metadata for an object
+func checksumMetadata(hash crypto.Hash, checksum string) string {
+	return hash.String() + ":" + checksum
+}
+
+// parseChecksumMetadata returns the checksum from a checksum metadata value,
+// if it was computed with the requested hash function
+func parseChecksumMetadata(value string, hash crypto.Hash) (checksum string, ok bool) {
+	hashName, checksum, ok := strings.Cut(value, ":")
+	if !ok || hashName != hash.String() {
+		return "", false
+	}
+	return checksum, true
+}
+
+// deletingCloser removes an uploaded object if its checksum did not match,
+// so that its checksum metadata can be trusted. Failing to remove it is
+// reported along with the checksum error
+type deletingCloser struct {
+	*util.ChecksummingWriter
+	remove func() error
+}
+
+func (w *deletingCloser) Close() error {
+	err := w.ChecksummingWriter.Close()
+	var checksumErr *util.ChecksumError
+	if errors.As(err, &checksumErr) {
+		if removeErr := w.remove(); removeErr != nil {
+			return errors.Join(err, fmt.Errorf("cannot remove object with wrong checksum: %w", removeErr))
+		}
+	}
+	return err
+}
@@ -0,0 +1,76 @@
+package get
+
+import (
+	"crypto"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/uyuni-project/minima/util"
+)
+
+// testStorage checks the behavior all Storage implementations share: stored
+// and recycled files are committed, checksums of files not matching the
+// expected one are never trusted and missing files are reported as such
+func testStorage(t *testing.T, storage Storage) {
+	content := "Hello, World"
+	checksum := "03675ac53ff9cd1535ccc7dfcdfa2c458c5218371f418dc136f2d19ac1fbe8a5"
+
+	// a file not matching its checksum might be kept, but not with that checksum
+	store := util.Compose(storage.StoringMapper("x86_64/wrong.rpm", "0000", crypto.SHA256), util.Nop)
+	err := store(util.NewNopReadCloser(strings.NewReader(content)))
+	assert.IsType(t, &util.ChecksumError{}, err)
+	actual, err := storage.Checksum("x86_64/wrong.rpm", Temporary, crypto.SHA256)
+	if err != ErrFileNotFound {
+		assert.NoError(t, err)
+		assert.Equal(t, checksum, actual)
+	}
+
+	for i := 0; i < 2; i++ {
+		if i == 0 {
+			store := util.Compose(storage.StoringMapper("x86_64/hello+world.rpm", checksum, crypto.SHA256), util.Nop)
+			assert.NoError(t, store(util.NewNopReadCloser(strings.NewReader(content))))
+		} else {
+			assert.NoError(t, storage.Recycle("x86_64/hello+world.rpm"))
+		}
+
+		actual, err := storage.Checksum("x86_64/hello+world.rpm", Temporary, crypto.SHA256)
+		assert.NoError(t, err)
+		assert.Equal(t, checksum, actual)
+
+		assert.NoError(t, storage.Commit())
+
+		reader, err := storage.NewReader("x86_64/hello+world.rpm", Permanent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := io.ReadAll(reader)
+		reader.Close()
+		assert.NoError(t, err)
+		assert.Equal(t, content, string(result))
+	}
+
+	_, err = storage.NewReader("x86_64/missing.rpm", Permanent)
+	assert.Equal(t, ErrFileNotFound, err)
+	_, err = storage.Checksum("x86_64/missing.rpm", Permanent, crypto.SHA256)
+	assert.Equal(t, ErrFileNotFound, err)
+}
+
+func TestDeletingCloser(t *testing.T) {
+	removeErr := errors.New("access denied")
+	writer := &deletingCloser{util.NewChecksummingWriter(util.NewNopWriteCloser(io.Discard), "0000", crypto.SHA256), func() error {
+		return removeErr
+	}}
+	_, err := writer.Write([]byte("Hello, World"))
+	assert.NoError(t, err)
+	err = writer.Close()
+	var checksumErr *util.ChecksumError
+	assert.True(t, errors.As(err, &checksumErr))
+	assert.ErrorIs(t, err, removeErr)
+}
+
+func TestFileStorage(t *testing.T) {
+	testStorage(t, NewFileStorage(t.TempDir()))
+}
@@ -2,20 +2,33 @@ package get
 
 import (
 	"bytes"
+	"compress/bzip2"
 	"compress/gzip"
 	"crypto"
+	_ "crypto/md5"
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/hex"
 	"encoding/xml"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"net/http"
 	"net/url"
 	"path"
 	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/ProtonMail/go-crypto/openpgp"
 	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
 	"github.com/uyuni-project/minima/util"
 )
 
@@ -30,14 +43,25 @@ type XMLLocation struct {
 
 // XMLRepomd maps a <repomd> tag in repodata/repomd.xml
 type XMLRepomd struct {
-	Data []XMLData `xml:"data"`
+	Revision string    `xml:"revision"`
+	Tags     xmlRaw    `xml:"tags"`
+	Data     []XMLData `xml:"data"`
 }
 
 // XMLData maps a <data> tag in repodata/repomd.xml
 type XMLData struct {
-	Type     string      `xml:"type,attr"`
-	Location XMLLocation `xml:"location"`
-	Checksum XMLChecksum `xml:"checksum"`
+	Type         string      `xml:"type,attr"`
+	Location     XMLLocation `xml:"location"`
+	Checksum     XMLChecksum `xml:"checksum"`
+	OpenChecksum XMLChecksum `xml:"open-checksum"`
+	Timestamp    string      `xml:"timestamp"`
+	Size         int64       `xml:"size"`
+	OpenSize     int64       `xml:"open-size"`
+	// HeaderChecksum and HeaderSize describe the header of zchunk files
+	HeaderChecksum XMLChecksum `xml:"header-checksum"`
+	HeaderSize     int64       `xml:"header-size"`
+	// Checksums are further checksums of the file, of other types
+	Checksums []XMLChecksum `xml:"-"`
 }
 
 // repodata/<ID>-primary.xml.<compression>
@@ -49,9 +73,26 @@ type XMLMetaData struct {
 
 // XMLPackage maps a <package> tag in repodata/<ID>-primary.xml.<compression>
 type XMLPackage struct {
+	Name     string      `xml:"name"`
+	Version  XMLVersion  `xml:"version"`
 	Arch     string      `xml:"arch"`
 	Location XMLLocation `xml:"location"`
 	Checksum XMLChecksum `xml:"checksum"`
+	Size     XMLSize     `xml:"size"`
+	// Checksums are further checksums of the package, of other types
+	Checksums []XMLChecksum `xml:"-"`
+}
+
+// XMLVersion maps a <version> tag in repodata/<ID>-primary.xml.<compression>
+type XMLVersion struct {
+	Epoch string `xml:"epoch,attr"`
+	Ver   string `xml:"ver,attr"`
+	Rel   string `xml:"rel,attr"`
+}
+
+// XMLSize maps a <size> tag in repodata/<ID>-primary.xml.<compression>
+type XMLSize struct {
+	Package int64 `xml:"package,attr"`
 }
 
 // XMLChecksum maps a <checksum> tag in repodata/<ID>-primary.xml.<compression>
@@ -61,62 +102,64 @@ type XMLChecksum struct {
 }
 
 var hashMap = map[string]crypto.Hash{
+	"md5":    crypto.MD5,
 	"sha":    crypto.SHA1,
 	"sha1":   crypto.SHA1,
+	"sha224": crypto.SHA224,
 	"sha256": crypto.SHA256,
+	"sha384": crypto.SHA384,
 	"sha512": crypto.SHA512,
 }
 
 const repomdPath = "repodata/repomd.xml"
 const releasePath = "Release"
 
-type RepoType struct {
-	MetadataPath         string
-	PackagesType         string
-	DecodeMetadata       func(io.Reader) (XMLRepomd, error)
-	DecodePackages       func(io.Reader, string) (XMLMetaData, error)
-	MetadataSignatureExt string
-	Noarch               string
-}
-
-var (
-	packageExtensions = map[string]struct{}{
-		".rpm":  {},
-		".deb":  {},
-		".udeb": {},
-	}
-	repoTypes = map[string]RepoType{
-		"rpm": {
-			MetadataPath: "repodata/repomd.xml",
-			PackagesType: "primary",
-			DecodeMetadata: func(reader io.Reader) (repomd XMLRepomd, err error) {
-				decoder := xml.NewDecoder(reader)
-				err = decoder.Decode(&repomd)
-				return
-			},
-			DecodePackages:       readMetaData,
-			MetadataSignatureExt: ".asc",
-			Noarch:               "noarch",
-		},
-		"deb": {
-			MetadataPath:         "Release",
-			PackagesType:         "Packages",
-			DecodeMetadata:       decodeRelease,
-			DecodePackages:       decodePackages,
-			MetadataSignatureExt: ".gpg",
-			Noarch:               "all",
-		},
-	}
-	SkipLegacy bool
-)
-
 // Syncer syncs repos from an HTTP source to a Storage
 type Syncer struct {
 	// URL of the repo this syncer syncs
-	URL     url.URL
-	archs   map[string]bool
-	storage Storage
-	quiet   bool
+	URL url.URL
+	// Mirrorlist is the URL of a list of mirrors of the repo, optional
+	Mirrorlist string
+	// Metalink is the URL of a metalink for repomd.xml, optional
+	Metalink string
+	// Retry is the policy to retry failed downloads
+	Retry RetryConfig
+	// Limiters throttle downloads, eg. a global one and a per-repo one
+	Limiters []*util.RateLimiter
+	// Progress reports the progress of package downloads, optional
+	Progress *ProgressTracker
+	archs    map[string]bool
+	storage  Storage
+	quiet    bool
+
+	repoType    string
+	name        string
+	regenerate  bool
+	deltaRPMs   bool
+	sources     PackagePolicy
+	debuginfo   PackagePolicy
+	signingKey  []byte
+	keys        [][]byte
+	client      *http.Client
+	log         *slog.Logger
+	skipLegacy  bool
+	filter      func(XMLPackage) bool
+	concurrency int
+	onEvent     func(Event)
+
+	// whether files are verified against all their checksums, not only one
+	allChecksums bool
+
+	// patterns of indexes to sync and not to sync
+	includeIndexes []string
+	excludeIndexes []string
+
+	// base URLs packages are downloaded from, in turn
+	mirrors     []url.URL
+	mirrorMutex sync.Mutex
+	nextMirror  int
+	// checksum repomd.xml must have according to the metalink, if any
+	repomdChecksum XMLChecksum
 }
 
 // Decision encodes what to do with a file
@@ -131,60 +174,85 @@ const (
 	Skip
 )
 
-// NewSyncer creates a new Syncer
-func NewSyncer(url url.URL, archs map[string]bool, storage Storage, quiet bool) *Syncer {
-	return &Syncer{url, archs, storage, quiet}
+// NewSyncer creates a new Syncer for the repo at url, configured by options
+func NewSyncer(url url.URL, storage Storage, options ...SyncerOption) *Syncer {
+	r := &Syncer{URL: url, storage: storage, client: http.DefaultClient, concurrency: 1}
+	for _, option := range options {
+		option(r)
+	}
+	return r
 }
 
-// StoreRepo stores an HTTP repo in a Storage, automatically retrying in case of recoverable errors
+// StoreRepo stores an HTTP repo in a Storage. Single files are retried according to
+// the retry policy, while the whole repo is synced again if metadata changed while syncing
 func (r *Syncer) StoreRepo() (err error) {
-	checksumMap := r.readChecksumMap()
-	for i := 0; i < 20; i++ {
-		err = r.storeRepo(checksumMap)
+	repoType, err := r.detectRepoType()
+	if err != nil {
+		return
+	}
+	if repoType.NeedsKeys() && len(r.keys) == 0 {
+		return &SignatureError{Reason: fmt.Sprintf("%s metadata signatures are checked against configured keys, but no keys are configured", repoType.Name)}
+	}
+	if r.selectingIndexes(repoType) && repoType.MetadataSignatureExt != "" && len(r.signingKey) == 0 {
+		return fmt.Errorf("%s metadata rewritten to select indexes must be signed, but no signing key is configured", repoType.Name)
+	}
+
+	checksumMap := r.readChecksumMap(repoType)
+	for i := 1; ; i++ {
+		err = r.storeRepo(checksumMap, repoType)
 		if err == nil {
 			return
 		}
 
-		uerr, unexpectedStatusCode := err.(*UnexpectedStatusCodeError)
-		if unexpectedStatusCode {
-			sc := uerr.StatusCode
-			if sc == 401 || sc == 403 || sc == 404 || sc == 410 || sc == 502 || sc == 503 || sc == 504 {
-				log.Printf("Got %v, presumably temporarily, retrying...\n", sc)
-			} else {
-				return err
-			}
-		}
-
-		_, checksumError := err.(*util.ChecksumError)
-		if checksumError {
-			log.Println(err.Error())
-			log.Println("Checksum did not match, presumably the repo was published while syncing, retrying...")
-			continue
+		var metadataRaceErr *MetadataRaceError
+		if !errors.As(err, &metadataRaceErr) {
+			return err
 		}
-
-		_, signatureError := err.(*SignatureError)
-		if signatureError {
-			log.Println(err.Error())
-			log.Println("Signature not valid, presumably the repo was published while syncing, retrying...")
-		} else {
+		if i > r.Retry.metadataRestarts() {
+			r.logger().Error("Too many metadata changes while syncing, aborting")
 			return err
 		}
+
+		delay := r.Retry.backoff(i)
+		r.emit(Event{Type: EventRepoRestarted, Attempt: i, Delay: delay, Err: err})
+		r.logger().Warn("Metadata did not match, presumably the repo was published while syncing, restarting",
+			"error", err, "delay", delay.Round(time.Millisecond))
+		time.Sleep(delay)
 	}
+}
 
-	log.Println("Too many temporary errors, aborting...")
-	return err
+// logger returns the logger for messages about the repo
+func (r *Syncer) logger() *slog.Logger {
+	logger := r.log
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return logger.With("repo", r.URL.String())
 }
 
 // StoreRepo stores an HTTP repo in a Storage
-func (r *Syncer) storeRepo(checksumMap map[string]XMLChecksum) (err error) {
-	packagesToDownload, packagesToRecycle, err := r.processMetadata(checksumMap)
+func (r *Syncer) storeRepo(checksumMap map[string]XMLChecksum, repoType RepoType) (err error) {
+	r.emit(Event{Type: EventRepoStarted})
+	err = r.loadMirrors()
+	if err != nil {
+		return
+	}
+
+	packagesToDownload, packagesToRecycle, err := r.processMetadata(checksumMap, repoType)
 	if err != nil {
 		return
 	}
 
 	downloadCount := len(packagesToDownload)
-	log.Printf("Downloading %v packages...\n", downloadCount)
-	for i, pack := range packagesToDownload {
+	var downloadSize int64
+	for _, pack := range packagesToDownload {
+		downloadSize += pack.Size.Package
+	}
+	r.logger().Info("Downloading packages", "count", downloadCount)
+	r.Progress.StartRepo(r.URL.String(), downloadCount, downloadSize)
+	defer r.Progress.FinishRepo()
+	err = r.forEach(downloadCount, func(i int) error {
+		pack := packagesToDownload[i]
 		// we need to escape package names because some CDN, proxies (...) are not perfectly RFC 3986 compliant
 		// in such cases characters like '+' (which are common in c++ pkgs) will assume a different meaning
 		name := path.Base(pack.Location.Href)
@@ -192,136 +260,509 @@ func (r *Syncer) storeRepo(checksumMap map[string]XMLChecksum) (err error) {
 		relativeURL := strings.TrimSuffix(pack.Location.Href, name) + escapedName
 
 		description := fmt.Sprintf("(%v/%v) %v", i+1, downloadCount, name)
-		err = r.downloadStoreApply(relativeURL, pack.Checksum.Checksum, description, hashMap[pack.Checksum.Type], util.Nop)
+		var err error
+		if pack.Checksum.Type == signatureChecksumType {
+			// checked once the signed package is stored
+			err = r.downloadStoreApply(relativeURL, "", description, 0, pack.Size.Package, util.Nop)
+		} else if repoType.VerifyPackage != nil {
+			err = r.downloadStoreApply(relativeURL, "", description, 0, pack.Size.Package, func(reader io.ReadCloser) error {
+				return repoType.VerifyPackage(reader, pack.Checksum)
+			})
+		} else {
+			err = r.downloadPackage(relativeURL, pack, description)
+		}
 		if err != nil {
 			return err
 		}
+		r.Progress.PackageDone()
+		return nil
+	})
+	if err != nil {
+		return
 	}
+	r.Progress.FinishRepo()
 
 	recycleCount := len(packagesToRecycle)
-	log.Printf("Recycling %v packages...\n", recycleCount)
+	r.logger().Info("Recycling packages", "count", recycleCount)
 	for _, pack := range packagesToRecycle {
 		err = r.storage.Recycle(pack.Location.Href)
 		if err != nil {
 			return
 		}
+		r.emit(Event{Type: EventFileRecycled, File: pack.Location.Href})
+	}
+
+	err = r.verifyPackageSignatures(packagesToDownload)
+	if err != nil {
+		return
 	}
 
-	log.Println("Committing changes...")
+	r.logger().Info("Committing changes")
 	err = r.storage.Commit()
 	if err != nil {
 		return
 	}
+	r.emit(Event{Type: EventRepoCommitted})
 	return
 }
 
-// downloadStoreApply downloads a repo-relative path into a file, while applying a ReaderConsumer
-func (r *Syncer) downloadStoreApply(relativePath string, checksum string, description string, hash crypto.Hash, f util.ReaderConsumer) error {
-	if !r.quiet {
-		log.Printf("Downloading %v...", description)
+// downloadPackage downloads a package, verifying it against its checksum, and
+// against its further checksums if all checksums are verified
+func (r *Syncer) downloadPackage(relativeURL string, pack XMLPackage, description string) error {
+	hash, err := hashOf(pack.Checksum.Type)
+	if err != nil {
+		return fmt.Errorf("cannot verify %s: %w", pack.Location.Href, err)
 	}
+	verify, err := r.checksumVerifier(pack.Checksums, util.Nop)
+	if err != nil {
+		return fmt.Errorf("cannot verify %s: %w", pack.Location.Href, err)
+	}
+	return r.downloadStoreApply(relativeURL, pack.Checksum.Checksum, description, hash, pack.Size.Package, verify)
+}
 
-	repoURL := r.URL
-	repoURL.Path = path.Join(repoURL.Path, relativePath)
-	finalURL := fmt.Sprintf("%s://%s%s?%s", repoURL.Scheme, repoURL.Host, repoURL.Path, repoURL.Query().Encode())
+// forEach calls f with indexes from 0 to n-1, from up to concurrency
+// goroutines at once. It stops at the first error and returns it
+func (r *Syncer) forEach(n int, f func(i int) error) error {
+	workers := r.concurrency
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > n {
+		workers = n
+	}
 
-	body, err := ReadURL(finalURL)
-	if err != nil {
-		return err
+	indexes := make(chan int)
+	stop := make(chan struct{})
+	var once sync.Once
+	var firstErr error
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				if err := f(i); err != nil {
+					once.Do(func() {
+						firstErr = err
+						close(stop)
+					})
+				}
+			}
+		}()
+	}
+
+feed:
+	for i := 0; i < n; i++ {
+		select {
+		case indexes <- i:
+		case <-stop:
+			break feed
+		}
 	}
+	close(indexes)
+	wg.Wait()
+	return firstErr
+}
+
+// downloadStoreApply downloads a repo-relative path into a file, while applying a ReaderConsumer.
+// Files with a known checksum are downloaded from mirrors, if any. Downloads are aborted as soon as
+// they exceed the expected size, if positive
+func (r *Syncer) downloadStoreApply(relativePath string, checksum string, description string, hash crypto.Hash, size int64, f util.ReaderConsumer) error {
+	if checksum != "" && len(r.mirrors) > 0 {
+		return r.downloadStoreApplyFromMirrors(relativePath, checksum, description, hash, size, f)
+	}
+	return r.downloadStoreApplyFrom(r.URL, relativePath, checksum, description, hash, size, f)
+}
+
+// downloadStoreApplyFrom downloads a path relative to a base URL into a file, while applying a ReaderConsumer.
+// Failed downloads are retried according to the retry policy
+func (r *Syncer) downloadStoreApplyFrom(baseURL url.URL, relativePath string, checksum string, description string, hash crypto.Hash, size int64, f util.ReaderConsumer) error {
+	return r.withRetries(description, func() error {
+		return r.downloadStoreApplyOnce(baseURL, relativePath, checksum, description, hash, size, f)
+	})
+}
+
+// downloadStoreApplyOnce downloads a path relative to a base URL into a file, while applying a ReaderConsumer.
+// Errors of the ReaderConsumer, other than errors reading the download, are returned as consumerErrors
+func (r *Syncer) downloadStoreApplyOnce(baseURL url.URL, relativePath string, checksum string, description string, hash crypto.Hash, size int64, f util.ReaderConsumer) error {
 	// unescape to preserve original pkg name
 	storagePath, err := url.QueryUnescape(relativePath)
 	if err != nil {
 		return err
 	}
-	return util.Compose(r.storage.StoringMapper(storagePath, checksum, hash), f)(body)
+	read, err := r.downloadApplyOnce(baseURL, relativePath, description, size, r.storage.StoringMapper(storagePath, checksum, hash), f)
+	if err == nil {
+		r.emit(Event{Type: EventFileDownloaded, File: storagePath, Size: read})
+	}
+	return err
+}
+
+// downloadApply downloads a repo-relative path from the repo URL without
+// storing it, while applying a ReaderConsumer. Failed downloads are retried
+// according to the retry policy
+func (r *Syncer) downloadApply(relativePath string, checksum string, description string, hash crypto.Hash, size int64, f util.ReaderConsumer) error {
+	return r.withRetries(description, func() error {
+		_, err := r.downloadApplyOnce(r.URL, relativePath, description, size, checkingMapper(checksum, hash), f)
+		return err
+	})
+}
+
+// downloadApplyOnce downloads a path relative to a base URL through a mapper, while applying a ReaderConsumer,
+// and returns the downloaded size. The download fails with a SizeError as soon as it exceeds the expected size,
+// or at its end if it is shorter, if the expected size is positive. Errors of the ReaderConsumer, other than
+// errors reading the download, are returned as consumerErrors
+func (r *Syncer) downloadApplyOnce(baseURL url.URL, relativePath string, description string, size int64, mapper util.ReaderMapper, f util.ReaderConsumer) (read int64, err error) {
+	if !r.quiet {
+		r.logger().Info("Downloading", "file", description)
+	}
+
+	response, err := readURL(r.client, fileURL(baseURL, relativePath))
+	if err != nil {
+		return 0, err
+	}
+	counter := &progressReader{ReadCloser: util.NewLimitedReadCloser(response, r.Limiters...), tracker: r.Progress}
+	defer func() { r.Progress.release(counter, err == nil) }()
+	body := &readErrorRecorder{ReadCloser: util.NewSizeCheckingReadCloser(counter, size)}
+
+	var fErr error
+	err = util.Compose(mapper, func(reader io.ReadCloser) error {
+		fErr = f(reader)
+		return fErr
+	})(body)
+	// checksums verified by the consumer are retried like any other, as are
+	// size mismatches it may wrap
+	var checksumErr *util.ChecksumError
+	var sizeErr *util.SizeError
+	if err != nil && err == fErr && fErr != body.err && !errors.As(fErr, &checksumErr) && !errors.As(fErr, &sizeErr) {
+		return counter.read, &consumerError{err}
+	}
+	return counter.read, err
+}
+
+// checkingMapper returns a mapper that checks read data against a checksum,
+// without storing it
+func checkingMapper(checksum string, hash crypto.Hash) util.ReaderMapper {
+	return func(reader io.ReadCloser) (io.ReadCloser, error) {
+		return util.NewTeeReadCloser(reader, util.NewChecksummingWriter(util.NewNopWriteCloser(io.Discard), checksum, hash)), nil
+	}
+}
+
+// fileURL returns the URL of a path relative to a base URL, keeping its query
+func fileURL(baseURL url.URL, relativePath string) string {
+	baseURL.Path = path.Join(baseURL.Path, relativePath)
+	return fmt.Sprintf("%s://%s%s?%s", baseURL.Scheme, baseURL.Host, baseURL.Path, baseURL.Query().Encode())
 }
 
 // processMetadata stores the repo metadata and returns a list of package file
 // paths to download
-func (r *Syncer) processMetadata(checksumMap map[string]XMLChecksum) (packagesToDownload []XMLPackage, packagesToRecycle []XMLPackage, err error) {
-	doProcessMetadata := func(reader io.ReadCloser, repoType RepoType) (err error) {
+func (r *Syncer) processMetadata(checksumMap map[string]XMLChecksum, repoType RepoType) (packagesToDownload []XMLPackage, packagesToRecycle []XMLPackage, err error) {
+	if r.regenerate && !repoType.regenerable {
+		r.logger().Warn("Metadata of this repo type cannot be regenerated, mirroring it as is", "type", repoType.Name)
+	}
+	if (len(r.includeIndexes) > 0 || len(r.excludeIndexes) > 0) && repoType.FilterMetadata == nil {
+		r.logger().Warn("Indexes of this repo type cannot be selected, mirroring all of them", "type", repoType.Name)
+	}
+	metadataPaths, err := r.metadataPaths(repoType)
+	if err != nil {
+		return
+	}
+	for _, metadataPath := range metadataPaths {
+		toDownload, toRecycle, err := r.processMetadataFile(metadataPath, checksumMap, repoType)
+		if err != nil {
+			return nil, nil, err
+		}
+		packagesToDownload = append(packagesToDownload, toDownload...)
+		packagesToRecycle = append(packagesToRecycle, toRecycle...)
+	}
+	return
+}
+
+// metadataPaths returns the paths of the metadata files of a repo type, one
+// per configured arch if the path depends on it
+func (r *Syncer) metadataPaths(repoType RepoType) ([]string, error) {
+	metadataPath := strings.ReplaceAll(repoType.MetadataPath, "{name}", r.repoName())
+	if !strings.Contains(metadataPath, "{arch}") {
+		return []string{metadataPath}, nil
+	}
+	if len(r.archs) == 0 {
+		return nil, fmt.Errorf("repos of type %s need archs", repoType.Name)
+	}
+	archs := make([]string, 0, len(r.archs))
+	for arch := range r.archs {
+		archs = append(archs, arch)
+	}
+	sort.Strings(archs)
+
+	paths := []string{}
+	for _, arch := range archs {
+		paths = append(paths, strings.ReplaceAll(metadataPath, "{arch}", arch))
+	}
+	return paths, nil
+}
+
+// processMetadataFile stores a metadata file and the files it lists, and
+// returns a list of package file paths to download
+func (r *Syncer) processMetadataFile(metadataPath string, checksumMap map[string]XMLChecksum, repoType RepoType) (packagesToDownload []XMLPackage, packagesToRecycle []XMLPackage, err error) {
+	regenerate := r.regenerating(repoType)
+	selecting := r.selectingIndexes(repoType)
+	// content stored instead of the original metadata file, if regenerated or
+	// if indexes are selected
+	var stored []byte
+	rewritten := regenerate
+	doProcessMetadata := func(reader io.ReadCloser) (err error) {
+		// the metadata file may be processed again if its download is retried
+		packagesToDownload, packagesToRecycle = nil, nil
 		b, err := io.ReadAll(reader)
 		if err != nil {
 			return
 		}
 
-		err = r.checkRepomdSignature(bytes.NewReader(b), repoType)
+		// the metadata file itself lists packages
+		if repoType.PackagesType == "" {
+			err = r.checkRepomdSignature(metadataPath, b, repoType, true)
+			if err != nil {
+				return
+			}
+			primary, err := decodeOwnPackages(metadataPath, b, repoType)
+			if err != nil {
+				return err
+			}
+			packagesToDownload, packagesToRecycle = r.filterPackages(primary, checksumMap, repoType)
+			return nil
+		}
+
+		repomd, err := repoType.DecodeMetadata(bytes.NewReader(b))
 		if err != nil {
 			return
 		}
+		for _, entry := range repomd.Data {
+			if err = validateData(entry); err != nil {
+				return
+			}
+		}
+		if selecting {
+			var excluded bool
+			repomd.Data, excluded = r.selectIndexes(repomd.Data)
+			stored = b
+			if excluded {
+				rewritten = true
+				stored, err = repoType.FilterMetadata(b, r.includesIndex)
+				if err != nil {
+					return
+				}
+			}
+		}
 
-		repomd, err := repoType.DecodeMetadata(bytes.NewReader(b))
+		// signatures of rewritten metadata would not be valid
+		err = r.checkRepomdSignature(metadataPath, b, repoType, !rewritten)
 		if err != nil {
 			return
 		}
 
+		if regenerate {
+			packagesToDownload, packagesToRecycle, stored, err = r.regenerateMetadata(repomd, checksumMap, repoType)
+			return
+		}
+
+		var packages *packageSet
+		deltainfoPaths := []string{}
 		data := repomd.Data
+		sources := sourcesIndexes(data, repoType)
+		// indexes stored, and those not published, by location
+		storedIndexes := map[string]bool{}
+		unpublished := map[string]error{}
 		for _, entry := range data {
-			if !r.quiet {
-				log.Println(entry.Location.Href)
-			}
-
 			metadataLocation := entry.Location.Href
 			metadataChecksum := entry.Checksum
 
-			decision := r.decide(metadataLocation, metadataChecksum, checksumMap)
+			decision := r.decide(metadataLocation, metadataChecksum, entry.Checksums, checksumMap)
 			switch decision {
 			case Download:
-				if !r.quiet {
-					log.Println("...downloading")
+				r.logger().Debug("Metadata changed, downloading", "file", metadataLocation)
+				var verify util.ReaderConsumer
+				verify, err = r.checksumVerifier(entry.Checksums, r.openChecksumVerifier(entry))
+				if err != nil {
+					return
+				}
+				if !r.downloadZckDelta(metadataPath, entry, repoType, verify) {
+					err = r.downloadStoreApply(metadataLocation, metadataChecksum.Checksum, path.Base(metadataLocation), hashMap[metadataChecksum.Type], entry.Size, verify)
+				}
+				if err != nil && repoType.UnpublishedIndexes && entry.Type != repoType.PackagesType && !sources[entry.Type] && ignoreStatusCode(err, 404) == nil {
+					// checked once all compressed variants are stored
+					unpublished[metadataLocation] = err
+					err = nil
+					continue
 				}
-
-				err = r.downloadStoreApply(metadataLocation, metadataChecksum.Checksum, path.Base(metadataLocation), hashMap[metadataChecksum.Type], util.Nop)
 				if err != nil {
 					return
 				}
 			case Recycle:
-				if !r.quiet {
-					log.Println("...recycling")
-				}
-
+				r.logger().Debug("Metadata unchanged, recycling", "file", metadataLocation)
 				r.storage.Recycle(metadataLocation)
+				r.emit(Event{Type: EventFileRecycled, File: metadataLocation})
+			case Skip:
+				r.logger().Debug("Metadata already downloaded", "file", metadataLocation)
+			}
+			storedIndexes[metadataLocation] = true
+
+			var toDownload, toRecycle []XMLPackage
+			switch {
+			case entry.Type == repoType.PackagesType:
+				toDownload, toRecycle, packages, err = r.processPrimary(metadataLocation, checksumMap, repoType)
+			case sources[entry.Type]:
+				toDownload, toRecycle, err = r.processSources(metadataLocation, checksumMap, repoType)
 			}
+			if err != nil {
+				return
+			}
+			packagesToDownload = append(packagesToDownload, toDownload...)
+			packagesToRecycle = append(packagesToRecycle, toRecycle...)
+			if isDeltainfo(entry.Type) {
+				deltainfoPaths = append(deltainfoPaths, metadataLocation)
+			}
+		}
+
+		for metadataLocation, unpublishedErr := range unpublished {
+			if !hasCompressedVariant(metadataLocation, storedIndexes) {
+				err = unpublishedErr
+				return
+			}
+			r.logger().Debug("Metadata not published, skipping", "file", metadataLocation)
+		}
 
-			if entry.Type == repoType.PackagesType {
-				packagesToDownload, packagesToRecycle, err = r.processPrimary(metadataLocation, checksumMap, repoType)
+		// deltas are listed by target package, so they are processed once packages are known
+		if r.deltaRPMs && packages != nil {
+			for _, deltainfoPath := range deltainfoPaths {
+				var deltasToDownload, deltasToRecycle []XMLPackage
+				deltasToDownload, deltasToRecycle, err = r.processDeltainfo(deltainfoPath, packages, checksumMap)
+				if err != nil {
+					return
+				}
+				packagesToDownload = append(packagesToDownload, deltasToDownload...)
+				packagesToRecycle = append(packagesToRecycle, deltasToRecycle...)
 			}
 		}
 		return
 	}
 
-	err = r.downloadStoreApply(repomdPath, "", path.Base(repomdPath), 0, func(reader io.ReadCloser) (err error) {
-		err = doProcessMetadata(reader, repoTypes["rpm"])
-		return
-	})
+	// metadata always comes from the repo URL, verified against the metalink if any
+	if regenerate || selecting {
+		// the original metadata may be replaced by a rewritten one
+		err = r.downloadApply(metadataPath, r.repomdChecksum.Checksum, path.Base(metadataPath), hashMap[r.repomdChecksum.Type], 0, doProcessMetadata)
+		if err == nil && rewritten {
+			err = r.storeRewrittenMetadata(metadataPath, stored, repoType)
+		} else if err == nil {
+			err = r.storeBytes(metadataPath, stored)
+		}
+	} else {
+		err = r.downloadStoreApplyFrom(r.URL, metadataPath, r.repomdChecksum.Checksum, path.Base(metadataPath), hashMap[r.repomdChecksum.Type], 0, doProcessMetadata)
+	}
+	err = metadataRace(err)
+	return
+}
+
+// validateData checks that a metadata entry is well formed, so that it is
+// stored inside the repo and can be verified
+func validateData(entry XMLData) error {
+	href := entry.Location.Href
+	clean := path.Clean(href)
+	if href == "" || path.IsAbs(href) || strings.Contains(href, "://") || clean == ".." || strings.HasPrefix(clean, "../") {
+		return fmt.Errorf("invalid location '%s' of %s metadata", href, entry.Type)
+	}
+	if err := validateChecksum(entry.Checksum); err != nil {
+		return fmt.Errorf("invalid checksum of %s: %w", href, err)
+	}
+	if entry.OpenChecksum != (XMLChecksum{}) {
+		if err := validateChecksum(entry.OpenChecksum); err != nil {
+			return fmt.Errorf("invalid open-checksum of %s: %w", href, err)
+		}
+	}
+	if entry.HeaderChecksum != (XMLChecksum{}) {
+		if err := validateChecksum(entry.HeaderChecksum); err != nil {
+			return fmt.Errorf("invalid header-checksum of %s: %w", href, err)
+		}
+	}
+	for _, checksum := range entry.Checksums {
+		if err := validateChecksum(checksum); err != nil {
+			return fmt.Errorf("invalid checksum of %s: %w", href, err)
+		}
+	}
+	if entry.Size < 0 || entry.OpenSize < 0 || entry.HeaderSize < 0 {
+		return fmt.Errorf("invalid size of %s", href)
+	}
+	return nil
+}
+
+// validateChecksum checks that a checksum is of a known type and as long as
+// its hash
+func validateChecksum(checksum XMLChecksum) error {
+	hash, err := hashOf(checksum.Type)
 	if err != nil {
-		log.Println(err.Error())
-		log.Println("Fallback to next repo type")
-		// attempt to download Debian's Release file
-		err = r.downloadStoreApply(releasePath, "", path.Base(releasePath), 0, func(reader io.ReadCloser) (err error) {
-			err = doProcessMetadata(reader, repoTypes["deb"])
-			return
-		})
-		return
+		return err
+	}
+	if _, err := hex.DecodeString(checksum.Checksum); err != nil || len(checksum.Checksum) != 2*hash.Size() {
+		return fmt.Errorf("malformed %s checksum '%s'", checksum.Type, checksum.Checksum)
 	}
+	return nil
+}
 
+// decodeOwnPackages decodes packages listed in a metadata file, with
+// locations relative to its directory
+func decodeOwnPackages(metadataPath string, metadata []byte, repoType RepoType) (primary XMLMetaData, err error) {
+	compType := strings.Trim(filepath.Ext(metadataPath), ".")
+	primary, err = repoType.DecodePackages(bytes.NewReader(metadata), compType)
+	if err != nil {
+		return
+	}
+	dir := path.Dir(metadataPath)
+	for i := range primary.Packages {
+		primary.Packages[i].Location.Href = path.Join(dir, primary.Packages[i].Location.Href)
+	}
 	return
 }
 
-func (r *Syncer) checkRepomdSignature(repomdReader io.Reader, repoType RepoType) (err error) {
-	ascPath := repoType.MetadataPath + repoType.MetadataSignatureExt
-	keyPath := repoType.MetadataPath + ".key"
+// checkRepomdSignature checks the signature of a metadata file, either
+// embedded or in a detached signature file signed by a key file next to it or
+// by configured keys
+func (r *Syncer) checkRepomdSignature(metadataPath string, metadata []byte, repoType RepoType, store bool) (err error) {
+	if repoType.VerifyMetadata != nil {
+		return repoType.VerifyMetadata(metadata, r.keys)
+	}
+	if repoType.MetadataSignatureExt == "" {
+		return nil
+	}
 
-	err = r.downloadStoreApply(ascPath, "", path.Base(ascPath), 0, func(signatureReader io.ReadCloser) (err error) {
-		err = r.downloadStoreApply(keyPath, "", path.Base(keyPath), 0, func(keyReader io.ReadCloser) (err error) {
+	download := r.downloadStoreApply
+	if !store {
+		download = r.downloadApply
+	}
+	ascPath := metadataPath + repoType.MetadataSignatureExt
+	err = download(ascPath, "", path.Base(ascPath), 0, 0, func(signatureReader io.ReadCloser) (err error) {
+		signature, err := io.ReadAll(signatureReader)
+		if err != nil {
+			return
+		}
+
+		if repoType.MetadataKeyExt == "" {
+			keyring, err := readKeyRing(r.keys)
+			if err != nil {
+				return fmt.Errorf("invalid key: %w", err)
+			}
+			if checkDetachedSignature(keyring, metadata, signature) != nil {
+				return &SignatureError{Reason: ascPath + " signature check failed, signature is not valid"}
+			}
+			return nil
+		}
+
+		keyPath := metadataPath + repoType.MetadataKeyExt
+		err = download(keyPath, "", path.Base(keyPath), 0, 0, func(keyReader io.ReadCloser) (err error) {
 			keyring, err := openpgp.ReadArmoredKeyRing(keyReader)
 			if err != nil {
-				return &SignatureError{keyPath + " file does not contain a valid signature"}
+				return &SignatureError{Reason: keyPath + " file does not contain a valid signature"}
 			}
-			_, err = openpgp.CheckArmoredDetachedSignature(keyring, repomdReader, signatureReader, nil)
+			err = checkDetachedSignature(keyring, metadata, signature)
 			if err != nil {
-				return &SignatureError{ascPath + " signature check failed, signature is not valid"}
+				return &SignatureError{Reason: ascPath + " signature check failed, signature is not valid"}
 			}
 			return
 		})
@@ -332,6 +773,10 @@ func (r *Syncer) checkRepomdSignature(repomdReader io.Reader, repoType RepoType)
 	})
 	if err != nil {
 		err = ignoreStatusCode(err, 403, 404)
+		if err == nil && repoType.MetadataKeyExt == "" {
+			// keys are configured for such types, so the signature is expected
+			err = &SignatureError{Reason: ascPath + " signature file not found"}
+		}
 	}
 	return
 }
@@ -341,7 +786,7 @@ func ignoreStatusCode(err error, codes ...int) error {
 	if unexpectedStatusCode {
 		for _, code := range codes {
 			if uerr.StatusCode == code {
-				log.Printf("Got %d, ignoring...\n", code)
+				slog.Debug("Ignoring unexpected status code", "url", uerr.URL, "status", code)
 				return nil
 			}
 		}
@@ -351,71 +796,109 @@ func ignoreStatusCode(err error, codes ...int) error {
 
 // SignatureError is returned if a signature was found but it's invalid
 type SignatureError struct {
-	reason string
+	Reason string
 }
 
 func (e *SignatureError) Error() string {
-	return fmt.Sprintf("Signature error: %s", e.reason)
+	return fmt.Sprintf("Signature error: %s", e.Reason)
 }
 
 // Uncompress and read primary XML
-func readMetaData(reader io.Reader, compType string) (XMLMetaData, error) {
-	var primary XMLMetaData
+func readMetaData(reader io.Reader, compType string) (primary XMLMetaData, err error) {
+	uncompressed, err := uncompress(reader, compType)
+	if err != nil {
+		return
+	}
+	defer uncompressed.Close()
+
+	decoder := xml.NewDecoder(uncompressed)
+	err = decoder.Decode(&primary)
+	return
+}
 
+// uncompress returns the content of a metadata file, given the extension of
+// its path without the dot, eg. gz
+func uncompress(reader io.Reader, compType string) (io.ReadCloser, error) {
 	switch compType {
 	case "gz":
-		reader, err := gzip.NewReader(reader)
-		if err != nil {
-			return primary, err
-		}
-		defer reader.Close()
-
-		decoder := xml.NewDecoder(reader)
-		if err = decoder.Decode(&primary); err != nil {
-			return primary, err
-		}
+		return gzip.NewReader(reader)
 	case "zst":
-		reader, err := zstd.NewReader(reader)
+		decoder, err := zstd.NewReader(reader)
 		if err != nil {
-			return primary, err
+			return nil, err
 		}
-		defer reader.Close()
-
-		decoder := xml.NewDecoder(reader)
-		if err = decoder.Decode(&primary); err != nil {
-			return primary, err
+		return decoder.IOReadCloser(), nil
+	case "bz2":
+		return io.NopCloser(bzip2.NewReader(reader)), nil
+	case "xz":
+		decoder, err := xz.NewReader(reader)
+		if err != nil {
+			return nil, err
 		}
-	default:
-		return primary, errors.New("unsupported compression type")
+		return io.NopCloser(decoder), nil
+	case "zck":
+		return newZckReader(reader)
+	case "xml", "yaml":
+		return io.NopCloser(reader), nil
 	}
-
-	return primary, nil
+	return nil, fmt.Errorf("%w %s", errUnsupportedCompression, compType)
 }
 
-func (r *Syncer) readChecksumMap() (checksumMap map[string]XMLChecksum) {
+// errUnsupportedCompression is returned for metadata files that cannot be
+// uncompressed
+var errUnsupportedCompression = errors.New("unsupported compression type")
+
+func (r *Syncer) readChecksumMap(repoType RepoType) (checksumMap map[string]XMLChecksum) {
 	checksumMap = make(map[string]XMLChecksum)
 
-	repoType := repoTypes["rpm"]
-	repomdReader, err := r.storage.NewReader(repomdPath, Permanent)
+	metadataPaths, err := r.metadataPaths(repoType)
+	if err != nil {
+		return
+	}
+	for _, metadataPath := range metadataPaths {
+		if !r.readMetadataChecksums(metadataPath, repoType, checksumMap) {
+			return
+		}
+	}
+	return
+}
+
+// readMetadataChecksums adds checksums of files listed in a previously
+// downloaded metadata file to checksumMap, returning false if not found
+func (r *Syncer) readMetadataChecksums(metadataPath string, repoType RepoType, checksumMap map[string]XMLChecksum) bool {
+	repomdReader, err := r.storage.NewReader(metadataPath, Permanent)
 	if err != nil {
 		if err == ErrFileNotFound {
-			repomdReader, err = r.storage.NewReader(releasePath, Permanent)
-			if err != nil {
-				log.Println("First-time sync started")
-				return
-			}
-			repoType = repoTypes["deb"]
+			r.logger().Info("First-time sync started")
 		} else {
-			log.Println("Error while reading previously-downloaded metadata. Starting sync from scratch")
-			return
+			r.logger().Warn("Error while reading previously-downloaded metadata, starting sync from scratch", "error", err)
 		}
+		return false
 	}
 	defer repomdReader.Close()
 
-	repomd, err := repoType.DecodeMetadata(repomdReader)
+	b, err := io.ReadAll(repomdReader)
 	if err != nil {
-		log.Println("Error while parsing previously-downloaded metadata. Starting sync from scratch")
-		return
+		r.logger().Warn("Error while reading previously-downloaded metadata, starting sync from scratch", "error", err)
+		return false
+	}
+
+	if repoType.PackagesType == "" {
+		primary, err := decodeOwnPackages(metadataPath, b, repoType)
+		if err != nil {
+			r.logger().Warn("Error while parsing previously-downloaded metadata, starting sync from scratch", "error", err)
+			return false
+		}
+		for _, pack := range primary.Packages {
+			checksumMap[pack.Location.Href] = pack.Checksum
+		}
+		return true
+	}
+
+	repomd, err := repoType.DecodeMetadata(bytes.NewReader(b))
+	if err != nil {
+		r.logger().Warn("Error while parsing previously-downloaded metadata, starting sync from scratch", "error", err)
+		return false
 	}
 
 	data := repomd.Data
@@ -426,28 +909,35 @@ func (r *Syncer) readChecksumMap() (checksumMap map[string]XMLChecksum) {
 		if data[i].Type == repoType.PackagesType {
 			primaryReader, err := r.storage.NewReader(dataHref, Permanent)
 			if err != nil {
-				return
+				return false
 			}
 			compType := strings.Trim(filepath.Ext(dataHref), ".")
 			primary, err := repoType.DecodePackages(primaryReader, compType)
+			primaryReader.Close()
 			if err != nil {
-				return
+				return false
 			}
 			for _, pack := range primary.Packages {
 				checksumMap[pack.Location.Href] = pack.Checksum
 			}
 		}
+		if isDeltainfo(data[i].Type) {
+			if !r.readDeltaChecksums(dataHref, checksumMap) {
+				return false
+			}
+		}
 	}
-	return
+	return true
 }
 
-// processPrimary stores the primary XML metadata file and returns a list of
-// package file paths to download
-func (r *Syncer) processPrimary(path string, checksumMap map[string]XMLChecksum, repoType RepoType) (packagesToDownload []XMLPackage, packagesToRecycle []XMLPackage, err error) {
+// processPrimary reads the stored primary XML metadata file and returns
+// packages to download and to recycle, and the set of synced packages
+func (r *Syncer) processPrimary(path string, checksumMap map[string]XMLChecksum, repoType RepoType) (packagesToDownload []XMLPackage, packagesToRecycle []XMLPackage, packages *packageSet, err error) {
 	reader, err := r.storage.NewReader(path, Temporary)
 	if err != nil {
 		return
 	}
+	defer reader.Close()
 
 	compType := strings.Trim(filepath.Ext(path), ".")
 	primary, err := repoType.DecodePackages(reader, compType)
@@ -455,31 +945,125 @@ func (r *Syncer) processPrimary(path string, checksumMap map[string]XMLChecksum,
 		return
 	}
 
+	packagesToDownload, packagesToRecycle = r.filterPackages(primary, checksumMap, repoType)
+	packages = newPackageSet(primary.Packages, r.syncedPackages(primary, repoType))
+	return
+}
+
+// processSources reads the stored file listing source packages and returns
+// their files to download and to recycle
+func (r *Syncer) processSources(path string, checksumMap map[string]XMLChecksum, repoType RepoType) (packagesToDownload []XMLPackage, packagesToRecycle []XMLPackage, err error) {
+	reader, err := r.storage.NewReader(path, Temporary)
+	if err != nil {
+		return
+	}
+	defer reader.Close()
+
+	compType := strings.Trim(filepath.Ext(path), ".")
+	sources, err := repoType.DecodeSources(reader, compType)
+	if err != nil {
+		return
+	}
+
+	packagesToDownload, packagesToRecycle = r.filterPackages(sources, checksumMap, repoType)
+	return
+}
+
+// indexCompressions lists the compressions of indexes, most preferred first
+var indexCompressions = []string{"xz", "gz", "bz2", "zst", ""}
+
+// sourcesIndexes returns the types of the Sources indexes to process, one
+// variant per directory among the compressed and uncompressed ones listed
+func sourcesIndexes(data []XMLData, repoType RepoType) (indexes map[string]bool) {
+	indexes = map[string]bool{}
+	if repoType.SourcesType == "" {
+		return
+	}
+
+	variants := map[string]map[string]string{}
+	for _, entry := range data {
+		compType := strings.TrimPrefix(path.Ext(entry.Type), ".")
+		name := entry.Type
+		if compType != "" && slices.Contains(indexCompressions, compType) {
+			name = strings.TrimSuffix(name, "."+compType)
+		} else {
+			compType = ""
+		}
+		if path.Base(name) != repoType.SourcesType {
+			continue
+		}
+		if variants[name] == nil {
+			variants[name] = map[string]string{}
+		}
+		variants[name][compType] = entry.Type
+	}
+
+	for _, compTypes := range variants {
+		for _, compType := range indexCompressions {
+			if entryType, found := compTypes[compType]; found {
+				indexes[entryType] = true
+				break
+			}
+		}
+	}
+	return
+}
+
+// hasCompressedVariant returns whether a compressed variant of an index is
+// among the stored ones
+func hasCompressedVariant(location string, stored map[string]bool) bool {
+	for _, compType := range indexCompressions {
+		if compType != "" && stored[location+"."+compType] {
+			return true
+		}
+	}
+	return false
+}
+
+// filterPackages returns packages to download and to recycle, out of those
+// matching the configured archs and filters
+func (r *Syncer) filterPackages(primary XMLMetaData, checksumMap map[string]XMLChecksum, repoType RepoType) (packagesToDownload []XMLPackage, packagesToRecycle []XMLPackage) {
+	for _, pack := range r.syncedPackages(primary, repoType) {
+		decision := r.decide(pack.Location.Href, pack.Checksum, pack.Checksums, checksumMap)
+		switch decision {
+		case Download:
+			packagesToDownload = append(packagesToDownload, pack)
+		case Recycle:
+			packagesToRecycle = append(packagesToRecycle, pack)
+		}
+	}
+	return
+}
+
+// syncedPackages returns the packages matching the configured archs and
+// filters, whether they are already stored or not
+func (r *Syncer) syncedPackages(primary XMLMetaData, repoType RepoType) (packages []XMLPackage) {
 	allArchs := len(r.archs) == 0
 	for _, pack := range primary.Packages {
 		legacyPackage := (pack.Arch == "i586" || pack.Arch == "i686")
 
-		if SkipLegacy && legacyPackage {
-			if !r.quiet {
-				fmt.Println("Skipping legacy package:", pack.Location.Href)
-			}
+		if r.skipLegacy && legacyPackage {
+			r.logger().Debug("Skipping legacy package", "file", pack.Location.Href)
 			continue
 		}
 
-		if allArchs || pack.Arch == repoType.Noarch || r.archs[pack.Arch] || (r.archs["x86_64"] && legacyPackage) {
-			decision := r.decide(pack.Location.Href, pack.Checksum, checksumMap)
-			switch decision {
-			case Download:
-				packagesToDownload = append(packagesToDownload, pack)
-			case Recycle:
-				packagesToRecycle = append(packagesToRecycle, pack)
-			}
+		if r.filter != nil && !r.filter(pack) {
+			continue
+		}
+
+		source := isSourcePackage(pack)
+		if !r.sources.allows(source) || !r.debuginfo.allows(isDebugPackage(pack)) {
+			continue
+		}
+
+		if allArchs || pack.Arch == repoType.Noarch || r.archs[pack.Arch] || (r.archs["x86_64"] && legacyPackage) || (source && r.sources.forced()) {
+			packages = append(packages, pack)
 		}
 	}
 	return
 }
 
-func (r *Syncer) decide(location string, checksum XMLChecksum, checksumMap map[string]XMLChecksum) Decision {
+func (r *Syncer) decide(location string, checksum XMLChecksum, checksums []XMLChecksum, checksumMap map[string]XMLChecksum) Decision {
 	previousChecksum, foundInChecksumMap := checksumMap[location]
 
 	if foundInChecksumMap {
@@ -491,23 +1075,58 @@ func (r *Syncer) decide(location string, checksum XMLChecksum, checksumMap map[s
 	}
 
 	if !foundInChecksumMap || previousChecksum.Type != checksum.Type || previousChecksum.Checksum != checksum.Checksum {
-		reader, err := r.storage.NewReader(location, Temporary)
-		if err != nil {
+		// checksums not of the whole file, eg. of APK packages, cannot be checked
+		hash, fileChecksum := hashMap[checksum.Type]
+		if !fileChecksum {
 			return Download
 		}
-		defer reader.Close()
-
-		log.Printf("Reading %s checksum\n", checksum.Type)
-		readChecksum, err := util.Checksum(reader, hashMap[checksum.Type])
+		readChecksum, err := r.storage.Checksum(location, Temporary, hash)
 		if err != nil || readChecksum != checksum.Checksum {
 			return Download
 		}
+		// files failing further checksums may have been stored by a previous attempt
+		if r.allChecksums && !r.matchesChecksums(location, checksums) {
+			return Download
+		}
 		return Skip
 	}
 	return Recycle
 }
 
 // Functions to handle Debian formatted repositories
+
+// debianChecksumField is a field of Debian metadata with checksums of a type,
+// other than the SHA256 ones files are primarily verified against
+type debianChecksumField struct {
+	Field        string
+	ChecksumType string
+}
+
+var (
+	releaseChecksums  = []debianChecksumField{{"MD5Sum", "md5"}, {"SHA1", "sha1"}, {"SHA512", "sha512"}}
+	packagesChecksums = []debianChecksumField{{"MD5sum", "md5"}, {"SHA1", "sha1"}, {"SHA512", "sha512"}}
+	sourcesChecksums  = []debianChecksumField{{"Files", "md5"}, {"Checksums-Sha1", "sha1"}, {"Checksums-Sha512", "sha512"}}
+)
+
+// fileChecksums returns the checksums of files listed in fields of a Debian
+// metadata entry, one file per line, by file name
+func fileChecksums(entry map[string]string, fields []debianChecksumField) (map[string][]XMLChecksum, error) {
+	checksums := map[string][]XMLChecksum{}
+	for _, field := range fields {
+		if entry[field.Field] == "" {
+			continue
+		}
+		for _, fileEntry := range strings.Split(entry[field.Field], "\n") {
+			infos := strings.Fields(fileEntry)
+			if len(infos) != 3 {
+				return nil, fmt.Errorf("badly formatted file entry: '%s'", fileEntry)
+			}
+			checksums[infos[2]] = append(checksums[infos[2]], XMLChecksum{Type: field.ChecksumType, Checksum: infos[0]})
+		}
+	}
+	return checksums, nil
+}
+
 func decodeRelease(reader io.Reader) (repomd XMLRepomd, err error) {
 	entries, err := util.ProcessPropertiesFile(reader)
 	if err != nil {
@@ -522,6 +1141,10 @@ func decodeRelease(reader io.Reader) (repomd XMLRepomd, err error) {
 		return
 	}
 	fileEntries := strings.Split(entries[0]["SHA256"], "\n")
+	checksums, err := fileChecksums(entries[0], releaseChecksums)
+	if err != nil {
+		return
+	}
 
 	data := make([]XMLData, 0)
 	for _, fileEntry := range fileEntries {
@@ -530,10 +1153,13 @@ func decodeRelease(reader io.Reader) (repomd XMLRepomd, err error) {
 			err = fmt.Errorf("badly formatted file entry: '%s'", fileEntry)
 			return
 		}
+		size, _ := strconv.ParseInt(infos[1], 10, 64)
 		fileData := XMLData{
-			Type:     infos[2],
-			Location: XMLLocation{Href: infos[2]},
-			Checksum: XMLChecksum{Type: "sha256", Checksum: infos[0]},
+			Type:      infos[2],
+			Location:  XMLLocation{Href: infos[2]},
+			Checksum:  XMLChecksum{Type: "sha256", Checksum: infos[0]},
+			Checksums: checksums[infos[2]],
+			Size:      size,
 		}
 		data = append(data, fileData)
 	}
@@ -549,12 +1175,83 @@ func decodePackages(reader io.Reader, _ string) (metadata XMLMetaData, err error
 
 	packages := make([]XMLPackage, 0)
 	for _, packageEntry := range packagesEntries {
+		size, _ := strconv.ParseInt(packageEntry["Size"], 10, 64)
+		var checksums []XMLChecksum
+		for _, field := range packagesChecksums {
+			if packageEntry[field.Field] != "" {
+				checksums = append(checksums, XMLChecksum{Type: field.ChecksumType, Checksum: packageEntry[field.Field]})
+			}
+		}
 		packages = append(packages, XMLPackage{
-			Arch:     packageEntry["Architecture"],
-			Location: XMLLocation{Href: packageEntry["Filename"]},
-			Checksum: XMLChecksum{Type: "sha256", Checksum: packageEntry["SHA256"]},
+			Name:      packageEntry["Package"],
+			Arch:      packageEntry["Architecture"],
+			Location:  XMLLocation{Href: packageEntry["Filename"]},
+			Checksum:  XMLChecksum{Type: "sha256", Checksum: packageEntry["SHA256"]},
+			Size:      XMLSize{Package: size},
+			Checksums: checksums,
 		})
 	}
 	metadata = XMLMetaData{Packages: packages}
 	return
 }
+
+// decodeSources returns the files of source packages listed in a Debian
+// Sources file, compressed or not, as packages of the source arch
+func decodeSources(reader io.Reader, compType string) (metadata XMLMetaData, err error) {
+	if compType != "" {
+		var uncompressed io.ReadCloser
+		uncompressed, err = uncompress(reader, compType)
+		if err != nil {
+			return
+		}
+		defer uncompressed.Close()
+		reader = uncompressed
+	}
+
+	sourcesEntries, err := util.ProcessPropertiesFile(reader)
+	if err != nil {
+		return
+	}
+
+	packages := make([]XMLPackage, 0)
+	for _, sourcesEntry := range sourcesEntries {
+		name := sourcesEntry["Package"]
+		if name == "" {
+			continue
+		}
+		if sourcesEntry["Checksums-Sha256"] == "" {
+			err = fmt.Errorf("missing Checksums-Sha256 entry for source package %s", name)
+			return
+		}
+		directory := sourcesEntry["Directory"]
+		var checksums map[string][]XMLChecksum
+		checksums, err = fileChecksums(sourcesEntry, sourcesChecksums)
+		if err != nil {
+			err = fmt.Errorf("badly formatted checksums for source package %s: %w", name, err)
+			return
+		}
+		for _, fileEntry := range strings.Split(sourcesEntry["Checksums-Sha256"], "\n") {
+			infos := strings.Fields(fileEntry)
+			if len(infos) != 3 || strings.Contains(infos[2], "/") {
+				err = fmt.Errorf("badly formatted file entry for source package %s: '%s'", name, fileEntry)
+				return
+			}
+			location := path.Join(directory, infos[2])
+			if path.IsAbs(location) || location == ".." || strings.HasPrefix(location, "../") {
+				err = fmt.Errorf("invalid directory '%s' for source package %s", directory, name)
+				return
+			}
+			size, _ := strconv.ParseInt(infos[1], 10, 64)
+			packages = append(packages, XMLPackage{
+				Name:      name,
+				Arch:      "source",
+				Location:  XMLLocation{Href: location},
+				Checksum:  XMLChecksum{Type: "sha256", Checksum: infos[0]},
+				Size:      XMLSize{Package: size},
+				Checksums: checksums[infos[2]],
+			})
+		}
+	}
+	metadata = XMLMetaData{Packages: packages}
+	return
+}
@@ -1,11 +1,20 @@
 package get
 
 import (
+	"bytes"
+	"compress/gzip"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ulikunitz/xz"
 )
 
 func TestStoreRepo(t *testing.T) {
@@ -18,15 +27,12 @@ func TestStoreRepo(t *testing.T) {
 		t.Error(err)
 	}
 
-	archs := map[string]bool{
-		"x86_64": true,
-	}
 	storage := NewFileStorage(directory)
 	url, err := url.Parse("http://localhost:8080/repo")
 	if err != nil {
 		t.Error(err)
 	}
-	syncer := NewSyncer(*url, archs, storage, false)
+	syncer := NewSyncer(*url, storage, WithArchs("x86_64"))
 
 	// first sync
 	err = syncer.StoreRepo()
@@ -75,15 +81,12 @@ func TestStoreRepoZstd(t *testing.T) {
 		t.Error(err)
 	}
 
-	archs := map[string]bool{
-		"x86_64": true,
-	}
 	storage := NewFileStorage(directory)
 	url, err := url.Parse("http://localhost:8080/zstrepo")
 	if err != nil {
 		t.Error(err)
 	}
-	syncer := NewSyncer(*url, archs, storage, false)
+	syncer := NewSyncer(*url, storage, WithArchs("x86_64"))
 
 	// first sync
 	err = syncer.StoreRepo()
@@ -131,16 +134,12 @@ func TestStoreDebRepo(t *testing.T) {
 		t.Error(err)
 	}
 
-	archs := map[string]bool{
-		"amd64": true,
-	}
-
 	storage := NewFileStorage(directory)
 	url, err := url.Parse("http://localhost:8080/deb_repo")
 	if err != nil {
 		t.Error(err)
 	}
-	syncer := NewSyncer(*url, archs, storage, false)
+	syncer := NewSyncer(*url, storage, WithArchs("amd64"))
 
 	// first sync
 	err = syncer.StoreRepo()
@@ -178,3 +177,175 @@ func TestStoreDebRepo(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestStoreRepoOptions(t *testing.T) {
+	server := httptest.NewServer(http.FileServer(http.Dir("testdata")))
+	defer server.Close()
+
+	repoURL, err := url.Parse(server.URL + "/repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	directory := filepath.Join(t.TempDir(), "repo")
+	storage := NewFileStorage(directory)
+
+	var mutex sync.Mutex
+	events := map[EventType][]string{}
+	syncer := NewSyncer(*repoURL, storage,
+		WithHTTPClient(server.Client()),
+		WithArchs("x86_64"),
+		WithSkipLegacy(true),
+		WithFilter(func(pack XMLPackage) bool {
+			return !strings.HasPrefix(path.Base(pack.Location.Href), "orion-")
+		}),
+		WithConcurrency(3),
+		WithEventHandler(func(event Event) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			assert.Equal(t, repoURL.String(), event.Repo)
+			events[event.Type] = append(events[event.Type], event.File)
+		}),
+	)
+
+	err = syncer.StoreRepo()
+	assert.NoError(t, err)
+
+	for _, file := range []string{"milkyway-dummy-2.0-1.1.x86_64.rpm", "hoag-dummy-1.1-2.1.x86_64.rpm", "perseus-dummy-1.1-1.1.x86_64.rpm"} {
+		_, err := os.Stat(filepath.Join(directory, "x86_64", file))
+		assert.NoError(t, err, file)
+		assert.Contains(t, events[EventFileDownloaded], filepath.Join("x86_64", file))
+	}
+	// filtered out, and legacy packages skipped
+	for _, file := range []string{filepath.Join("x86_64", "orion-dummy-1.1-1.1.x86_64.rpm"), filepath.Join("i586", "hoag-dummy-1.1-2.1.i586.rpm")} {
+		_, err := os.Stat(filepath.Join(directory, file))
+		assert.True(t, os.IsNotExist(err), file)
+	}
+	assert.Len(t, events[EventRepoStarted], 1)
+	assert.Len(t, events[EventRepoCommitted], 1)
+
+	// second sync recycles everything
+	events = map[EventType][]string{}
+	err = syncer.StoreRepo()
+	assert.NoError(t, err)
+	assert.Contains(t, events[EventFileRecycled], filepath.Join("x86_64", "hoag-dummy-1.1-2.1.x86_64.rpm"))
+	assert.NotContains(t, events[EventFileDownloaded], filepath.Join("x86_64", "hoag-dummy-1.1-2.1.x86_64.rpm"))
+}
+
+func TestDecodeSources(t *testing.T) {
+	sources := "Package: a\nVersion: 1.0-1\nDirectory: pool/main/a\nChecksums-Sha256:\n" +
+		" abc 12 a_1.0-1.dsc\n def 345 a_1.0.orig.tar.xz\n\n" +
+		"Package: b\nVersion: 2.0\nChecksums-Sha256:\n 123 6 b_2.0.dsc\n"
+	metadata, err := decodeSources(strings.NewReader(sources), "")
+	assert.NoError(t, err)
+	assert.Equal(t, []XMLPackage{
+		{Name: "a", Arch: "source", Location: XMLLocation{Href: "pool/main/a/a_1.0-1.dsc"}, Checksum: XMLChecksum{Type: "sha256", Checksum: "abc"}, Size: XMLSize{Package: 12}},
+		{Name: "a", Arch: "source", Location: XMLLocation{Href: "pool/main/a/a_1.0.orig.tar.xz"}, Checksum: XMLChecksum{Type: "sha256", Checksum: "def"}, Size: XMLSize{Package: 345}},
+		{Name: "b", Arch: "source", Location: XMLLocation{Href: "b_2.0.dsc"}, Checksum: XMLChecksum{Type: "sha256", Checksum: "123"}, Size: XMLSize{Package: 6}},
+	}, metadata.Packages)
+
+	for _, invalid := range []string{
+		"Package: a\nFiles:\n abc 12 a_1.0-1.dsc\n",
+		"Package: a\nChecksums-Sha256:\n abc a_1.0-1.dsc\n",
+		"Package: a\nDirectory: ../..\nChecksums-Sha256:\n abc 12 a_1.0-1.dsc\n",
+		"Package: a\nChecksums-Sha256:\n abc 12 ../a_1.0-1.dsc\n",
+	} {
+		_, err = decodeSources(strings.NewReader(invalid), "")
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestStoreDebRepoSources(t *testing.T) {
+	server := httptest.NewServer(http.FileServer(http.Dir("testdata")))
+	defer server.Close()
+
+	repoURL, err := url.Parse(server.URL + "/deb_repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sourceFiles := []string{"hello-dummy_1.0-1.dsc", "hello-dummy_1.0.orig.tar.gz", "hello-dummy_1.0-1.debian.tar.xz"}
+
+	directory := t.TempDir()
+	syncer := NewSyncer(*repoURL, NewFileStorage(directory), WithHTTPClient(server.Client()), WithArchs("amd64"), WithSources(PolicyInclude))
+	assert.NoError(t, syncer.StoreRepo())
+	for _, file := range append([]string{"Sources", filepath.Join("amd64", "hoag-dummy_1.1-2.1_amd64.deb")}, sourceFiles...) {
+		if !strings.HasSuffix(file, ".deb") && file != "Sources" {
+			file = filepath.Join("source", file)
+		}
+		original, err := os.ReadFile(filepath.Join("testdata", "deb_repo", file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		synced, err := os.ReadFile(filepath.Join(directory, file))
+		if assert.NoError(t, err, file) {
+			assert.Equal(t, original, synced, file)
+		}
+	}
+	// second sync
+	assert.NoError(t, syncer.StoreRepo())
+
+	// source packages are not synced by default if archs are set
+	directory = t.TempDir()
+	syncer = NewSyncer(*repoURL, NewFileStorage(directory), WithHTTPClient(server.Client()), WithArchs("amd64"))
+	assert.NoError(t, syncer.StoreRepo())
+	_, err = os.Stat(filepath.Join(directory, "source", "hello-dummy_1.0-1.dsc"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestStoreDebRepoCompressedSources(t *testing.T) {
+	// the test repo, with compressed Sources only
+	repoDirectory := t.TempDir()
+	if err := os.CopyFS(repoDirectory, os.DirFS(filepath.Join("testdata", "deb_repo"))); err != nil {
+		t.Fatal(err)
+	}
+	sources, err := os.ReadFile(filepath.Join(repoDirectory, "Sources"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(repoDirectory, "Sources")); err != nil {
+		t.Fatal(err)
+	}
+	var gzipped, xzipped bytes.Buffer
+	gzipWriter := gzip.NewWriter(&gzipped)
+	gzipWriter.Write(sources)
+	gzipWriter.Close()
+	xzWriter, err := xz.NewWriter(&xzipped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xzWriter.Write(sources)
+	xzWriter.Close()
+	for name, content := range map[string][]byte{"Sources.gz": gzipped.Bytes(), "Sources.xz": xzipped.Bytes()} {
+		if err := os.WriteFile(filepath.Join(repoDirectory, name), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+		addReleaseEntry(t, repoDirectory, name, content)
+	}
+
+	server := httptest.NewServer(http.FileServer(http.Dir(repoDirectory)))
+	defer server.Close()
+	repoURL, err := url.Parse(server.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	directory := t.TempDir()
+	syncer := NewSyncer(*repoURL, NewFileStorage(directory), WithHTTPClient(server.Client()), WithArchs("amd64"), WithSources(PolicyInclude))
+	assert.NoError(t, syncer.StoreRepo())
+	for _, file := range []string{"Sources.gz", "Sources.xz", filepath.Join("source", "hello-dummy_1.0-1.dsc"), filepath.Join("source", "hello-dummy_1.0.orig.tar.gz")} {
+		_, err = os.Stat(filepath.Join(directory, file))
+		assert.NoError(t, err, file)
+	}
+}
+
+func TestDecodeRelease(t *testing.T) {
+	release := "Origin: Debian\nSHA256:\n abc 1234 main/binary-amd64/Packages\n def 56 main/binary-amd64/Release\n"
+	repomd, err := decodeRelease(strings.NewReader(release))
+	assert.NoError(t, err)
+	assert.Equal(t, []XMLData{
+		{Type: "main/binary-amd64/Packages", Location: XMLLocation{Href: "main/binary-amd64/Packages"}, Checksum: XMLChecksum{Type: "sha256", Checksum: "abc"}, Size: 1234},
+		{Type: "main/binary-amd64/Release", Location: XMLLocation{Href: "main/binary-amd64/Release"}, Checksum: XMLChecksum{Type: "sha256", Checksum: "def"}, Size: 56},
+	}, repomd.Data)
+
+	_, err = decodeRelease(strings.NewReader("Origin: Debian\nMD5Sum:\n 123 4 Packages\n"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,526 @@
+package get
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/uyuni-project/minima/util"
+)
+
+// zchunk files, as published by Fedora and openSUSE for rpm metadata, are
+// made of independently compressed chunks listed with their checksums in a
+// header. Chunks unchanged since the previous version of a file can thus be
+// reused, only downloading the others
+
+const zckMagic = "\x00ZCK1"
+
+// zckMaxHeaderSize caps the size of zchunk headers read into memory
+const zckMaxHeaderSize = 64 * 1024 * 1024
+
+// zckChecksumType is a checksum type of zchunk files, with the length of its
+// digests. SHA-512/128 digests are the first 128 bits of SHA-512 ones
+type zckChecksumType struct {
+	hash crypto.Hash
+	size int
+}
+
+var zckChecksumTypes = map[uint64]zckChecksumType{
+	0: {crypto.SHA1, 20},
+	1: {crypto.SHA256, 32},
+	2: {crypto.SHA512, 64},
+	3: {crypto.SHA512, 16},
+}
+
+// sum returns the hex digest of data
+func (t zckChecksumType) sum(data []byte) string {
+	h := t.hash.New()
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil)[:t.size])
+}
+
+// flags of the preface of zchunk files
+const (
+	zckFlagStreams               = 1
+	zckFlagOptionalElements      = 2
+	zckFlagUncompressedChecksums = 4
+)
+
+// compression types of zchunk files
+const (
+	zckCompressionNone = 0
+	zckCompressionZstd = 2
+)
+
+// zckChunk is a chunk listed in the index of a zchunk file
+type zckChunk struct {
+	Checksum string
+	// Offset of the chunk from the start of the file
+	Offset             int64
+	Length             int64
+	UncompressedLength int64
+}
+
+// zckHeader is the header of a zchunk file, in its lead, preface and index
+type zckHeader struct {
+	// Size of the lead and header, where data starts
+	Size        int64
+	Compression uint64
+	// ChunkChecksum is the checksum type of chunks
+	ChunkChecksum zckChecksumType
+	// Dict is the chunk of the compression dictionary, which may be empty
+	Dict   zckChunk
+	Chunks []zckChunk
+}
+
+// errZck is returned for malformed zchunk files
+var errZck = errors.New("invalid zchunk file")
+
+// readZckHeader reads the lead and header of a zchunk file, returning them
+// as read and decoded
+func readZckHeader(reader io.Reader) (header zckHeader, raw []byte, err error) {
+	byteReader := &recordingByteReader{reader: reader}
+	magic := make([]byte, len(zckMagic))
+	if _, err = io.ReadFull(byteReader, magic); err != nil || string(magic) != zckMagic {
+		return header, nil, fmt.Errorf("%w: bad magic", errZck)
+	}
+	checksumTypeID, err := readCompint(byteReader)
+	if err != nil {
+		return
+	}
+	checksumType, found := zckChecksumTypes[checksumTypeID]
+	if !found {
+		return header, nil, fmt.Errorf("%w: unknown checksum type %d", errZck, checksumTypeID)
+	}
+	headerSize, err := readCompint(byteReader)
+	if err != nil {
+		return
+	}
+	if headerSize > zckMaxHeaderSize {
+		return header, nil, fmt.Errorf("%w: header of %d bytes", errZck, headerSize)
+	}
+	leadSize := len(byteReader.read) + checksumType.size
+	raw = make([]byte, leadSize+int(headerSize))
+	copy(raw, byteReader.read)
+	if _, err = io.ReadFull(reader, raw[len(byteReader.read):]); err != nil {
+		return header, nil, fmt.Errorf("%w: %w", errZck, err)
+	}
+	header.Size = int64(len(raw))
+
+	// preface
+	headerReader := bytes.NewReader(raw[leadSize:])
+	if _, err = headerReader.Seek(int64(checksumType.size), io.SeekCurrent); err != nil {
+		return
+	}
+	flags, err := readCompint(headerReader)
+	if err != nil {
+		return
+	}
+	if header.Compression, err = readCompint(headerReader); err != nil {
+		return
+	}
+	if flags&zckFlagOptionalElements != 0 {
+		var count uint64
+		if count, err = readCompint(headerReader); err != nil {
+			return
+		}
+		for i := uint64(0); i < count; i++ {
+			if _, err = readCompint(headerReader); err != nil {
+				return
+			}
+			var size uint64
+			if size, err = readCompint(headerReader); err != nil {
+				return
+			}
+			if _, err = headerReader.Seek(int64(size), io.SeekCurrent); err != nil {
+				return
+			}
+		}
+	}
+
+	// index, listing the dictionary first
+	if _, err = readCompint(headerReader); err != nil {
+		return
+	}
+	chunkChecksumTypeID, err := readCompint(headerReader)
+	if err != nil {
+		return
+	}
+	if header.ChunkChecksum, found = zckChecksumTypes[chunkChecksumTypeID]; !found {
+		return header, nil, fmt.Errorf("%w: unknown chunk checksum type %d", errZck, chunkChecksumTypeID)
+	}
+	count, err := readCompint(headerReader)
+	if err != nil {
+		return
+	}
+	if count == 0 {
+		return header, nil, fmt.Errorf("%w: no dictionary chunk", errZck)
+	}
+	offset := header.Size
+	checksum := make([]byte, header.ChunkChecksum.size)
+	for i := uint64(0); i < count; i++ {
+		if flags&zckFlagStreams != 0 {
+			if _, err = readCompint(headerReader); err != nil {
+				return
+			}
+		}
+		if _, err = io.ReadFull(headerReader, checksum); err != nil {
+			return header, nil, fmt.Errorf("%w: %w", errZck, err)
+		}
+		if flags&zckFlagUncompressedChecksums != 0 {
+			if _, err = headerReader.Seek(int64(header.ChunkChecksum.size), io.SeekCurrent); err != nil {
+				return
+			}
+		}
+		var length, uncompressedLength uint64
+		if length, err = readCompint(headerReader); err != nil {
+			return
+		}
+		if uncompressedLength, err = readCompint(headerReader); err != nil {
+			return
+		}
+		chunk := zckChunk{hex.EncodeToString(checksum), offset, int64(length), int64(uncompressedLength)}
+		if chunk.Length < 0 || chunk.UncompressedLength < 0 {
+			return header, nil, fmt.Errorf("%w: chunk of %d bytes", errZck, length)
+		}
+		offset += chunk.Length
+		if i == 0 {
+			header.Dict = chunk
+		} else {
+			header.Chunks = append(header.Chunks, chunk)
+		}
+	}
+	return
+}
+
+// readCompint reads a zchunk compressed integer: 7 bits per byte, least
+// significant first, the last byte having its most significant bit set
+func readCompint(reader io.ByteReader) (uint64, error) {
+	var value uint64
+	for shift := 0; shift < 64; shift += 7 {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return 0, fmt.Errorf("%w: %w", errZck, err)
+		}
+		value |= uint64(b&0x7f) << shift
+		if b&0x80 != 0 {
+			return value, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: integer overflow", errZck)
+}
+
+// recordingByteReader reads bytes one by one, remembering them
+type recordingByteReader struct {
+	reader io.Reader
+	read   []byte
+}
+
+func (r *recordingByteReader) ReadByte() (byte, error) {
+	b := make([]byte, 1)
+	if _, err := io.ReadFull(r.reader, b); err != nil {
+		return 0, err
+	}
+	r.read = append(r.read, b[0])
+	return b[0], nil
+}
+
+func (r *recordingByteReader) Read(p []byte) (n int, err error) {
+	n, err = r.reader.Read(p)
+	r.read = append(r.read, p[:n]...)
+	return
+}
+
+// newZckReader returns the uncompressed content of a zchunk file
+func newZckReader(reader io.Reader) (io.ReadCloser, error) {
+	buffered := bufio.NewReader(reader)
+	header, _, err := readZckHeader(buffered)
+	if err != nil {
+		return nil, err
+	}
+	dict, err := readZckChunk(buffered, header.Dict)
+	if err != nil {
+		return nil, err
+	}
+
+	switch header.Compression {
+	case zckCompressionNone:
+		return &zckReader{reader: buffered, chunks: header.Chunks, decode: func(chunk []byte) ([]byte, error) {
+			return chunk, nil
+		}}, nil
+	case zckCompressionZstd:
+		options := []zstd.DOption{zstd.WithDecoderConcurrency(1)}
+		if len(dict) > 0 {
+			if dict, err = uncompressZstdDict(dict); err != nil {
+				return nil, fmt.Errorf("%w: %w", errZck, err)
+			}
+			options = append(options, zstdDictOption(dict))
+		}
+		decoder, err := zstd.NewReader(nil, options...)
+		if err != nil {
+			return nil, err
+		}
+		return &zckReader{reader: buffered, chunks: header.Chunks, decode: func(chunk []byte) ([]byte, error) {
+			return decoder.DecodeAll(chunk, nil)
+		}, close: decoder.Close}, nil
+	}
+	return nil, fmt.Errorf("%w: unsupported compression type %d", errZck, header.Compression)
+}
+
+// magic numbers starting zstd frames, and zstd dictionaries as opposed to
+// raw content ones
+const (
+	zstdFrameMagic = "\x28\xb5\x2f\xfd"
+	zstdDictMagic  = "\x37\xa4\x30\xec"
+)
+
+// uncompressZstdDict returns the content of a dictionary chunk, which is
+// compressed like other chunks
+func uncompressZstdDict(chunk []byte) ([]byte, error) {
+	if !bytes.HasPrefix(chunk, []byte(zstdFrameMagic)) {
+		return chunk, nil
+	}
+	decoder, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	defer decoder.Close()
+	return decoder.DecodeAll(chunk, nil)
+}
+
+// zstdDictOption returns the option to decode zstd frames with a dictionary
+func zstdDictOption(dict []byte) zstd.DOption {
+	if bytes.HasPrefix(dict, []byte(zstdDictMagic)) {
+		return zstd.WithDecoderDicts(dict)
+	}
+	return zstd.WithDecoderDictRaw(0, dict)
+}
+
+// readZckChunk reads the data of a chunk
+func readZckChunk(reader io.Reader, chunk zckChunk) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(reader, chunk.Length))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) != chunk.Length {
+		return nil, fmt.Errorf("%w: %w", errZck, io.ErrUnexpectedEOF)
+	}
+	return data, nil
+}
+
+// zckReader decodes the chunks of a zchunk file one after the other
+type zckReader struct {
+	reader  io.Reader
+	chunks  []zckChunk
+	decode  func([]byte) ([]byte, error)
+	close   func()
+	current []byte
+}
+
+func (r *zckReader) Read(p []byte) (int, error) {
+	for len(r.current) == 0 {
+		if len(r.chunks) == 0 {
+			return 0, io.EOF
+		}
+		data, err := readZckChunk(r.reader, r.chunks[0])
+		if err != nil {
+			return 0, err
+		}
+		if r.current, err = r.decode(data); err != nil {
+			return 0, fmt.Errorf("%w: %w", errZck, err)
+		}
+		r.chunks = r.chunks[1:]
+	}
+	n := copy(p, r.current)
+	r.current = r.current[n:]
+	return n, nil
+}
+
+func (r *zckReader) Close() error {
+	if r.close != nil {
+		r.close()
+	}
+	return nil
+}
+
+// zckRangeGap is the largest gap between missing chunks downloaded at once
+const zckRangeGap = 16 * 1024
+
+// zckMaxRanges caps the number of requests to download missing chunks,
+// beyond which zchunk files are downloaded in full
+const zckMaxRanges = 32
+
+// downloadZckDelta stores a zchunk file listed in a metadata file by reusing
+// the chunks of its previous version, and only downloading the others. It
+// returns false if the file could not be stored this way, and is to be
+// downloaded in full
+func (r *Syncer) downloadZckDelta(metadataPath string, entry XMLData, repoType RepoType, f util.ReaderConsumer) bool {
+	location := entry.Location.Href
+	if path.Ext(location) != ".zck" || entry.HeaderSize <= 0 {
+		return false
+	}
+	previous, found := r.previousZck(metadataPath, entry, repoType)
+	if !found {
+		return false
+	}
+
+	content, downloaded, err := r.assembleZck(entry, previous)
+	if err == nil {
+		mapper := r.storage.StoringMapper(location, entry.Checksum.Checksum, hashMap[entry.Checksum.Type])
+		err = util.Compose(mapper, f)(util.NewNopReadCloser(bytes.NewReader(content)))
+	}
+	if err != nil {
+		r.logger().Debug("Cannot reuse chunks of the previous version, downloading in full", "file", location, "error", err)
+		return false
+	}
+	if !r.quiet {
+		r.logger().Info("Downloaded changed chunks", "file", location, "downloaded", downloaded, "size", len(content))
+	}
+	r.emit(Event{Type: EventFileDownloaded, File: location, Size: downloaded})
+	return true
+}
+
+// previousZck returns the content of the previous version of a zchunk file,
+// listed with the same type in the stored metadata file, if any
+func (r *Syncer) previousZck(metadataPath string, entry XMLData, repoType RepoType) ([]byte, bool) {
+	reader, err := r.storage.NewReader(metadataPath, Permanent)
+	if err != nil {
+		return nil, false
+	}
+	repomd, err := repoType.DecodeMetadata(reader)
+	reader.Close()
+	if err != nil {
+		return nil, false
+	}
+
+	for _, previous := range repomd.Data {
+		location := previous.Location.Href
+		if previous.Type != entry.Type || location == entry.Location.Href || path.Ext(location) != ".zck" || validateData(previous) != nil {
+			continue
+		}
+		reader, err := r.storage.NewReader(location, Permanent)
+		if err != nil {
+			return nil, false
+		}
+		defer reader.Close()
+		content, err := io.ReadAll(reader)
+		if err != nil {
+			return nil, false
+		}
+		return content, true
+	}
+	return nil, false
+}
+
+// assembleZck returns a zchunk file made of the chunks of a previous version
+// and of the downloaded missing ones, and the downloaded size
+func (r *Syncer) assembleZck(entry XMLData, previous []byte) (content []byte, downloaded int64, err error) {
+	previousHeader, _, err := readZckHeader(bytes.NewReader(previous))
+	if err != nil {
+		return
+	}
+	previousChunks := map[string][]byte{}
+	for _, chunk := range append([]zckChunk{previousHeader.Dict}, previousHeader.Chunks...) {
+		if chunk.Offset+chunk.Length > int64(len(previous)) {
+			break
+		}
+		previousChunks[chunk.Checksum] = previous[chunk.Offset : chunk.Offset+chunk.Length]
+	}
+
+	location := entry.Location.Href
+	rawHeader, err := r.downloadRange(location, 0, entry.HeaderSize-1)
+	if err != nil {
+		return
+	}
+	downloaded += int64(len(rawHeader))
+	if entry.HeaderChecksum.Checksum != "" {
+		hash := hashMap[entry.HeaderChecksum.Type].New()
+		hash.Write(rawHeader)
+		actual := hex.EncodeToString(hash.Sum(nil))
+		if actual != entry.HeaderChecksum.Checksum {
+			return nil, downloaded, util.NewChecksumError(entry.HeaderChecksum.Checksum, actual)
+		}
+	}
+	header, _, err := readZckHeader(bytes.NewReader(rawHeader))
+	if err != nil {
+		return
+	}
+	if header.Size != entry.HeaderSize {
+		return nil, downloaded, fmt.Errorf("%w: header of %d bytes instead of %d", errZck, header.Size, entry.HeaderSize)
+	}
+
+	// chunks are reused if their content matches their checksum
+	chunks := append([]zckChunk{header.Dict}, header.Chunks...)
+	data := make([][]byte, len(chunks))
+	missing := []int{}
+	for i, chunk := range chunks {
+		if previousData, found := previousChunks[chunk.Checksum]; found && header.ChunkChecksum.sum(previousData) == chunk.Checksum {
+			data[i] = previousData
+		} else if chunk.Length > 0 {
+			missing = append(missing, i)
+		}
+	}
+
+	ranges := zckRanges(chunks, missing)
+	if len(ranges) > zckMaxRanges {
+		return nil, downloaded, fmt.Errorf("%d ranges of chunks to download", len(ranges))
+	}
+	for _, byteRange := range ranges {
+		var rangeData []byte
+		rangeData, err = r.downloadRange(location, byteRange.start, byteRange.end)
+		if err != nil {
+			return
+		}
+		downloaded += int64(len(rangeData))
+		for _, i := range byteRange.chunks {
+			start := chunks[i].Offset - byteRange.start
+			data[i] = rangeData[start : start+chunks[i].Length]
+		}
+	}
+
+	content = rawHeader
+	for _, chunkData := range data {
+		content = append(content, chunkData...)
+	}
+	return
+}
+
+// zckRange is a range of bytes of a zchunk file, from start to end included,
+// covering chunks
+type zckRange struct {
+	start  int64
+	end    int64
+	chunks []int
+}
+
+// zckRanges returns the ranges of bytes covering chunks, merging close ones
+func zckRanges(chunks []zckChunk, indexes []int) (ranges []zckRange) {
+	for _, i := range indexes {
+		chunk := chunks[i]
+		last := len(ranges) - 1
+		if last >= 0 && chunk.Offset-ranges[last].end-1 <= zckRangeGap {
+			ranges[last].end = chunk.Offset + chunk.Length - 1
+			ranges[last].chunks = append(ranges[last].chunks, i)
+			continue
+		}
+		ranges = append(ranges, zckRange{chunk.Offset, chunk.Offset + chunk.Length - 1, []int{i}})
+	}
+	return
+}
+
+// downloadRange downloads a range of bytes of a repo-relative path from the
+// repo URL, from start to end included
+func (r *Syncer) downloadRange(relativePath string, start int64, end int64) ([]byte, error) {
+	reader, err := readURLRange(r.client, fileURL(r.URL, relativePath), start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(util.NewSizeCheckingReadCloser(util.NewLimitedReadCloser(reader, r.Limiters...), end-start+1))
+}
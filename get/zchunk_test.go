@@ -0,0 +1,263 @@
+package get
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadCompint(t *testing.T) {
+	for _, value := range []uint64{0, 1, 127, 128, 300, 1 << 40} {
+		decoded, err := readCompint(bytes.NewReader(compint(value)))
+		assert.NoError(t, err)
+		assert.Equal(t, value, decoded)
+	}
+	_, err := readCompint(bytes.NewReader([]byte{0x01, 0x02}))
+	assert.ErrorIs(t, err, errZck)
+}
+
+func TestReadZck(t *testing.T) {
+	primary := `<?xml version="1.0" encoding="UTF-8"?>
+<metadata xmlns="http://linux.duke.edu/metadata/common" packages="2">
+<package type="rpm"><name>a</name><arch>x86_64</arch><location href="x86_64/a.rpm"/></package>
+<package type="rpm"><name>b</name><arch>noarch</arch><location href="noarch/b.rpm"/></package>
+</metadata>
+`
+	chunks := [][]byte{[]byte(primary[:120]), []byte(primary[120:250]), []byte(primary[250:])}
+	for _, dict := range [][]byte{nil, []byte(strings.Repeat("<package type=\"rpm\"><name>", 10))} {
+		zck := encodeZck(t, dict, chunks)
+		header, raw, err := readZckHeader(bytes.NewReader(zck))
+		assert.NoError(t, err)
+		assert.Equal(t, header.Size, int64(len(raw)))
+		assert.Len(t, header.Chunks, 3)
+		assert.Equal(t, int64(130), header.Chunks[1].UncompressedLength)
+
+		uncompressed, err := uncompress(bytes.NewReader(zck), "zck")
+		assert.NoError(t, err)
+		content, err := io.ReadAll(uncompressed)
+		assert.NoError(t, err)
+		assert.Equal(t, primary, string(content))
+		assert.NoError(t, uncompressed.Close())
+
+		metadata, err := readMetaData(bytes.NewReader(zck), "zck")
+		assert.NoError(t, err)
+		assert.Len(t, metadata.Packages, 2)
+	}
+
+	_, err := uncompress(strings.NewReader("\x00ZCK2"), "zck")
+	assert.ErrorIs(t, err, errZck)
+	zck := encodeZck(t, nil, chunks)
+	_, err = io.ReadAll(newZckReaderOrFail(t, zck[:len(zck)-10]))
+	assert.ErrorIs(t, err, errZck)
+}
+
+func TestZckRanges(t *testing.T) {
+	chunks := []zckChunk{{Offset: 100, Length: 10}, {Offset: 110, Length: 20}, {Offset: 130, Length: 30000}, {Offset: 30130, Length: 10}}
+	assert.Equal(t, []zckRange{{100, 129, []int{0, 1}}, {30130, 30139, []int{3}}}, zckRanges(chunks, []int{0, 1, 3}))
+	assert.Empty(t, zckRanges(chunks, []int{}))
+}
+
+func TestStoreRepoZchunk(t *testing.T) {
+	repoDirectory := t.TempDir()
+	if err := os.CopyFS(repoDirectory, os.DirFS(filepath.Join("testdata", "repo"))); err != nil {
+		t.Fatal(err)
+	}
+	original, err := os.ReadFile(filepath.Join(repoDirectory, "repodata", "repomd.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mutex sync.Mutex
+	ranges := []string{}
+	fileServer := http.FileServer(http.Dir(repoDirectory))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if byteRange := r.Header.Get("Range"); byteRange != "" {
+			mutex.Lock()
+			ranges = append(ranges, byteRange)
+			mutex.Unlock()
+		}
+		fileServer.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	repoURL, err := url.Parse(server.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// chunks that do not compress, the second one changing in the next version
+	random := rand.New(rand.NewSource(1))
+	chunks := make([][]byte, 4)
+	for i := range chunks {
+		chunks[i] = make([]byte, 8192)
+		random.Read(chunks[i])
+	}
+	dict := []byte(strings.Repeat("minima zchunk dictionary ", 40))
+	first := addZck(t, repoDirectory, original, encodeZck(t, dict, chunks), bytes.Join(chunks, nil))
+
+	directory := t.TempDir()
+	var events []Event
+	syncer := NewSyncer(*repoURL, NewFileStorage(directory),
+		WithHTTPClient(server.Client()),
+		WithArchs("x86_64"),
+		WithEventHandler(func(event Event) {
+			if event.Type == EventFileDownloaded && strings.HasSuffix(event.File, ".zck") {
+				events = append(events, event)
+			}
+		}),
+	)
+	assert.NoError(t, syncer.StoreRepo())
+	_, err = os.Stat(filepath.Join(directory, filepath.FromSlash(first)))
+	assert.NoError(t, err)
+	assert.Len(t, ranges, 0)
+
+	// second version, only the header and the changed chunk are downloaded
+	chunks[1] = make([]byte, 8192)
+	random.Read(chunks[1])
+	zck := encodeZck(t, dict, chunks)
+	second := addZck(t, repoDirectory, original, zck, bytes.Join(chunks, nil))
+	events = nil
+	assert.NoError(t, syncer.StoreRepo())
+	synced, err := os.ReadFile(filepath.Join(directory, filepath.FromSlash(second)))
+	assert.NoError(t, err)
+	assert.Equal(t, zck, synced)
+	assert.Len(t, ranges, 2)
+	if assert.Len(t, events, 1) {
+		assert.Less(t, events[0].Size, int64(len(zck)/2))
+	}
+
+	// previous chunks not matching their checksum are downloaded again
+	header, _, err := readZckHeader(bytes.NewReader(zck))
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupted := append([]byte{}, zck...)
+	corrupted[header.Chunks[2].Offset] ^= 0xff
+	directory = t.TempDir()
+	if err := os.MkdirAll(filepath.Join(directory, "repodata"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	repomd, err := os.ReadFile(filepath.Join(repoDirectory, "repodata", "repomd.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(directory, "repodata", "repomd.xml"), bytes.ReplaceAll(repomd, []byte(second), []byte(first)), 0644)
+	os.WriteFile(filepath.Join(directory, filepath.FromSlash(first)), corrupted, 0644)
+	syncer = NewSyncer(*repoURL, NewFileStorage(directory), WithHTTPClient(server.Client()), WithArchs("x86_64"))
+	assert.NoError(t, syncer.StoreRepo())
+	synced, err = os.ReadFile(filepath.Join(directory, filepath.FromSlash(second)))
+	assert.NoError(t, err)
+	assert.Equal(t, zck, synced)
+}
+
+// newZckReaderOrFail returns the uncompressed content of a zchunk file
+func newZckReaderOrFail(t *testing.T, zck []byte) io.Reader {
+	reader, err := newZckReader(bytes.NewReader(zck))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reader
+}
+
+// encodeZck returns a zchunk file of zstd compressed chunks, with a raw
+// dictionary if any
+func encodeZck(t *testing.T, dict []byte, chunks [][]byte) []byte {
+	plain, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoder := plain
+	var compressedDict []byte
+	if len(dict) > 0 {
+		compressedDict = plain.EncodeAll(dict, nil)
+		if encoder, err = zstd.NewWriter(nil, zstd.WithEncoderDictRaw(0, dict)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var data, index bytes.Buffer
+	index.Write(compint(3))
+	index.Write(compint(uint64(len(chunks) + 1)))
+	addChunk := func(compressed []byte, uncompressedLength int) {
+		sum := sha512.Sum512(compressed)
+		index.Write(sum[:16])
+		index.Write(compint(uint64(len(compressed))))
+		index.Write(compint(uint64(uncompressedLength)))
+		data.Write(compressed)
+	}
+	addChunk(compressedDict, len(dict))
+	for _, chunk := range chunks {
+		addChunk(encoder.EncodeAll(chunk, nil), len(chunk))
+	}
+
+	var header bytes.Buffer
+	dataSum := sha256.Sum256(data.Bytes())
+	header.Write(dataSum[:])
+	header.Write(compint(0))
+	header.Write(compint(zckCompressionZstd))
+	header.Write(compint(uint64(index.Len())))
+	header.Write(index.Bytes())
+	header.Write(compint(0))
+
+	lead := append([]byte(zckMagic), compint(1)...)
+	lead = append(lead, compint(uint64(header.Len()))...)
+	headerSum := sha256.Sum256(append(append([]byte{}, lead...), header.Bytes()...))
+	return bytes.Join([][]byte{lead, headerSum[:], header.Bytes(), data.Bytes()}, nil)
+}
+
+// compint returns a zchunk compressed integer
+func compint(value uint64) []byte {
+	result := []byte{}
+	for value >= 0x80 {
+		result = append(result, byte(value&0x7f))
+		value >>= 7
+	}
+	return append(result, byte(value)|0x80)
+}
+
+// addZck stores a zchunk file in a repo and lists it in a copy of its
+// original repomd.xml, returning its location
+func addZck(t *testing.T, repoDirectory string, repomd []byte, zck []byte, uncompressed []byte) string {
+	header, raw, err := readZckHeader(bytes.NewReader(zck))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(zck)
+	checksum := hex.EncodeToString(sum[:])
+	location := "repodata/" + checksum + "-other.xml.zck"
+	if err := os.WriteFile(filepath.Join(repoDirectory, filepath.FromSlash(location)), zck, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	openSum := sha256.Sum256(uncompressed)
+	headerSum := sha256.Sum256(raw)
+	entry := fmt.Sprintf(`<data type="other_zck">
+  <checksum type="sha256">%s</checksum>
+  <open-checksum type="sha256">%s</open-checksum>
+  <header-checksum type="sha256">%s</header-checksum>
+  <location href="%s"/>
+  <size>%d</size>
+  <open-size>%d</open-size>
+  <header-size>%d</header-size>
+</data>
+</repomd>`, checksum, hex.EncodeToString(openSum[:]), hex.EncodeToString(headerSum[:]), location, len(zck), len(uncompressed), header.Size)
+	repomd = bytes.Replace(repomd, []byte("</repomd>"), []byte(entry), 1)
+	if err := os.WriteFile(filepath.Join(repoDirectory, "repodata", "repomd.xml"), repomd, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return location
+}
@@ -0,0 +1,30 @@
+package minima
+
+import (
+	"github.com/uyuni-project/minima/get"
+	"github.com/uyuni-project/minima/util"
+)
+
+// Errors returned by a Syncer or a Storage, to be checked with errors.Is and
+// errors.As
+type (
+	// UnexpectedStatusCodeError is returned when a server responds with a
+	// status code other than 200
+	UnexpectedStatusCodeError = get.UnexpectedStatusCodeError
+	// ChecksumError is returned when a downloaded file does not match its checksum
+	ChecksumError = util.ChecksumError
+	// SignatureError is returned when repo metadata has an invalid signature
+	SignatureError = get.SignatureError
+	// MetadataRaceError is returned when repo metadata kept changing while syncing
+	MetadataRaceError = get.MetadataRaceError
+	// ReplicationError is returned when some targets of a fanout Storage failed
+	ReplicationError = get.ReplicationError
+)
+
+var (
+	// ErrFileNotFound is returned by Storage readers for missing files
+	ErrFileNotFound = get.ErrFileNotFound
+	// ErrRepoTypeNotDetected is returned if no registered repo type was found
+	// while probing a repo
+	ErrRepoTypeNotDetected = get.ErrRepoTypeNotDetected
+)
@@ -0,0 +1,222 @@
+// Package minima is the API to embed minima into other programs. It mirrors
+// RPM, Debian, Alpine and Arch Linux repositories from HTTP sources to a
+// Storage:
+//
+//	storage := minima.NewFileStorage("/srv/mirror/repo")
+//	syncer, err := minima.NewSyncer("https://download.example.com/repo/", storage,
+//		minima.WithArchs("x86_64"),
+//		minima.WithConcurrency(4),
+//	)
+//	if err != nil {
+//		return err
+//	}
+//	err = syncer.StoreRepo()
+//
+// Everything is configured through options, this package has no global state.
+package minima
+
+import (
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/uyuni-project/minima/get"
+	"github.com/uyuni-project/minima/util"
+)
+
+// Syncer syncs a repo from an HTTP source to a Storage
+type Syncer = get.Syncer
+
+// Option configures a Syncer
+type Option = get.SyncerOption
+
+// Package is a package listed in repo metadata, as passed to filters
+type Package = get.XMLPackage
+
+// Event describes progress of a Syncer, see WithEventHandler
+type Event = get.Event
+
+// EventType is the kind of an Event
+type EventType = get.EventType
+
+// Event types
+const (
+	EventRepoStarted     = get.EventRepoStarted
+	EventFileDownloaded  = get.EventFileDownloaded
+	EventFileRecycled    = get.EventFileRecycled
+	EventDownloadRetried = get.EventDownloadRetried
+	EventRepoRestarted   = get.EventRepoRestarted
+	EventRepoCommitted   = get.EventRepoCommitted
+)
+
+// PackagePolicy tells whether a kind of packages is synced, see WithSources
+// and WithDebuginfo
+type PackagePolicy = get.PackagePolicy
+
+// Package policies
+const (
+	PolicyDefault = get.PolicyDefault
+	PolicyInclude = get.PolicyInclude
+	PolicyExclude = get.PolicyExclude
+	PolicyOnly    = get.PolicyOnly
+)
+
+// RetryConfig defines how failed downloads are retried
+type RetryConfig = get.RetryConfig
+
+// RateLimiter limits throughput in bytes per second, see WithLimiters
+type RateLimiter = util.RateLimiter
+
+// ProgressTracker reports package download progress, see WithProgress
+type ProgressTracker = get.ProgressTracker
+
+// NewProgressTracker returns a ProgressTracker writing to a file, drawing a
+// status line if the file is a terminal and quiet is false
+func NewProgressTracker(out *os.File, quiet bool) *ProgressTracker {
+	return get.NewProgressTracker(out, quiet)
+}
+
+// NewSyncer returns a Syncer for the repo at repoURL, storing to storage
+func NewSyncer(repoURL string, storage Storage, options ...Option) (*Syncer, error) {
+	parsed, err := url.Parse(repoURL)
+	if err != nil {
+		return nil, err
+	}
+	return get.NewSyncer(*parsed, storage, options...), nil
+}
+
+// WithHTTPClient sets the client used for all downloads, by default
+// http.DefaultClient
+func WithHTTPClient(client *http.Client) Option {
+	return get.WithHTTPClient(client)
+}
+
+// WithLogger sets the logger, by default slog.Default()
+func WithLogger(logger *slog.Logger) Option {
+	return get.WithLogger(logger)
+}
+
+// WithRepoType sets the registered name of the repo type, by default
+// RepoTypeAuto detects it
+func WithRepoType(name string) Option {
+	return get.WithRepoType(name)
+}
+
+// WithRepoName sets the repo name, used in metadata paths of some repo types
+// such as pacman. By default it is taken from the URL path
+func WithRepoName(name string) Option {
+	return get.WithRepoName(name)
+}
+
+// WithRegenerateMetadata rewrites rpm metadata to only refer to synced
+// packages. Regenerated metadata is only signed with WithSigningKey
+func WithRegenerateMetadata(regenerate bool) Option {
+	return get.WithRegenerateMetadata(regenerate)
+}
+
+// WithDeltaRPMs also syncs delta rpms listed in rpm metadata, if they update
+// synced packages
+func WithDeltaRPMs(deltaRPMs bool) Option {
+	return get.WithDeltaRPMs(deltaRPMs)
+}
+
+// WithSources sets whether source packages are synced, by default like
+// others, by arch
+func WithSources(policy PackagePolicy) Option {
+	return get.WithSources(policy)
+}
+
+// WithDebuginfo sets whether debugging information packages are synced, by
+// default like others, by arch
+func WithDebuginfo(policy PackagePolicy) Option {
+	return get.WithDebuginfo(policy)
+}
+
+// WithVerifyAllChecksums verifies files against all the checksums listed in
+// metadata, not only one
+func WithVerifyAllChecksums(verify bool) Option {
+	return get.WithVerifyAllChecksums(verify)
+}
+
+// WithIncludeIndexes only syncs indexes listed in Release files of deb repos
+// whose path, or a parent directory of it, matches one of the patterns in
+// path.Match syntax, or whose name matches one of the patterns without a
+// slash. Release files are rewritten to only list synced indexes
+func WithIncludeIndexes(patterns ...string) Option {
+	return get.WithIncludeIndexes(patterns...)
+}
+
+// WithExcludeIndexes does not sync indexes of deb repos matching one of the
+// patterns, like WithIncludeIndexes
+func WithExcludeIndexes(patterns ...string) Option {
+	return get.WithExcludeIndexes(patterns...)
+}
+
+// WithSigningKey signs metadata rewritten by minima with an armored OpenPGP
+// private key
+func WithSigningKey(key []byte) Option {
+	return get.WithSigningKey(key)
+}
+
+// WithArchs only syncs packages of the given architectures, plus noarch ones
+func WithArchs(archs ...string) Option {
+	return get.WithArchs(archs...)
+}
+
+// WithKeys sets public keys trusted to sign metadata, for repo types whose
+// keys are not published in the repo: PEM RSA keys for apk, OpenPGP keys for
+// pacman
+func WithKeys(keys ...[]byte) Option {
+	return get.WithKeys(keys...)
+}
+
+// WithSkipLegacy skips i586 and i686 packages, otherwise synced along x86_64
+func WithSkipLegacy(skipLegacy bool) Option {
+	return get.WithSkipLegacy(skipLegacy)
+}
+
+// WithFilter only syncs packages for which filter returns true
+func WithFilter(filter func(Package) bool) Option {
+	return get.WithFilter(filter)
+}
+
+// WithConcurrency downloads up to n packages at once, by default 1
+func WithConcurrency(n int) Option {
+	return get.WithConcurrency(n)
+}
+
+// WithEventHandler calls handler on sync events, possibly concurrently
+func WithEventHandler(handler func(Event)) Option {
+	return get.WithEventHandler(handler)
+}
+
+// WithQuiet omits the log message for each downloaded file
+func WithQuiet(quiet bool) Option {
+	return get.WithQuiet(quiet)
+}
+
+// WithMirrorlist downloads files from the mirrors in a mirrorlist
+func WithMirrorlist(mirrorlistURL string) Option {
+	return get.WithMirrorlist(mirrorlistURL)
+}
+
+// WithMetalink downloads files from the mirrors in a metalink
+func WithMetalink(metalinkURL string) Option {
+	return get.WithMetalink(metalinkURL)
+}
+
+// WithRetry sets the policy to retry failed downloads
+func WithRetry(retry RetryConfig) Option {
+	return get.WithRetry(retry)
+}
+
+// WithLimiters throttles downloads through all given limiters
+func WithLimiters(limiters ...*RateLimiter) Option {
+	return get.WithLimiters(limiters...)
+}
+
+// WithProgress reports the progress of package downloads to a ProgressTracker
+func WithProgress(progress *ProgressTracker) Option {
+	return get.WithProgress(progress)
+}
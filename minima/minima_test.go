@@ -0,0 +1,56 @@
+package minima
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSyncer(t *testing.T) {
+	server := httptest.NewServer(http.FileServer(http.Dir(filepath.Join("..", "get", "testdata"))))
+	defer server.Close()
+
+	directory := t.TempDir()
+	var downloaded []string
+	syncer, err := NewSyncer(server.URL+"/repo", NewFileStorage(directory),
+		WithHTTPClient(server.Client()),
+		WithArchs("x86_64"),
+		WithSkipLegacy(true),
+		WithProgress(NewProgressTracker(os.Stderr, true)),
+		WithEventHandler(func(event Event) {
+			if event.Type == EventFileDownloaded {
+				downloaded = append(downloaded, event.File)
+			}
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, syncer.StoreRepo())
+	assert.Contains(t, downloaded, filepath.Join("x86_64", "milkyway-dummy-2.0-1.1.x86_64.rpm"))
+	_, err = os.Stat(filepath.Join(directory, "x86_64", "milkyway-dummy-2.0-1.1.x86_64.rpm"))
+	assert.NoError(t, err)
+
+	// errors are exported
+	syncer, err = NewSyncer(server.URL+"/missing", NewFileStorage(t.TempDir()), WithHTTPClient(server.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = syncer.StoreRepo()
+	assert.ErrorIs(t, err, ErrRepoTypeNotDetected)
+
+	syncer, err = NewSyncer(server.URL+"/missing", NewFileStorage(t.TempDir()), WithHTTPClient(server.Client()), WithRepoType("rpm"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = syncer.StoreRepo()
+	var statusErr *UnexpectedStatusCodeError
+	if assert.True(t, errors.As(err, &statusErr), err) {
+		assert.Equal(t, 404, statusErr.StatusCode)
+	}
+}
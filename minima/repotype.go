@@ -0,0 +1,23 @@
+package minima
+
+import (
+	"github.com/uyuni-project/minima/get"
+)
+
+// RepoType describes a format of repo metadata, eg. RPM or Debian
+type RepoType = get.RepoType
+
+// RepoTypeAuto detects the type of a repo by probing it for the metadata of
+// each registered type, in registration order
+const RepoTypeAuto = get.RepoTypeAuto
+
+// RegisterRepoType makes a repo type available under a name, to be used with
+// WithRepoType or found by auto-detection
+func RegisterRepoType(name string, repoType RepoType) error {
+	return get.RegisterRepoType(name, repoType)
+}
+
+// RegisteredRepoTypes returns all registered repo types, in registration order
+func RegisteredRepoTypes() []RepoType {
+	return get.RegisteredRepoTypes()
+}
@@ -0,0 +1,52 @@
+package minima
+
+import (
+	"github.com/uyuni-project/minima/get"
+)
+
+// Storage stores synced repos
+type Storage = get.Storage
+
+// Storage options
+type (
+	S3Options    = get.S3Options
+	GCSOptions   = get.GCSOptions
+	AzureOptions = get.AzureOptions
+	SFTPOptions  = get.SFTPOptions
+)
+
+// FanoutTarget is a named Storage a fanout Storage replicates to
+type FanoutTarget = get.FanoutTarget
+
+// ReplicationConfig defines how a fanout Storage handles failing targets
+type ReplicationConfig = get.ReplicationConfig
+
+// NewFileStorage returns a Storage in a local directory
+func NewFileStorage(directory string) Storage {
+	return get.NewFileStorage(directory)
+}
+
+// NewS3Storage returns a Storage in an AWS S3 or S3-compatible bucket
+func NewS3Storage(region string, bucket string, options S3Options) (Storage, error) {
+	return get.NewS3Storage(region, bucket, options)
+}
+
+// NewGCSStorage returns a Storage under root in a Google Cloud Storage bucket
+func NewGCSStorage(bucket string, root string, options GCSOptions) (Storage, error) {
+	return get.NewGCSStorage(bucket, root, options)
+}
+
+// NewAzureStorage returns a Storage under root in an Azure Blob Storage container
+func NewAzureStorage(container string, root string, options AzureOptions) (Storage, error) {
+	return get.NewAzureStorage(container, root, options)
+}
+
+// NewSFTPStorage returns a Storage in a directory of a remote host over SFTP
+func NewSFTPStorage(directory string, options SFTPOptions) (Storage, error) {
+	return get.NewSFTPStorage(directory, options)
+}
+
+// NewFanoutStorage returns a Storage replicating to all targets
+func NewFanoutStorage(targets []FanoutTarget, policy ReplicationConfig) Storage {
+	return get.NewFanoutStorage(targets, policy)
+}
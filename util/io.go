@@ -53,6 +53,20 @@ func (r *NopReadCloser) Read(p []byte) (n int, err error) { return r.r.Read(p) }
 // Close does nothing
 func (r *NopReadCloser) Close() error { return nil }
 
+// NopWriteCloser wraps a Writer into a WriteCloser
+type NopWriteCloser struct{ w io.Writer }
+
+// NewNopWriteCloser returns a new NopWriteCloser
+func NewNopWriteCloser(w io.Writer) *NopWriteCloser {
+	return &NopWriteCloser{w}
+}
+
+// Write delegates to the wrapped Write function
+func (w *NopWriteCloser) Write(p []byte) (n int, err error) { return w.w.Write(p) }
+
+// Close does nothing
+func (w *NopWriteCloser) Close() error { return nil }
+
 // TeeReadCloser uses a TeeReader to copy data from a reader to a writer
 type TeeReadCloser struct {
 	reader    io.ReadCloser
@@ -114,6 +128,15 @@ func (w *ChecksummingWriter) Write(p []byte) (n int, err error) {
 	return w.writer.Write(p)
 }
 
+// Sum returns the checksum of the data written so far, or an empty string
+// if no hash function was specified
+func (w *ChecksummingWriter) Sum() string {
+	if w.hashFunction == 0 {
+		return ""
+	}
+	return hex.EncodeToString(w.hash.Sum(nil))
+}
+
 // Close delegates to the writer and checks the hash sum
 func (w *ChecksummingWriter) Close() (err error) {
 	err = w.writer.Close()
@@ -121,7 +144,7 @@ func (w *ChecksummingWriter) Close() (err error) {
 		return
 	}
 	if w.hashFunction != 0 {
-		actualSum := hex.EncodeToString(w.hash.Sum(nil))
+		actualSum := w.Sum()
 		if w.expectedSum != actualSum {
 			err = &ChecksumError{w.expectedSum, actualSum}
 		}
@@ -135,10 +158,64 @@ type ChecksumError struct {
 	actual   string
 }
 
+// NewChecksumError returns a new ChecksumError
+func NewChecksumError(expected string, actual string) *ChecksumError {
+	return &ChecksumError{expected, actual}
+}
+
 func (e *ChecksumError) Error() string {
 	return fmt.Sprintf("Checksum mismatch: expected %s, actual %s", e.expected, e.actual)
 }
 
+// SizeCheckingReadCloser is a ReadCloser that fails as soon as more data than
+// expected is read, or at the end of data if less was read
+type SizeCheckingReadCloser struct {
+	io.ReadCloser
+	expected int64
+	read     int64
+}
+
+// NewSizeCheckingReadCloser returns a new SizeCheckingReadCloser, checking
+// nothing if the expected size is not positive
+func NewSizeCheckingReadCloser(reader io.ReadCloser, expected int64) io.ReadCloser {
+	if expected <= 0 {
+		return reader
+	}
+	return &SizeCheckingReadCloser{reader, expected, 0}
+}
+
+// Read delegates to the wrapped Read function, reading at most one byte more
+// than expected
+func (r *SizeCheckingReadCloser) Read(p []byte) (n int, err error) {
+	if remaining := r.expected - r.read + 1; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err = r.ReadCloser.Read(p)
+	r.read += int64(n)
+	if r.read > r.expected || (err == io.EOF && r.read < r.expected) {
+		err = &SizeError{r.expected, r.read}
+	}
+	return
+}
+
+// SizeError is returned if more or less data than expected was read
+type SizeError struct {
+	expected int64
+	actual   int64
+}
+
+// NewSizeError returns a new SizeError
+func NewSizeError(expected int64, actual int64) *SizeError {
+	return &SizeError{expected, actual}
+}
+
+func (e *SizeError) Error() string {
+	if e.actual > e.expected {
+		return fmt.Sprintf("Size mismatch: expected %d bytes, actual more", e.expected)
+	}
+	return fmt.Sprintf("Size mismatch: expected %d bytes, actual %d", e.expected, e.actual)
+}
+
 // Checksum returns the checksum value from a Reader
 func Checksum(reader io.ReadCloser, hash crypto.Hash) (checksum string, err error) {
 	checksumBuffer := make([]byte, 4*1024*1024)
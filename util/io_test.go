@@ -34,3 +34,30 @@ func TestCompose(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestSizeCheckingReadCloser(t *testing.T) {
+	read := func(content string, expected int64) (string, error) {
+		reader := NewSizeCheckingReadCloser(NewNopReadCloser(bytes.NewBufferString(content)), expected)
+		result, err := io.ReadAll(reader)
+		return string(result), err
+	}
+
+	result, err := read("Hello, World", 12)
+	if err != nil || result != "Hello, World" {
+		t.Error("Unexpected result ", result, err)
+	}
+	result, err = read("Hello, World", 0)
+	if err != nil || result != "Hello, World" {
+		t.Error("Unexpected result ", result, err)
+	}
+
+	// oversized data is not read further than one byte
+	result, err = read("Hello, World", 5)
+	if _, ok := err.(*SizeError); !ok || result != "Hello," {
+		t.Error("Unexpected result ", result, err)
+	}
+	_, err = read("Hello", 12)
+	if _, ok := err.(*SizeError); !ok {
+		t.Error("Expected SizeError, got ", err)
+	}
+}
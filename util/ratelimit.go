@@ -0,0 +1,88 @@
+package util
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// rateLimitChunk is the maximum number of bytes read or written at once
+// through a limited reader or writer, so that waits are short and frequent
+const rateLimitChunk = 32 * 1024
+
+// RateLimiter is a token bucket limiting throughput in bytes per second. It
+// can be shared by any number of readers and writers. A nil RateLimiter does
+// not limit anything
+type RateLimiter struct {
+	mutex sync.Mutex
+	// rate returns the bytes per second allowed at a given time, 0 for no limit
+	rate   func(time.Time) int64
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a new RateLimiter given a function returning the
+// bytes per second allowed at a given time, 0 for no limit
+func NewRateLimiter(rate func(time.Time) int64) *RateLimiter {
+	return &RateLimiter{rate: rate, last: time.Now()}
+}
+
+// WaitN blocks until n bytes can be transferred
+func (l *RateLimiter) WaitN(n int) {
+	if l == nil {
+		return
+	}
+
+	l.mutex.Lock()
+	now := time.Now()
+	rate := l.rate(now)
+	if rate <= 0 {
+		l.tokens = 0
+		l.last = now
+		l.mutex.Unlock()
+		return
+	}
+
+	// allow bursts of up to one second of transfer
+	burst := float64(rate)
+	if burst < rateLimitChunk {
+		burst = rateLimitChunk
+	}
+	l.tokens += now.Sub(l.last).Seconds() * float64(rate)
+	if l.tokens > burst {
+		l.tokens = burst
+	}
+	l.last = now
+	// go into debt, so that concurrent callers queue up
+	l.tokens -= float64(n)
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / float64(rate) * float64(time.Second))
+	}
+	l.mutex.Unlock()
+
+	time.Sleep(wait)
+}
+
+// LimitedReadCloser is a ReadCloser throttled by RateLimiters
+type LimitedReadCloser struct {
+	io.ReadCloser
+	limiters []*RateLimiter
+}
+
+// NewLimitedReadCloser returns a new LimitedReadCloser
+func NewLimitedReadCloser(reader io.ReadCloser, limiters ...*RateLimiter) *LimitedReadCloser {
+	return &LimitedReadCloser{reader, limiters}
+}
+
+// Read delegates to the wrapped Read function, waiting on limiters afterwards
+func (r *LimitedReadCloser) Read(p []byte) (n int, err error) {
+	if len(p) > rateLimitChunk {
+		p = p[:rateLimitChunk]
+	}
+	n, err = r.ReadCloser.Read(p)
+	for _, limiter := range r.limiters {
+		limiter.WaitN(n)
+	}
+	return
+}
@@ -0,0 +1,40 @@
+package util
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestLimitedReadCloser(t *testing.T) {
+	// 64 KiB at 128 KiB/s, after the initial burst of 32 KiB, takes about 250ms
+	limiter := NewRateLimiter(func(time.Time) int64 { return 128 * 1024 })
+	limiter.tokens = rateLimitChunk
+	reader := NewLimitedReadCloser(io.NopCloser(bytes.NewReader(make([]byte, 64*1024))), limiter)
+
+	start := time.Now()
+	n, err := io.Copy(io.Discard, reader)
+	elapsed := time.Since(start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 64*1024 {
+		t.Errorf("Expected 65536 bytes, got %d", n)
+	}
+	if elapsed < 200*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("Unexpected time to read: %v", elapsed)
+	}
+
+	// no limit
+	unlimited := NewRateLimiter(func(time.Time) int64 { return 0 })
+	var nilLimiter *RateLimiter
+	reader = NewLimitedReadCloser(io.NopCloser(bytes.NewReader(make([]byte, 10*1024*1024))), unlimited, nilLimiter)
+	start = time.Now()
+	if _, err = io.Copy(io.Discard, reader); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("Unlimited reader was throttled")
+	}
+}